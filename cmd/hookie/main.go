@@ -0,0 +1,159 @@
+// Command hookie generates the registrations of the models that embed in.Inject, listing them with how
+// they embed it, so they are registered at init rather than detected when first written. Add to a
+// package of your binary, usually main:
+//
+//	//go:generate go run github.com/DeimosTech/hookie/cmd/hookie gen
+//
+// It also checks that audit logs were not modified or removed:
+//
+//	hookie verify -uri mongodb://localhost:27017 -db app
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	hookiemongo "github.com/DeimosTech/hookie/db/mongo"
+	"github.com/DeimosTech/hookie/hooks"
+	"github.com/DeimosTech/hookie/internal/hook"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/tools/go/packages"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "gen":
+		err = gen(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hookie:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hookie gen [-o file] [-pkg name] [-root dir]")
+	fmt.Fprintln(os.Stderr, "       hookie verify -db name [-uri uri] [-doc id]")
+}
+
+// gen writes the registrations of every model in the module to a file in the current package
+func gen(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	out := fs.String("o", "hookie_gen.go", "output file")
+	pkgName := fs.String("pkg", "", "package name of the output file, defaults to the package in the current directory")
+	root := fs.String("root", "", "module root to scan, defaults to the nearest directory containing go.mod")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	if *root == "" {
+		dir, err := findModuleRoot()
+		if err != nil {
+			return err
+		}
+		*root = dir
+	}
+	if *pkgName == "" {
+		name, err := currentPackageName(ctx)
+		if err != nil {
+			return err
+		}
+		*pkgName = name
+	}
+
+	models, err := hook.DiscoverModels(ctx, *root)
+	if err != nil {
+		return err
+	}
+	for _, m := range models {
+		fmt.Fprintf(os.Stderr, "%s.%s: %s\n", m.PkgPath, m.Name, m.Reason)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = hook.Generate(f, *pkgName, models); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verify walks the audit chains stored in a database and reports every problem found
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	uri := fs.String("uri", "mongodb://localhost:27017", "MongoDB connection string")
+	dbName := fs.String("db", "", "database holding the audit collections")
+	docId := fs.String("doc", "", "only verify the document with this id")
+	_ = fs.Parse(args)
+	if *dbName == "" {
+		return errors.New("-db is required")
+	}
+
+	ctx := context.Background()
+	cl, err := mongo.Connect(ctx, options.Client().ApplyURI(*uri))
+	if err != nil {
+		return err
+	}
+	defer cl.Disconnect(ctx)
+	history := hooks.NewHistory(hookiemongo.InitMongo(cl, *dbName))
+
+	var issues []hooks.ChainIssue
+	if *docId != "" {
+		issues, err = history.VerifyDocument(ctx, *docId)
+	} else {
+		issues, err = history.Verify(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d problems found in audit logs", len(issues))
+	}
+	fmt.Println("audit logs verified")
+	return nil
+}
+
+func findModuleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("could not find go.mod")
+		}
+		dir = parent
+	}
+}
+
+func currentPackageName(ctx context.Context) (string, error) {
+	pkgs, err := packages.Load(&packages.Config{Context: ctx, Mode: packages.NeedName}, ".")
+	if err != nil {
+		return "", err
+	}
+	if len(pkgs) == 0 || pkgs[0].Name == "" {
+		return "", errors.New("no Go package in current directory, set -pkg")
+	}
+	return pkgs[0].Name, nil
+}
@@ -25,6 +25,7 @@ type NoSql interface {
 	Aggregate(ctx context.Context, col string, q []interface{}, v interface{}) error
 	AggregateWithDiskUse(ctx context.Context, col string, q []interface{}, v interface{}) error
 	Distinct(ctx context.Context, col, field string, q interface{}, v interface{}) error
+	DeleteOne(ctx context.Context, col string, filter interface{}) error
 	DeleteMany(ctx context.Context, col string, filter interface{}) error
 }
 
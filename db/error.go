@@ -1,6 +1,9 @@
 package db
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // List of errors
 var (
@@ -8,4 +11,43 @@ var (
 	ErrNotFound        = errors.New("document: not found")
 	ErrDuplicateKey    = errors.New("infra: duplicate key")
 	ErrInvalidData     = errors.New("infra: invalid data")
+	ErrVersionConflict = errors.New("document: version conflict")
 )
+
+// HookError wraps an error returned by a hook. Errors from PreSave and PreDelete abort the write,
+// errors from PostSave and PostDelete are reported after the write has been persisted, unless it runs in
+// a transaction, which they roll back.
+type HookError struct {
+	Hook  string // PreSave, PostSave, PreDelete, PostDelete, PreFind, PostFind or PostRead
+	Col   string
+	DocId string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	if e.DocId == "" {
+		return fmt.Sprintf("hook: %s on %s failed: %v", e.Hook, e.Col, e.Err)
+	}
+	return fmt.Sprintf("hook: %s on %s/%s failed: %v", e.Hook, e.Col, e.DocId, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is returned by Update when the document of a versioned model was updated since the version
+// being written was read. It matches ErrVersionConflict.
+type ConflictError struct {
+	Col     string
+	DocId   string
+	Version int64 // version the update expected
+	Current int64 // version stored
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("document: version conflict on %s/%s: updating version %d, stored version is %d", e.Col, e.DocId, e.Version, e.Current)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"reflect"
+)
+
+// RunPreFind runs the PreFind hook of the model v decodes into, then the one of h, and returns the filter
+// to query with. Models opt in by implementing in.PreFindHook.
+func RunPreFind(ctx context.Context, h in.Hook, filter interface{}, v interface{}, col, ops string) (interface{}, error) {
+	if HooksDisabled(ctx) {
+		return filter, nil
+	}
+	var err error
+	if hook, ok := modelOf(v).(in.PreFindHook); ok {
+		if filter, err = hook.PreFind(ctx, filter, col, ops); err != nil {
+			return nil, &HookError{Hook: "PreFind", Col: col, Err: err}
+		}
+	}
+	if hook, ok := h.(in.PreFindHook); ok {
+		if filter, err = hook.PreFind(ctx, filter, col, ops); err != nil {
+			return nil, &HookError{Hook: "PreFind", Col: col, Err: err}
+		}
+	}
+	return filter, nil
+}
+
+// RunPostFind runs the PostFind hook of the decoded document doc, then the one of h. It reports whether
+// a hook dropped doc.
+func RunPostFind(ctx context.Context, h in.Hook, doc interface{}, filter interface{}, col, ops string) (bool, error) {
+	if HooksDisabled(ctx) {
+		return false, nil
+	}
+	if hook, ok := doc.(in.PostFindHook); ok {
+		if err := hook.PostFind(ctx, doc, filter, col, ops); err != nil {
+			return postFindResult(col, err)
+		}
+	}
+	if hook, ok := h.(in.PostFindHook); ok {
+		if err := hook.PostFind(ctx, doc, filter, col, ops); err != nil {
+			return postFindResult(col, err)
+		}
+	}
+	return false, nil
+}
+
+type pageKey struct{}
+
+// Page is what a List read before its PostFind hooks dropped any document, so callers paging through
+// results can tell the end of the results from a page the hooks shortened
+type Page struct {
+	Read     int64       // number of documents read
+	LastId   interface{} // _id of the last document read, nil when none was
+	Recorded bool        // whether the List recorded the page
+}
+
+// WithPage returns a copy of ctx for which List records the documents it reads in page
+func WithPage(ctx context.Context, page *Page) context.Context {
+	return context.WithValue(ctx, pageKey{}, page)
+}
+
+// RunPostFindAll runs the PostFind hooks on every document of the slice v points to, removing the dropped
+// ones from it
+func RunPostFindAll(ctx context.Context, h in.Hook, v interface{}, filter interface{}, col, ops string) error {
+	slice := reflect.ValueOf(v)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return nil
+	}
+	slice = slice.Elem()
+	if page, ok := ctx.Value(pageKey{}).(*Page); ok && ops == "list" {
+		recordPage(page, slice)
+	}
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	kept := reflect.MakeSlice(slice.Type(), 0, slice.Len())
+	dropped := false
+	for i := 0; i < slice.Len(); i++ {
+		elem := slice.Index(i)
+		doc := elem.Addr().Interface()
+		if elem.Kind() == reflect.Ptr {
+			doc = elem.Interface()
+		}
+		drop, err := RunPostFind(ctx, h, doc, filter, col, ops)
+		if err != nil {
+			return err
+		}
+		if drop {
+			dropped = true
+			continue
+		}
+		kept = reflect.Append(kept, elem)
+	}
+	if dropped {
+		slice.Set(kept)
+	}
+	return nil
+}
+
+// recordPage records the documents of slice in page
+func recordPage(page *Page, slice reflect.Value) {
+	*page = Page{Read: int64(slice.Len()), Recorded: true}
+	if slice.Len() == 0 {
+		return
+	}
+	data, err := bson.Marshal(slice.Index(slice.Len() - 1).Interface())
+	if err != nil {
+		return
+	}
+	var doc struct {
+		Id interface{} `bson:"_id"`
+	}
+	if bson.Unmarshal(data, &doc) == nil {
+		page.LastId = doc.Id
+	}
+}
+
+// RunPostRead runs the PostRead hook of h once the results of a read are final
+func RunPostRead(ctx context.Context, h in.Hook, result interface{}, filter interface{}, col, ops string) error {
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	if hook, ok := h.(in.PostReadHook); ok {
+		if err := hook.PostRead(ctx, result, filter, col, ops); err != nil {
+			return &HookError{Hook: "PostRead", Col: col, Err: err}
+		}
+	}
+	return nil
+}
+
+// AggregatePipeline returns the pipeline returned by the PreFind hooks of an aggregate
+func AggregatePipeline(pipeline interface{}) ([]interface{}, error) {
+	switch p := pipeline.(type) {
+	case []interface{}:
+		return p, nil
+	case bson.A:
+		return p, nil
+	case mongo.Pipeline:
+		stages := make([]interface{}, len(p))
+		for i, stage := range p {
+			stages[i] = stage
+		}
+		return stages, nil
+	}
+	return nil, fmt.Errorf("%w: PreFind returned a %T as aggregate pipeline", ErrInvalidData, pipeline)
+}
+
+func postFindResult(col string, err error) (bool, error) {
+	if errors.Is(err, in.ErrDropResult) {
+		return true, nil
+	}
+	return false, &HookError{Hook: "PostFind", Col: col, Err: err}
+}
+
+// modelOf returns a zero value of the model v decodes into, v pointing to a model or to a slice of them
+func modelOf(v interface{}) interface{} {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil
+	}
+	t = t.Elem()
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface()
+}
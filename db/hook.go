@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	in "github.com/DeimosTech/hookie/instance"
+)
+
+type noHooksKey struct{}
+
+// WithoutHooks returns a copy of ctx for which writes do not run hooks, as used when writing audit storage
+func WithoutHooks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noHooksKey{}, true)
+}
+
+// HooksDisabled reports whether ctx was made by WithoutHooks
+func HooksDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(noHooksKey{}).(bool)
+	return disabled
+}
+
+type redeliveryKey struct{}
+
+// WithRedelivery returns a copy of ctx marking hooks run with it as replayed, they may have run for the same
+// write already
+func WithRedelivery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, redeliveryKey{}, true)
+}
+
+// IsRedelivery reports whether ctx was made by WithRedelivery
+func IsRedelivery(ctx context.Context) bool {
+	redelivered, _ := ctx.Value(redeliveryKey{}).(bool)
+	return redelivered
+}
+
+// RunPreSave runs the PreSave hook of h, wrapping its error so callers can tell it apart from database errors
+func RunPreSave(ctx context.Context, h in.Hook, model interface{}, filter interface{}, col, ops, docId string) error {
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	if err := h.PreSave(ctx, model, filter, col, ops, docId); err != nil {
+		return &HookError{Hook: "PreSave", Col: col, DocId: docId, Err: err}
+	}
+	return nil
+}
+
+func RunPostSave(ctx context.Context, h in.Hook, model interface{}, filter interface{}, col, ops, docId string) error {
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	if err := h.PostSave(ctx, model, filter, col, ops, docId); err != nil {
+		return &HookError{Hook: "PostSave", Col: col, DocId: docId, Err: err}
+	}
+	return nil
+}
+
+func RunPreDelete(ctx context.Context, h in.Hook, model interface{}, filter interface{}, col, docId string) error {
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	if err := h.PreDelete(ctx, model, filter, col, docId); err != nil {
+		return &HookError{Hook: "PreDelete", Col: col, DocId: docId, Err: err}
+	}
+	return nil
+}
+
+func RunPostDelete(ctx context.Context, h in.Hook, model interface{}, filter interface{}, col, docId string) error {
+	if HooksDisabled(ctx) {
+		return nil
+	}
+	if err := h.PostDelete(ctx, model, filter, col, docId); err != nil {
+		return &HookError{Hook: "PostDelete", Col: col, DocId: docId, Err: err}
+	}
+	return nil
+}
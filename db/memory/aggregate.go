@@ -0,0 +1,298 @@
+package memory
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"strings"
+)
+
+// aggregate runs pipeline over docs, supporting the stages $match, $sort, $skip, $limit, $project,
+// $unwind, $group and $count
+func aggregate(docs []bson.M, pipeline []bson.M) ([]bson.M, error) {
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("memory: a pipeline stage must have exactly one field")
+		}
+		for name, arg := range stage {
+			var err error
+			switch name {
+			case "$match":
+				docs, err = stageMatch(docs, arg)
+			case "$sort":
+				docs, err = stageSort(docs, arg)
+			case "$skip":
+				n, _ := toFloat(arg)
+				if int(n) >= len(docs) {
+					docs = nil
+				} else {
+					docs = docs[int(n):]
+				}
+			case "$limit":
+				n, _ := toFloat(arg)
+				if int(n) < len(docs) {
+					docs = docs[:int(n)]
+				}
+			case "$project":
+				docs, err = stageProject(docs, arg)
+			case "$unwind":
+				docs, err = stageUnwind(docs, arg)
+			case "$group":
+				docs, err = stageGroup(docs, arg)
+			case "$count":
+				field, ok := arg.(string)
+				if !ok {
+					return nil, fmt.Errorf("memory: $count needs a field name")
+				}
+				docs = []bson.M{{field: int32(len(docs))}}
+			default:
+				err = fmt.Errorf("memory: unsupported pipeline stage %s", name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return docs, nil
+}
+
+func stageMatch(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	filter, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("memory: $match needs a document")
+	}
+	var matched []bson.M
+	for _, doc := range docs {
+		ok, err := match(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+	return matched, nil
+}
+
+func stageSort(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, err := toSortSpec([]interface{}{arg})
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]bson.M(nil), docs...)
+	sortDocs(sorted, spec)
+	return sorted, nil
+}
+
+// stageProject supports including or excluding fields, and computing fields from "$field" references
+func stageProject(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("memory: $project needs a document")
+	}
+	exclude := false
+	for key, v := range spec {
+		if n, ok := toFloat(v); ok && n == 0 && key != "_id" {
+			exclude = true
+		} else if b, ok := v.(bool); ok && !b && key != "_id" {
+			exclude = true
+		}
+	}
+	projected := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		var out bson.M
+		if exclude {
+			out = deepCopy(doc).(bson.M)
+			for key := range spec {
+				unsetPath(out, splitPath(key))
+			}
+		} else {
+			out = bson.M{}
+			if id, ok := doc["_id"]; ok {
+				out["_id"] = id
+			}
+			for key, v := range spec {
+				if included(v) {
+					if value := getPath(doc, splitPath(key)); value != nil {
+						_ = setPath(out, splitPath(key), deepCopy(value))
+					}
+					continue
+				}
+				if key == "_id" {
+					delete(out, "_id")
+					continue
+				}
+				value, err := evalExpr(doc, v)
+				if err != nil {
+					return nil, err
+				}
+				_ = setPath(out, splitPath(key), value)
+			}
+		}
+		projected = append(projected, out)
+	}
+	return projected, nil
+}
+
+func included(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	n, ok := toFloat(v)
+	return ok && n != 0
+}
+
+func stageUnwind(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	path, ok := arg.(string)
+	if spec, isDoc := arg.(bson.M); isDoc {
+		path, ok = spec["path"].(string)
+	}
+	if !ok || !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("memory: $unwind needs a $field path")
+	}
+	field := splitPath(path[1:])
+	var unwound []bson.M
+	for _, doc := range docs {
+		arr, ok := getPath(doc, field).(bson.A)
+		if !ok {
+			continue
+		}
+		for _, elem := range arr {
+			out := deepCopy(doc).(bson.M)
+			_ = setPath(out, field, deepCopy(elem))
+			unwound = append(unwound, out)
+		}
+	}
+	return unwound, nil
+}
+
+// stageGroup supports the accumulators $sum, $avg, $min, $max, $first, $last, $push and $addToSet
+func stageGroup(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("memory: $group needs a document")
+	}
+	idExpr, ok := spec["_id"]
+	if !ok {
+		return nil, fmt.Errorf("memory: $group needs an _id")
+	}
+	var (
+		groups []bson.M
+		keys   []interface{}
+		counts []int
+	)
+	for _, doc := range docs {
+		key, err := evalExpr(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		idx := -1
+		for i, k := range keys {
+			if equal(k, key) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			idx = len(groups)
+			groups = append(groups, bson.M{"_id": key})
+			keys = append(keys, key)
+			counts = append(counts, 0)
+		}
+		counts[idx]++
+		group := groups[idx]
+		for field, acc := range spec {
+			if field == "_id" {
+				continue
+			}
+			accDoc, ok := acc.(bson.M)
+			if !ok || len(accDoc) != 1 {
+				return nil, fmt.Errorf("memory: $group field %s needs one accumulator", field)
+			}
+			for op, expr := range accDoc {
+				value, err := evalExpr(doc, expr)
+				if err != nil {
+					return nil, err
+				}
+				if err = accumulate(group, field, op, value, counts[idx]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return groups, nil
+}
+
+func accumulate(group bson.M, field, op string, value interface{}, n int) error {
+	current, seen := group[field]
+	switch op {
+	case "$sum":
+		if _, ok := toFloat(value); !ok {
+			value = int32(0)
+		}
+		if !seen {
+			group[field] = value
+			return nil
+		}
+		sum, err := add(current, value)
+		if err != nil {
+			return err
+		}
+		group[field] = sum
+	case "$avg":
+		f, ok := toFloat(value)
+		if !ok {
+			return nil
+		}
+		prev, _ := toFloat(current)
+		group[field] = prev + (f-prev)/float64(n)
+	case "$min", "$max":
+		if value == nil {
+			return nil
+		}
+		c, _ := compare(value, current)
+		if !seen || current == nil || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+			group[field] = value
+		}
+	case "$first":
+		if !seen {
+			group[field] = value
+		}
+	case "$last":
+		group[field] = value
+	case "$push", "$addToSet":
+		arr, _ := current.(bson.A)
+		if op == "$addToSet" && matchEqual([]interface{}{arr}, value) {
+			group[field] = arr
+			return nil
+		}
+		group[field] = append(arr, value)
+	default:
+		return fmt.Errorf("memory: unsupported accumulator %s", op)
+	}
+	return nil
+}
+
+// evalExpr evaluates "$field" references, documents of them and literals
+func evalExpr(doc bson.M, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			return deepCopy(getPath(doc, splitPath(e[1:]))), nil
+		}
+		return e, nil
+	case bson.M:
+		if isOperatorDoc(e) {
+			return nil, fmt.Errorf("memory: unsupported expression %v", e)
+		}
+		out := bson.M{}
+		for key, sub := range e {
+			value, err := evalExpr(doc, sub)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = value
+		}
+		return out, nil
+	}
+	return expr, nil
+}
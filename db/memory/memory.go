@@ -0,0 +1,659 @@
+// Package memory is an in-memory implementation of db.NoSql for unit tests. It runs the same hooks as
+// the Mongo client, so audit behaviour can be tested without a database.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"sync"
+)
+
+var errNotSlicePtr = errors.New("memory: result argument must be a pointer to a slice")
+
+// Memory holds collections of documents in memory
+type Memory struct {
+	mu    sync.RWMutex
+	cols  map[string]*collection
+	hooks *in.Chain
+}
+
+type collection struct {
+	docs    []bson.M
+	indexes []db.Index
+}
+
+var _ db.NoSql = (*Memory)(nil)
+
+// New returns an empty store running hooks in the given order around every write and read
+func New(hooks ...in.Hook) *Memory {
+	return &Memory{
+		cols:  make(map[string]*collection),
+		hooks: in.NewChain(hooks...),
+	}
+}
+
+// Hooks returns the hook chain driven by the store
+func (m *Memory) Hooks() *in.Chain {
+	return m.hooks
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+// EnsureIndices creates indices for collection col, failing when existing docs violate a unique index
+func (m *Memory) EnsureIndices(ctx context.Context, col string, index []db.Index) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.collection(col)
+	indexes := append([]db.Index(nil), c.indexes...)
+	for _, ind := range index {
+		if ind.Name == "" {
+			ind.Name = indexName(ind)
+		}
+		replaced := false
+		for i := range indexes {
+			if indexes[i].Name == ind.Name {
+				indexes[i], replaced = ind, true
+			}
+		}
+		if !replaced {
+			indexes = append(indexes, ind)
+		}
+	}
+	for i, doc := range c.docs {
+		if err := checkUnique(c.docs, indexes, doc, i); err != nil {
+			return err
+		}
+	}
+	c.indexes = indexes
+	return nil
+}
+
+// DropIndices drops indices from collection col
+func (m *Memory) DropIndices(ctx context.Context, col string, index []db.Index) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collection(col).indexes = nil
+	return nil
+}
+
+// Insert inserts doc into collection
+func (m *Memory) Insert(ctx context.Context, col string, doc interface{}) error {
+	if err := db.RunPreSave(ctx, m.hooks, doc, nil, col, "insert", ""); err != nil {
+		return err
+	}
+	ids, err := m.insert(col, []interface{}{doc})
+	if err != nil {
+		return err
+	}
+	return db.RunPostSave(ctx, m.hooks, doc, nil, col, "insert", idToString(ids[0]))
+}
+
+// InsertMany inserts docs into collection, all or none of them
+func (m *Memory) InsertMany(ctx context.Context, col string, docs []interface{}) error {
+	for _, doc := range docs {
+		if err := db.RunPreSave(ctx, m.hooks, doc, nil, col, "insert", ""); err != nil {
+			return err
+		}
+	}
+	ids, err := m.insert(col, docs)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, doc := range docs {
+		errs = append(errs, db.RunPostSave(ctx, m.hooks, doc, nil, col, "insert", idToString(ids[i])))
+	}
+	return errors.Join(errs...)
+}
+
+// FindOne finds a doc by query
+func (m *Memory) FindOne(ctx context.Context, col string, q interface{}, v interface{}, sort ...interface{}) error {
+	q, err := db.RunPreFind(ctx, m.hooks, db.ScopeFilter(ctx, col, q), v, col, "findOne")
+	if err != nil {
+		return err
+	}
+	docs, err := m.find(col, q, sort, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return db.ErrNotFound
+	}
+	if err = decode(docs[0], v); err != nil {
+		return err
+	}
+	dropped, err := db.RunPostFind(ctx, m.hooks, v, q, col, "findOne")
+	if err != nil {
+		return err
+	}
+	if dropped {
+		return db.ErrNotFound
+	}
+	return db.RunPostRead(ctx, m.hooks, v, q, col, "findOne")
+}
+
+// List finds list of docs that matches query with skip and limit, a limit of 0 meaning no limit
+func (m *Memory) List(ctx context.Context, col string, filter interface{}, skip, limit int64, v interface{}, sort ...interface{}) error {
+	filter, err := db.RunPreFind(ctx, m.hooks, db.ScopeFilter(ctx, col, filter), v, col, "list")
+	if err != nil {
+		return err
+	}
+	docs, err := m.find(col, filter, sort, skip, limit)
+	if err != nil {
+		return err
+	}
+	if err = decodeAll(docs, v); err != nil {
+		return err
+	}
+	if err = db.RunPostFindAll(ctx, m.hooks, v, filter, col, "list"); err != nil {
+		return err
+	}
+	return db.RunPostRead(ctx, m.hooks, v, filter, col, "list")
+}
+
+func (m *Memory) Count(ctx context.Context, col string, q interface{}) (int64, error) {
+	docs, err := m.find(col, db.ScopeFilter(ctx, col, q), nil, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
+
+// Aggregate runs aggregation q on docs and store the result on v
+func (m *Memory) Aggregate(ctx context.Context, col string, q []interface{}, v interface{}) error {
+	rewritten, err := db.RunPreFind(ctx, m.hooks, db.ScopePipeline(ctx, col, q), v, col, "aggregate")
+	if err != nil {
+		return err
+	}
+	if q, err = db.AggregatePipeline(rewritten); err != nil {
+		return err
+	}
+	pipeline := make([]bson.M, 0, len(q))
+	for _, stage := range q {
+		doc, err := toDoc(stage)
+		if err != nil {
+			return err
+		}
+		pipeline = append(pipeline, doc)
+	}
+	docs, err := m.find(col, nil, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	if docs, err = aggregate(docs, pipeline); err != nil {
+		return err
+	}
+	if err = decodeAll(docs, v); err != nil {
+		return err
+	}
+	return db.RunPostFindAll(ctx, m.hooks, v, q, col, "aggregate")
+}
+
+func (m *Memory) AggregateWithDiskUse(ctx context.Context, col string, q []interface{}, v interface{}) error {
+	return m.Aggregate(ctx, col, q, v)
+}
+
+func (m *Memory) Distinct(ctx context.Context, col, field string, q interface{}, v interface{}) error {
+	docs, err := m.find(col, db.ScopeFilter(ctx, col, q), nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	var values []interface{}
+	for _, doc := range docs {
+		for _, value := range expandArrays(lookup(doc, splitPath(field))) {
+			if !containsValue(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+	if values == nil {
+		values = []interface{}{}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Update sets data on the first doc matching filter. For versioned models, like the Mongo client, it
+// increments the version and returns a *db.ConflictError when the version carried by data is stale.
+func (m *Memory) Update(ctx context.Context, col string, filter interface{}, data interface{}) error {
+	if err := db.RunPreSave(ctx, m.hooks, data, filter, col, "update", ""); err != nil {
+		return err
+	}
+	target, update, checked, err := db.VersionedUpdate(col, filter, data)
+	if err != nil {
+		return err
+	}
+	updated, err := m.update(col, target, update, true, false, nil)
+	if err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		if checked != nil {
+			return db.Conflict(ctx, m, col, filter, *checked)
+		}
+		// Same as the Mongo client, which returns the error of decoding the missing doc
+		return mongo.ErrNoDocuments
+	}
+	return db.RunPostSave(db.WithStoredVersion(ctx, col, updated[0]), m.hooks, data, filter, col, "update", idToString(updated[0]["_id"]))
+}
+
+// PartialUpdateMany sets data on all docs matching filter, running the save hooks for each doc
+func (m *Memory) PartialUpdateMany(ctx context.Context, col string, filter interface{}, data interface{}) error {
+	ids, err := m.matchedIds(col, filter, false)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	for _, id := range ids {
+		if err = db.RunPreSave(ctx, m.hooks, data, filter, col, "update", idToString(id)); err != nil {
+			return err
+		}
+	}
+	update, _ := db.IncrementVersion(col, bson.M{"$set": data})
+	updated, err := m.update(col, filter, update, false, false, ids)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, doc := range updated {
+		errs = append(errs, db.RunPostSave(db.WithStoredVersion(ctx, col, doc), m.hooks, data, filter, col, "update", idToString(doc["_id"])))
+	}
+	return errors.Join(errs...)
+}
+
+// PartialUpdateManyByQuery applies query to all docs matching filter. As with the Mongo client, PostSave
+// receives the stored document after the update.
+func (m *Memory) PartialUpdateManyByQuery(ctx context.Context, col string, filter interface{}, query db.UnorderedDbQuery) error {
+	ids, err := m.matchedIds(col, filter, false)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	for _, id := range ids {
+		if err = db.RunPreSave(ctx, m.hooks, query, filter, col, "update", idToString(id)); err != nil {
+			return err
+		}
+	}
+	update, _ := db.IncrementVersion(col, bson.M(query))
+	updated, err := m.update(col, filter, update, false, false, ids)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, doc := range updated {
+		errs = append(errs, db.RunPostSave(ctx, m.hooks, in.Document(doc), filter, col, "update", idToString(doc["_id"])))
+	}
+	return errors.Join(errs...)
+}
+
+// BulkUpdate applies models one after the other, running the same hooks as the Mongo client.
+// Unlike a server bulk write, models applied before a failing one stay applied.
+func (m *Memory) BulkUpdate(ctx context.Context, col string, models []mongo.WriteModel) error {
+	var errs []error
+	for _, model := range models {
+		var err error
+		switch w := model.(type) {
+		case *mongo.InsertOneModel:
+			err = m.Insert(ctx, col, w.Document)
+		case *mongo.UpdateOneModel:
+			err = m.bulkUpdate(ctx, col, w.Filter, w.Update, true, w.Upsert, true)
+		case *mongo.UpdateManyModel:
+			err = m.bulkUpdate(ctx, col, w.Filter, w.Update, false, w.Upsert, true)
+		case *mongo.ReplaceOneModel:
+			err = m.bulkUpdate(ctx, col, w.Filter, w.Replacement, true, w.Upsert, false)
+		case *mongo.DeleteOneModel:
+			err = m.DeleteOne(ctx, col, w.Filter)
+			if errors.Is(err, db.ErrNotFound) {
+				err = nil
+			}
+		case *mongo.DeleteManyModel:
+			err = m.DeleteMany(ctx, col, w.Filter)
+		default:
+			err = fmt.Errorf("memory: unsupported write model %T", model)
+		}
+		var hookErr *db.HookError
+		if err != nil && !(errors.As(err, &hookErr) && (hookErr.Hook == "PostSave" || hookErr.Hook == "PostDelete")) {
+			return errors.Join(append(errs, err)...)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// bulkUpdate applies a single update or replace model of a bulk write. PostSave receives the stored doc
+// when post is set, as the update operators are arbitrary.
+func (m *Memory) bulkUpdate(ctx context.Context, col string, filter, update interface{}, one bool, upsert *bool, post bool) error {
+	ids, err := m.matchedIds(col, filter, one)
+	if err != nil {
+		return err
+	}
+	doUpsert := upsert != nil && *upsert && len(ids) == 0
+	for _, id := range ids {
+		if err = db.RunPreSave(ctx, m.hooks, update, filter, col, "update", idToString(id)); err != nil {
+			return err
+		}
+	}
+	if doUpsert {
+		if err = db.RunPreSave(ctx, m.hooks, update, filter, col, "update", ""); err != nil {
+			return err
+		}
+	}
+	updated, err := m.update(col, filter, update, one, doUpsert, ids)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, doc := range updated {
+		model := update
+		if post {
+			model = in.Document(doc)
+		}
+		errs = append(errs, db.RunPostSave(ctx, m.hooks, model, filter, col, "update", idToString(doc["_id"])))
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteOne deletes the first doc matching filter. Docs of soft deleted models are marked instead.
+func (m *Memory) DeleteOne(ctx context.Context, col string, filter interface{}) error {
+	if field, ok := db.SoftDeleting(ctx, col); ok {
+		return db.MarkDeleted(ctx, m, col, field, filter, true)
+	}
+	docs, err := m.find(col, filter, nil, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return db.ErrNotFound
+	}
+	return m.delete(ctx, col, filter, docs)
+}
+
+// DeleteMany deletes all docs matching filter, running the delete hooks for each one. Docs of soft deleted
+// models are marked instead.
+func (m *Memory) DeleteMany(ctx context.Context, col string, filter interface{}) error {
+	if field, ok := db.SoftDeleting(ctx, col); ok {
+		return db.MarkDeleted(ctx, m, col, field, filter, false)
+	}
+	docs, err := m.find(col, filter, nil, 0, 0)
+	if err != nil || len(docs) == 0 {
+		return err
+	}
+	return m.delete(ctx, col, filter, docs)
+}
+
+func (m *Memory) delete(ctx context.Context, col string, filter interface{}, docs []bson.M) error {
+	for _, doc := range docs {
+		if err := db.RunPreDelete(ctx, m.hooks, in.Document(doc), filter, col, idToString(doc["_id"])); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	c := m.collection(col)
+	kept := c.docs[:0]
+	for _, stored := range c.docs {
+		if !containsId(docs, stored["_id"]) {
+			kept = append(kept, stored)
+		}
+	}
+	c.docs = kept
+	m.mu.Unlock()
+	var errs []error
+	for _, doc := range docs {
+		errs = append(errs, db.RunPostDelete(ctx, m.hooks, in.Document(doc), filter, col, idToString(doc["_id"])))
+	}
+	return errors.Join(errs...)
+}
+
+// collection returns collection col, creating it. Callers must hold the lock.
+func (m *Memory) collection(col string) *collection {
+	c, ok := m.cols[col]
+	if !ok {
+		c = &collection{}
+		m.cols[col] = c
+	}
+	return c
+}
+
+// find returns copies of the docs matching filter
+func (m *Memory) find(col string, filter interface{}, sort []interface{}, skip, limit int64) ([]bson.M, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := toSortSpec(sort)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	var docs []bson.M
+	if c, ok := m.cols[col]; ok {
+		for _, doc := range c.docs {
+			matched, err := match(doc, f)
+			if err != nil {
+				m.mu.RUnlock()
+				return nil, err
+			}
+			if matched {
+				docs = append(docs, deepCopy(doc).(bson.M))
+			}
+		}
+	}
+	m.mu.RUnlock()
+	sortDocs(docs, spec)
+	if skip > 0 {
+		if skip >= int64(len(docs)) {
+			return nil, nil
+		}
+		docs = docs[skip:]
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+func (m *Memory) matchedIds(col string, filter interface{}, one bool) ([]interface{}, error) {
+	var limit int64
+	if one {
+		limit = 1
+	}
+	docs, err := m.find(col, filter, nil, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	return ids, nil
+}
+
+// insert stores docs, assigning an ObjectID to those without _id, and returns their ids
+func (m *Memory) insert(col string, docs []interface{}) ([]interface{}, error) {
+	converted := make([]bson.M, 0, len(docs))
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		d, err := toDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := d["_id"]; !ok {
+			d["_id"] = primitive.NewObjectID()
+		}
+		converted = append(converted, d)
+		ids = append(ids, d["_id"])
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.collection(col)
+	all := append(append([]bson.M(nil), c.docs...), converted...)
+	for i := len(c.docs); i < len(all); i++ {
+		if err := checkUnique(all, c.indexes, all[i], i); err != nil {
+			return nil, err
+		}
+	}
+	c.docs = all
+	return ids, nil
+}
+
+// update applies update to the docs matching filter, limited to ids when set and to the first doc when
+// one is set, inserting a doc when upsert is set and none matched. It returns copies of the updated docs.
+func (m *Memory) update(col string, filter, update interface{}, one, upsert bool, ids []interface{}) ([]bson.M, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.collection(col)
+	docs := append([]bson.M(nil), c.docs...)
+	var updated []bson.M
+	for i, doc := range docs {
+		if ids != nil && !containsValue(ids, doc["_id"]) {
+			continue
+		}
+		matched, err := match(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		newDoc, err := applyUpdate(doc, u, false)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = newDoc
+		updated = append(updated, deepCopy(newDoc).(bson.M))
+		if one {
+			break
+		}
+	}
+	if len(updated) == 0 && upsert {
+		newDoc, err := applyUpdate(upsertDoc(f), u, true)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := newDoc["_id"]; !ok {
+			newDoc["_id"] = primitive.NewObjectID()
+		}
+		docs = append(docs, newDoc)
+		updated = append(updated, deepCopy(newDoc).(bson.M))
+	}
+	for i, doc := range docs {
+		if err := checkUnique(docs, c.indexes, doc, i); err != nil {
+			return nil, err
+		}
+	}
+	c.docs = docs
+	return updated, nil
+}
+
+// checkUnique returns db.ErrDuplicateKey when docs[idx] clashes with another doc on _id or a unique index
+func checkUnique(docs []bson.M, indexes []db.Index, doc bson.M, idx int) error {
+	for i, other := range docs {
+		if i == idx {
+			continue
+		}
+		if equal(doc["_id"], other["_id"]) {
+			return db.ErrDuplicateKey
+		}
+		for _, ind := range indexes {
+			if ind.Unique == nil || !*ind.Unique {
+				continue
+			}
+			a, aok := indexKey(doc, ind)
+			b, bok := indexKey(other, ind)
+			sparse := ind.Sparse != nil && *ind.Sparse
+			if sparse && (!aok || !bok) {
+				continue
+			}
+			if equal(a, b) {
+				return db.ErrDuplicateKey
+			}
+		}
+	}
+	return nil
+}
+
+// indexKey returns the values of the index fields of doc, ok being false when all of them are missing
+func indexKey(doc bson.M, ind db.Index) (bson.A, bool) {
+	key := make(bson.A, 0, len(ind.Keys))
+	found := false
+	for _, k := range ind.Keys {
+		values := lookup(doc, splitPath(k.Key))
+		if len(values) == 0 {
+			key = append(key, nil)
+			continue
+		}
+		found = true
+		key = append(key, values[0])
+	}
+	return key, found
+}
+
+func indexName(ind db.Index) string {
+	parts := make([]string, 0, len(ind.Keys))
+	for _, k := range ind.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Asc))
+	}
+	return strings.Join(parts, "_")
+}
+
+func containsId(docs []bson.M, id interface{}) bool {
+	for _, doc := range docs {
+		if equal(doc["_id"], id) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(ids []interface{}, id interface{}) bool {
+	for _, other := range ids {
+		if equal(other, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandArrays flattens array values, as distinct does on the server
+func expandArrays(values []interface{}) []interface{} {
+	var flat []interface{}
+	for _, v := range values {
+		if arr, ok := v.(bson.A); ok {
+			flat = append(flat, arr...)
+			continue
+		}
+		flat = append(flat, v)
+	}
+	return flat
+}
+
+// idToString converts a document _id to the string form used by the hooks
+func idToString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprintf("%v", id)
+}
@@ -0,0 +1,337 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want int
+		ok   bool
+	}{
+		{"strings", "a", "b", -1, true},
+		{"symbol and string", primitive.Symbol("b"), "a", 1, true},
+		{"string and symbol", "a", primitive.Symbol("a"), 0, true},
+		{"numbers of different types", int32(2), 1.5, 1, true},
+		{"null before numbers", nil, int64(1), -1, false},
+		{"nested documents", bson.M{"a": int32(1)}, bson.M{"a": int32(2)}, -1, true},
+		{"arrays", bson.A{"a"}, bson.A{"a", "b"}, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ok := compare(tt.a, tt.b)
+			if sign(c) != tt.want || ok != tt.ok {
+				t.Errorf("compare(%v, %v) = %d, %v, want %d, %v", tt.a, tt.b, c, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	docs := []interface{}{
+		bson.M{"_id": 1, "name": "a", "n": 3, "tags": bson.A{"x"}},
+		bson.M{"_id": 2, "name": primitive.Symbol("b"), "n": 1},
+		bson.M{"_id": 3, "name": "c", "n": 2, "tags": bson.A{"x", "y"}},
+	}
+	if err := m.InsertMany(ctx, "items", docs); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		filter      interface{}
+		skip, limit int64
+		sort        interface{}
+		want        []int32
+	}{
+		{name: "all", filter: nil, want: []int32{1, 2, 3}},
+		{name: "range over strings and symbols", filter: bson.M{"name": bson.M{"$gt": "a"}}, want: []int32{2, 3}},
+		{name: "in", filter: bson.M{"n": bson.M{"$in": bson.A{1, 3}}}, want: []int32{1, 2}},
+		{name: "array element", filter: bson.M{"tags": "y"}, want: []int32{3}},
+		{name: "missing field", filter: bson.M{"tags": bson.M{"$exists": false}}, want: []int32{2}},
+		{name: "or", filter: bson.M{"$or": bson.A{bson.M{"_id": 1}, bson.M{"n": 2}}}, want: []int32{1, 3}},
+		{name: "sort skip and limit", sort: bson.D{{Key: "n", Value: -1}}, skip: 1, limit: 1, want: []int32{3}},
+		{name: "sort by mixed strings and symbols", sort: bson.D{{Key: "name", Value: -1}}, want: []int32{3, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []struct {
+				Id int32 `bson:"_id"`
+			}
+			var sort []interface{}
+			if tt.sort != nil {
+				sort = append(sort, tt.sort)
+			}
+			if err := m.List(ctx, "items", tt.filter, tt.skip, tt.limit, &got, sort...); err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			var ids []int32
+			for _, doc := range got {
+				ids = append(ids, doc.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("List() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	unique := true
+	if err := m.EnsureIndices(ctx, "users", []db.Index{{Name: "email", Keys: []db.IndexKey{{Key: "email", Asc: 1}}, Unique: &unique}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Insert(ctx, "users", bson.M{"_id": 1, "email": "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Insert(ctx, "users", bson.M{"_id": 2, "email": "a@example.com"}); !errors.Is(err, db.ErrDuplicateKey) {
+		t.Errorf("Insert of a duplicate returned %v, want db.ErrDuplicateKey", err)
+	}
+	if err := m.Update(ctx, "users", bson.M{"_id": 9}, bson.M{"email": "b@example.com"}); err == nil {
+		t.Errorf("Update of a missing document returned no error")
+	}
+}
+
+type item struct {
+	Id     int32  `bson:"_id"`
+	Tenant string `bson:"tenant"`
+	Name   string `bson:"name"`
+	Note   string `bson:"note"`
+}
+
+// shown is a model hiding its note in its own PostFind hook
+type shown item
+
+func (s *shown) PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error {
+	s.Note = "-"
+	return nil
+}
+
+// reader scopes reads to tenant t1, drops the documents named hidden, fails on those named broken and
+// upper cases the others. It records the names of the documents of the reads once their results are final.
+type reader struct {
+	in.NopHook
+	reads []string
+}
+
+func (r *reader) PreFind(ctx context.Context, filter interface{}, col, ops string) (interface{}, error) {
+	if col == "denied" {
+		return nil, errors.New("denied")
+	}
+	if filter == nil {
+		return bson.M{"tenant": "t1"}, nil
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"tenant": "t1"}}}, nil
+}
+
+func (r *reader) PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error {
+	v := reflect.ValueOf(doc).Elem()
+	name := v.FieldByName("Name")
+	switch name.String() {
+	case "hidden":
+		return in.ErrDropResult
+	case "broken":
+		return errors.New("broken")
+	}
+	name.SetString(strings.ToUpper(name.String()))
+	return nil
+}
+
+func (r *reader) PostRead(ctx context.Context, result interface{}, filter interface{}, col, ops string) error {
+	read := []string{ops}
+	v := reflect.Indirect(reflect.ValueOf(result))
+	if v.Kind() != reflect.Slice {
+		v = reflect.Append(reflect.MakeSlice(reflect.SliceOf(v.Type()), 0, 1), v)
+	}
+	for i := 0; i < v.Len(); i++ {
+		read = append(read, reflect.Indirect(v.Index(i)).FieldByName("Name").String())
+	}
+	r.reads = append(r.reads, strings.Join(read, " "))
+	return nil
+}
+
+func TestReadHooks(t *testing.T) {
+	ctx := context.Background()
+	hook := &reader{}
+	m := New(hook)
+	docs := []interface{}{
+		item{Id: 1, Tenant: "t1", Name: "a", Note: "n"},
+		item{Id: 2, Tenant: "t1", Name: "hidden"},
+		item{Id: 3, Tenant: "t2", Name: "c"},
+		item{Id: 4, Tenant: "t1", Name: "d"},
+		item{Id: 5, Tenant: "t1", Name: "broken"},
+	}
+	if err := m.InsertMany(db.WithoutHooks(ctx), "items", docs); err != nil {
+		t.Fatal(err)
+	}
+	notBroken := bson.M{"name": bson.M{"$ne": "broken"}}
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		col   string
+		read  func(ctx context.Context, col string) (interface{}, error)
+		want  interface{}
+		err   error
+		hook  string // of the HookError returned
+		reads []string
+	}{
+		{
+			name: "findOne rewritten",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var doc item
+				return doc, m.FindOne(ctx, col, bson.M{"_id": 1}, &doc)
+			},
+			want:  item{Id: 1, Tenant: "t1", Name: "A", Note: "n"},
+			reads: []string{"findOne A"},
+		},
+		{
+			name: "findOne dropped",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var doc item
+				return nil, m.FindOne(ctx, col, bson.M{"_id": 2}, &doc)
+			},
+			err: db.ErrNotFound,
+		},
+		{
+			name: "findOne out of the rewritten filter",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var doc item
+				return nil, m.FindOne(ctx, col, bson.M{"_id": 3}, &doc)
+			},
+			err: db.ErrNotFound,
+		},
+		{
+			name: "findOne failing",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var doc item
+				return nil, m.FindOne(ctx, col, bson.M{"_id": 5}, &doc)
+			},
+			hook: "PostFind",
+		},
+		{
+			name: "findOne of a model with its own hook",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var doc shown
+				return doc, m.FindOne(ctx, col, bson.M{"_id": 1}, &doc)
+			},
+			want:  shown{Id: 1, Tenant: "t1", Name: "A", Note: "-"},
+			reads: []string{"findOne A"},
+		},
+		{
+			name: "list with dropped documents",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []item
+				return docs, m.List(ctx, col, notBroken, 0, 0, &docs)
+			},
+			want:  []item{{Id: 1, Tenant: "t1", Name: "A", Note: "n"}, {Id: 4, Tenant: "t1", Name: "D"}},
+			reads: []string{"list A D"},
+		},
+		{
+			name: "list of pointers",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []*item
+				if err := m.List(ctx, col, bson.M{"_id": bson.M{"$in": bson.A{1, 2}}}, 0, 0, &docs); err != nil {
+					return nil, err
+				}
+				var names []string
+				for _, doc := range docs {
+					names = append(names, doc.Name)
+				}
+				return names, nil
+			},
+			want:  []string{"A"},
+			reads: []string{"list A"},
+		},
+		{
+			name: "list with every document dropped",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []item
+				return docs, m.List(ctx, col, bson.M{"_id": 2}, 0, 0, &docs)
+			},
+			want:  []item{},
+			reads: []string{"list"},
+		},
+		{
+			name: "list failing",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []item
+				return nil, m.List(ctx, col, nil, 0, 0, &docs)
+			},
+			hook: "PostFind",
+		},
+		{
+			name: "failing filter",
+			col:  "denied",
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []item
+				return nil, m.List(ctx, col, nil, 0, 0, &docs)
+			},
+			hook: "PreFind",
+		},
+		{
+			name: "hooks disabled",
+			ctx:  db.WithoutHooks(ctx),
+			read: func(ctx context.Context, col string) (interface{}, error) {
+				var docs []item
+				if err := m.List(ctx, col, nil, 0, 0, &docs); err != nil {
+					return nil, err
+				}
+				var names []string
+				for _, doc := range docs {
+					names = append(names, doc.Name)
+				}
+				return names, nil
+			},
+			want: []string{"a", "hidden", "c", "d", "broken"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.reads = nil
+			if tt.ctx == nil {
+				tt.ctx = ctx
+			}
+			if tt.col == "" {
+				tt.col = "items"
+			}
+			got, err := tt.read(tt.ctx, tt.col)
+			var hookErr *db.HookError
+			switch {
+			case tt.hook != "":
+				if !errors.As(err, &hookErr) || hookErr.Hook != tt.hook {
+					t.Fatalf("read = %v, want a %s error", err, tt.hook)
+				}
+			case !errors.Is(err, tt.err):
+				t.Fatalf("read = %v, want %v", err, tt.err)
+			case tt.err == nil && !reflect.DeepEqual(got, tt.want):
+				t.Errorf("read = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(hook.reads, tt.reads) {
+				t.Errorf("PostRead saw %v, want %v", hook.reads, tt.reads)
+			}
+		})
+	}
+}
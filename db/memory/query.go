@@ -0,0 +1,318 @@
+package memory
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// match reports whether doc matches filter, supporting the common query operators:
+// $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $not, $regex, $size, $all, $elemMatch,
+// $and, $or and $nor
+func match(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		var (
+			ok  bool
+			err error
+		)
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("memory: unsupported query operator %s", key)
+			}
+			ok, err = matchField(lookup(doc, splitPath(key)), cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	clauses, ok := cond.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("memory: %s needs an array", op)
+	}
+	for _, clause := range clauses {
+		sub, ok := clause.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("memory: %s needs an array of documents", op)
+		}
+		matched, err := match(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// matchField reports whether the values found at a path match cond, either a value or a document of operators
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	if ops, ok := cond.(bson.M); ok && isOperatorDoc(ops) {
+		for op, arg := range ops {
+			if op == "$options" {
+				continue
+			}
+			matched, err := matchOperator(values, op, arg, ops)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if re, ok := cond.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	return matchEqual(values, cond), nil
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, ops bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEqual(values, arg), nil
+	case "$ne":
+		return !matchEqual(values, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			c, ok := compare(v, arg)
+			if !ok {
+				continue
+			}
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("memory: %s needs an array", op)
+		}
+		found := false
+		for _, item := range list {
+			if re, ok := item.(primitive.Regex); ok {
+				if found, _ = matchRegex(values, re.Pattern, re.Options); found {
+					break
+				}
+			} else if matchEqual(values, item) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		want, _ := arg.(bool)
+		if n, ok := toFloat(arg); ok {
+			want = n != 0
+		}
+		return (len(values) > 0) == want, nil
+	case "$not":
+		matched, err := matchField(values, arg)
+		return !matched, err
+	case "$regex":
+		pattern, options := "", ""
+		switch re := arg.(type) {
+		case string:
+			pattern = re
+		case primitive.Regex:
+			pattern, options = re.Pattern, re.Options
+		default:
+			return false, fmt.Errorf("memory: $regex needs a string")
+		}
+		if o, ok := ops["$options"].(string); ok {
+			options = o
+		}
+		return matchRegex(values, pattern, options)
+	case "$size":
+		size, ok := toFloat(arg)
+		if !ok {
+			return false, fmt.Errorf("memory: $size needs a number")
+		}
+		for _, v := range values {
+			if arr, ok := v.(bson.A); ok && float64(len(arr)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		list, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("memory: $all needs an array")
+		}
+		for _, item := range list {
+			if !matchEqual(values, item) {
+				return false, nil
+			}
+		}
+		return len(list) > 0, nil
+	case "$elemMatch":
+		sub, ok := arg.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("memory: $elemMatch needs a document")
+		}
+		for _, v := range values {
+			arr, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, elem := range arr {
+				var (
+					matched bool
+					err     error
+				)
+				if isOperatorDoc(sub) {
+					matched, err = matchField([]interface{}{elem}, sub)
+				} else if elemDoc, ok := elem.(bson.M); ok {
+					matched, err = match(elemDoc, sub)
+				}
+				if err != nil {
+					return false, err
+				}
+				if matched {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("memory: unsupported query operator %s", op)
+}
+
+// matchEqual reports whether any value equals want, or is an array holding it. A missing value equals null.
+func matchEqual(values []interface{}, want interface{}) bool {
+	if len(values) == 0 {
+		return want == nil
+	}
+	for _, v := range values {
+		if equal(v, want) {
+			return true
+		}
+		if arr, ok := v.(bson.A); ok {
+			for _, elem := range arr {
+				if equal(elem, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchRegex(values []interface{}, pattern, options string) (bool, error) {
+	flags := ""
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand adds the elements of array values, which the comparison operators also match against
+func expand(values []interface{}) []interface{} {
+	expanded := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		expanded = append(expanded, v)
+		if arr, ok := v.(bson.A); ok {
+			expanded = append(expanded, arr...)
+		}
+	}
+	return expanded
+}
+
+func isOperatorDoc(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// sortDocs sorts docs in place by spec, a document of field to 1 or -1
+func sortDocs(docs []bson.M, spec bson.D) {
+	if len(spec) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range spec {
+			dir := 1
+			if n, ok := toFloat(e.Value); ok && n < 0 {
+				dir = -1
+			}
+			a := sortValue(lookup(docs[i], splitPath(e.Key)), dir)
+			b := sortValue(lookup(docs[j], splitPath(e.Key)), dir)
+			if c, _ := compare(a, b); c != 0 {
+				return c*dir < 0
+			}
+		}
+		return false
+	})
+}
+
+// sortValue picks the value a doc is sorted by: the smallest array element ascending, the largest descending
+func sortValue(values []interface{}, dir int) interface{} {
+	var best interface{}
+	first := true
+	for _, v := range values {
+		candidates := []interface{}{v}
+		if arr, ok := v.(bson.A); ok && len(arr) > 0 {
+			candidates = arr
+		}
+		for _, c := range candidates {
+			if first {
+				best, first = c, false
+				continue
+			}
+			if cmp, _ := compare(c, best); cmp*dir < 0 {
+				best = c
+			}
+		}
+	}
+	return best
+}
+
+// toSortSpec converts the sort argument of FindOne and List to an ordered spec
+func toSortSpec(sort []interface{}) (bson.D, error) {
+	if len(sort) == 0 || sort[0] == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(sort[0])
+	if err != nil {
+		return nil, err
+	}
+	var spec bson.D
+	if err = bson.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
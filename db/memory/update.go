@@ -0,0 +1,234 @@
+package memory
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyUpdate returns doc with update applied. update is either a replacement document or a document of
+// the update operators $set, $unset, $inc, $push, $addToSet, $pull, $currentDate and, when inserting an
+// upserted doc, $setOnInsert.
+func applyUpdate(doc bson.M, update bson.M, inserting bool) (bson.M, error) {
+	if !isOperatorDoc(update) {
+		// Replacement keeps the _id of the replaced doc
+		replaced := deepCopy(update).(bson.M)
+		if id, ok := doc["_id"]; ok {
+			replaced["_id"] = id
+		}
+		return replaced, nil
+	}
+	updated := deepCopy(doc).(bson.M)
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("memory: %s needs a document", op)
+		}
+		for path, value := range fields {
+			if path == "_id" && op != "$setOnInsert" && !inserting {
+				if old, ok := updated["_id"]; ok && !equal(old, value) {
+					return nil, fmt.Errorf("memory: _id is immutable")
+				}
+			}
+			if err := applyOperator(updated, op, splitPath(path), value, inserting); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+func applyOperator(doc bson.M, op string, path []string, value interface{}, inserting bool) error {
+	switch op {
+	case "$set":
+		return setPath(doc, path, value)
+	case "$setOnInsert":
+		if inserting {
+			return setPath(doc, path, value)
+		}
+		return nil
+	case "$unset":
+		unsetPath(doc, path)
+		return nil
+	case "$currentDate":
+		return setPath(doc, path, primitive.NewDateTimeFromTime(time.Now()))
+	case "$inc":
+		current := getPath(doc, path)
+		if current == nil {
+			return setPath(doc, path, value)
+		}
+		sum, err := add(current, value)
+		if err != nil {
+			return err
+		}
+		return setPath(doc, path, sum)
+	case "$push", "$addToSet":
+		items := bson.A{value}
+		if each, ok := value.(bson.M); ok {
+			if list, ok := each["$each"].(bson.A); ok {
+				items = list
+			}
+		}
+		arr, err := arrayAt(doc, path)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if op == "$addToSet" && matchEqual([]interface{}{arr}, item) {
+				continue
+			}
+			arr = append(arr, item)
+		}
+		return setPath(doc, path, arr)
+	case "$pull":
+		arr, err := arrayAt(doc, path)
+		if err != nil {
+			return err
+		}
+		kept := bson.A{}
+		for _, elem := range arr {
+			var pulled bool
+			if cond, ok := value.(bson.M); ok {
+				if isOperatorDoc(cond) {
+					pulled, err = matchField([]interface{}{elem}, cond)
+				} else if elemDoc, ok := elem.(bson.M); ok {
+					pulled, err = match(elemDoc, cond)
+				}
+				if err != nil {
+					return err
+				}
+			} else {
+				pulled = equal(elem, value)
+			}
+			if !pulled {
+				kept = append(kept, elem)
+			}
+		}
+		return setPath(doc, path, kept)
+	}
+	return fmt.Errorf("memory: unsupported update operator %s", op)
+}
+
+// getPath returns the value at path, nil when missing
+func getPath(doc bson.M, path []string) interface{} {
+	var cur interface{} = doc
+	for _, part := range path {
+		switch val := cur.(type) {
+		case bson.M:
+			cur = val[part]
+		case bson.A:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(val) {
+				return nil
+			}
+			cur = val[idx]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// setPath sets the value at path, creating the documents leading to it
+func setPath(doc bson.M, path []string, value interface{}) error {
+	var cur interface{} = doc
+	for i, part := range path {
+		last := i == len(path)-1
+		switch val := cur.(type) {
+		case bson.M:
+			if last {
+				val[part] = value
+				return nil
+			}
+			next, ok := val[part]
+			if !ok || next == nil {
+				next = bson.M{}
+				val[part] = next
+			}
+			cur = next
+		case bson.A:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 {
+				return fmt.Errorf("memory: can not set %s in an array", strings.Join(path, "."))
+			}
+			if idx >= len(val) {
+				return fmt.Errorf("memory: index %d out of range in %s", idx, strings.Join(path, "."))
+			}
+			if last {
+				val[idx] = value
+				return nil
+			}
+			cur = val[idx]
+		default:
+			return fmt.Errorf("memory: can not set %s in a %T", strings.Join(path, "."), cur)
+		}
+	}
+	return nil
+}
+
+func unsetPath(doc bson.M, path []string) {
+	parent := doc
+	if len(path) > 1 {
+		p, ok := getPath(doc, path[:len(path)-1]).(bson.M)
+		if !ok {
+			return
+		}
+		parent = p
+	}
+	delete(parent, path[len(path)-1])
+}
+
+// arrayAt returns the array at path, an empty one when missing
+func arrayAt(doc bson.M, path []string) (bson.A, error) {
+	switch val := getPath(doc, path).(type) {
+	case nil:
+		return bson.A{}, nil
+	case bson.A:
+		return append(bson.A{}, val...), nil
+	default:
+		return nil, fmt.Errorf("memory: %s is not an array", strings.Join(path, "."))
+	}
+}
+
+// add sums two numbers, keeping integer types while the result fits
+func add(a, b interface{}) (interface{}, error) {
+	fa, aok := toFloat(a)
+	fb, bok := toFloat(b)
+	if !aok || !bok {
+		return nil, fmt.Errorf("memory: can not $inc a %T by a %T", a, b)
+	}
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		return fa + fb, nil
+	}
+	sum := int64(fa) + int64(fb)
+	_, a64 := a.(int64)
+	_, b64 := b.(int64)
+	if !a64 && !b64 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return int32(sum), nil
+	}
+	return sum, nil
+}
+
+// upsertDoc builds the doc inserted by an upsert from the equality conditions of filter
+func upsertDoc(filter bson.M) bson.M {
+	doc := bson.M{}
+	for key, cond := range filter {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if ops, ok := cond.(bson.M); ok && isOperatorDoc(ops) {
+			if eq, ok := ops["$eq"]; ok {
+				_ = setPath(doc, splitPath(key), deepCopy(eq))
+			}
+			continue
+		}
+		_ = setPath(doc, splitPath(key), deepCopy(cond))
+	}
+	return doc
+}
@@ -0,0 +1,276 @@
+package memory
+
+import (
+	"bytes"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// toDoc converts v to the form documents are kept in: bson.M with nested bson.M and bson.A,
+// holding the same value types the driver decodes from the server
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return convert(d).(bson.M), nil
+}
+
+// toValue converts a single value the same way toDoc converts documents
+func toValue(v interface{}) (interface{}, error) {
+	doc, err := toDoc(bson.M{"v": v})
+	if err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+func convert(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		m := make(bson.M, len(val))
+		for _, e := range val {
+			m[e.Key] = convert(e.Value)
+		}
+		return m
+	case bson.M:
+		m := make(bson.M, len(val))
+		for key, value := range val {
+			m[key] = convert(value)
+		}
+		return m
+	case bson.A:
+		a := make(bson.A, len(val))
+		for i, value := range val {
+			a[i] = convert(value)
+		}
+		return a
+	}
+	return v
+}
+
+// deepCopy copies a document so that callers and hooks can not modify stored state
+func deepCopy(v interface{}) interface{} {
+	return convert(v)
+}
+
+// decode stores doc in v, as a cursor of the driver would
+func decode(doc bson.M, v interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, v)
+}
+
+// decodeAll stores docs in the slice pointed to by v
+func decodeAll(docs []bson.M, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errNotSlicePtr
+	}
+	slice := rv.Elem()
+	elemType := slice.Type().Elem()
+	out := reflect.MakeSlice(slice.Type(), 0, len(docs))
+	for _, doc := range docs {
+		elem := reflect.New(elemType)
+		if err := decode(doc, elem.Interface()); err != nil {
+			return err
+		}
+		out = reflect.Append(out, elem.Elem())
+	}
+	slice.Set(out)
+	return nil
+}
+
+// lookup returns every value found at the dotted path, descending into arrays like the server does
+func lookup(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch val := v.(type) {
+	case bson.M:
+		child, ok := val[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(child, path[1:])
+	case bson.A:
+		if idx, err := strconv.Atoi(path[0]); err == nil {
+			if idx >= 0 && idx < len(val) {
+				return lookup(val[idx], path[1:])
+			}
+			return nil
+		}
+		var found []interface{}
+		for _, elem := range val {
+			found = append(found, lookup(elem, path)...)
+		}
+		return found
+	}
+	return nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// typeRank orders values of different types the way the server sorts them
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, float64, int, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.M:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	}
+	return 12
+}
+
+// asString returns the text of a string or symbol
+func asString(v interface{}) string {
+	if symbol, ok := v.(primitive.Symbol); ok {
+		return string(symbol)
+	}
+	return v.(string)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compare orders a and b. ok is false when they are of types the query operators do not compare.
+func compare(a, b interface{}) (c int, ok bool) {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return ra - rb, false
+	}
+	switch x := a.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 0, true
+	case string, primitive.Symbol:
+		// Strings and symbols share a rank, either may be on each side
+		return strings.Compare(asString(a), asString(b)), true
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:]), true
+	case primitive.DateTime:
+		return cmpOrdered(x, b.(primitive.DateTime)), true
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return cmpOrdered(x.T, y.T), true
+		}
+		return cmpOrdered(x.I, y.I), true
+	case bson.M:
+		y := b.(bson.M)
+		keys := unionKeys(x, y)
+		for _, key := range keys {
+			xv, xok := x[key]
+			yv, yok := y[key]
+			if !xok || !yok {
+				if xok {
+					return 1, true
+				}
+				return -1, true
+			}
+			if c, _ := compare(xv, yv); c != 0 {
+				return c, true
+			}
+		}
+		return 0, true
+	case bson.A:
+		y := b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c, _ := compare(x[i], y[i]); c != 0 {
+				return c, true
+			}
+		}
+		return len(x) - len(y), true
+	}
+	if fa, aok := toFloat(a); aok {
+		if fb, bok := toFloat(b); bok {
+			return cmpOrdered(fa, fb), true
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	return 0, false
+}
+
+func cmpOrdered[T ~int64 | ~uint32 | ~float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// equal reports whether a and b are equal, treating all numeric types alike
+func equal(a, b interface{}) bool {
+	c, ok := compare(a, b)
+	return ok && c == 0
+}
+
+func unionKeys(a, b bson.M) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
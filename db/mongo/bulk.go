@@ -0,0 +1,227 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// bulkOp tracks what a single write model of a bulk write touches
+type bulkOp struct {
+	ops    string      // "insert", "update" or "delete"
+	model  interface{} // payload handed to the save hooks
+	filter interface{}
+	id     interface{} // id of the inserted doc
+	docs   []bson.M    // docs matched before the write
+	post   bool        // PostSave receives the stored doc after the update instead of model
+	upsert bool
+}
+
+// BulkUpdate runs models as a single bulk write, running the save or delete hooks for each affected doc.
+// Filters are narrowed to the docs matched before the write so the hooks see exactly what was changed.
+func (d *Mongo) BulkUpdate(ctx context.Context, col string, models []mongo.WriteModel) error {
+	return d.atomic(ctx, func(ctx context.Context) error {
+		bulkOps := make([]bulkOp, len(models))
+		writes := make([]mongo.WriteModel, len(models))
+		for i, model := range models {
+			op, write, err := d.resolveBulkOp(ctx, col, model)
+			if err != nil {
+				return err
+			}
+			bulkOps[i], writes[i] = op, write
+		}
+		for _, op := range bulkOps {
+			switch op.ops {
+			case "insert":
+				if err := d.preSave(ctx, op.model, nil, col, op.ops, ""); err != nil {
+					return err
+				}
+			case "update":
+				for _, doc := range op.docs {
+					if err := d.preSave(ctx, op.model, op.filter, col, op.ops, idToString(doc["_id"])); err != nil {
+						return err
+					}
+				}
+				if len(op.docs) == 0 && op.upsert {
+					if err := d.preSave(ctx, op.model, op.filter, col, op.ops, ""); err != nil {
+						return err
+					}
+				}
+			case "delete":
+				for _, doc := range op.docs {
+					if err := d.preDelete(ctx, in.Document(doc), op.filter, col, idToString(doc["_id"])); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		outboxId, err := d.openOutbox(ctx, col, bulkOutboxWrites(bulkOps))
+		if err != nil {
+			return err
+		}
+		res, err := d.Database.Collection(col).BulkWrite(ctx, writes)
+		if err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+
+		// Collect the ids of updated docs, including upserts, to load their new state in one query
+		updatedIds := make(map[int][]interface{})
+		var allIds []interface{}
+		for i, op := range bulkOps {
+			if op.ops != "update" {
+				continue
+			}
+			for _, doc := range op.docs {
+				updatedIds[i] = append(updatedIds[i], doc["_id"])
+			}
+			if id, ok := res.UpsertedIDs[int64(i)]; ok {
+				updatedIds[i] = append(updatedIds[i], id)
+			}
+			allIds = append(allIds, updatedIds[i]...)
+		}
+		updatedDocs := make(map[string]bson.M)
+		if len(allIds) > 0 {
+			docs, err := d.docsByIds(ctx, col, allIds)
+			if err != nil {
+				return err
+			}
+			for _, doc := range docs {
+				updatedDocs[idToString(doc["_id"])] = doc
+			}
+		}
+
+		var errs []error
+		for i, op := range bulkOps {
+			switch op.ops {
+			case "insert":
+				errs = append(errs, d.postSave(ctx, op.model, nil, col, op.ops, idToString(op.id)))
+			case "update":
+				for _, id := range updatedIds[i] {
+					docId := idToString(id)
+					doc, ok := updatedDocs[docId]
+					if !ok {
+						// Removed by a later write model of the same bulk write
+						continue
+					}
+					model := op.model
+					if op.post {
+						model = in.Document(doc)
+					}
+					errs = append(errs, d.postSave(ctx, model, op.filter, col, op.ops, docId))
+				}
+			case "delete":
+				for _, doc := range op.docs {
+					errs = append(errs, d.postDelete(ctx, in.Document(doc), op.filter, col, idToString(doc["_id"])))
+				}
+			}
+		}
+		return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+	})
+}
+
+// bulkOutboxWrites returns the outbox writes of bulkOps. Docs created by upserts are not known up front
+// and are left out.
+func bulkOutboxWrites(bulkOps []bulkOp) []outboxWrite {
+	var writes []outboxWrite
+	for _, op := range bulkOps {
+		switch op.ops {
+		case "insert":
+			writes = append(writes, outboxWrite{Ops: op.ops, DocId: op.id})
+		case "update", "delete":
+			writes = append(writes, writesOf(op.ops, op.docs)...)
+		}
+	}
+	return writes
+}
+
+// resolveBulkOp finds the docs affected by model and returns a copy of it narrowed to them
+func (d *Mongo) resolveBulkOp(ctx context.Context, col string, model mongo.WriteModel) (bulkOp, mongo.WriteModel, error) {
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		doc, id, err := ensureId(m.Document)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		write.Document = doc
+		return bulkOp{ops: "insert", model: m.Document, id: id}, &write, nil
+	case *mongo.UpdateOneModel:
+		docs, err := d.findMatches(ctx, col, m.Filter, true, true)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		if len(docs) > 0 {
+			write.Filter = restrictToIds(m.Filter, idsOf(docs))
+		}
+		op := bulkOp{ops: "update", model: m.Update, filter: m.Filter, docs: docs, post: true}
+		op.upsert = m.Upsert != nil && *m.Upsert
+		return op, &write, nil
+	case *mongo.UpdateManyModel:
+		docs, err := d.findMatches(ctx, col, m.Filter, false, true)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		if len(docs) > 0 {
+			write.Filter = restrictToIds(m.Filter, idsOf(docs))
+		}
+		op := bulkOp{ops: "update", model: m.Update, filter: m.Filter, docs: docs, post: true}
+		op.upsert = m.Upsert != nil && *m.Upsert
+		return op, &write, nil
+	case *mongo.ReplaceOneModel:
+		docs, err := d.findMatches(ctx, col, m.Filter, true, true)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		if len(docs) > 0 {
+			write.Filter = restrictToIds(m.Filter, idsOf(docs))
+		}
+		op := bulkOp{ops: "update", model: m.Replacement, filter: m.Filter, docs: docs}
+		op.upsert = m.Upsert != nil && *m.Upsert
+		return op, &write, nil
+	case *mongo.DeleteOneModel:
+		docs, err := d.findMatches(ctx, col, m.Filter, true, false)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		write.Filter = restrictToIds(m.Filter, idsOf(docs))
+		return bulkOp{ops: "delete", filter: m.Filter, docs: docs}, &write, nil
+	case *mongo.DeleteManyModel:
+		docs, err := d.findMatches(ctx, col, m.Filter, false, false)
+		if err != nil {
+			return bulkOp{}, nil, err
+		}
+		write := *m
+		write.Filter = restrictToIds(m.Filter, idsOf(docs))
+		return bulkOp{ops: "delete", filter: m.Filter, docs: docs}, &write, nil
+	}
+	// Unknown write models are passed through without hooks
+	return bulkOp{}, model, nil
+}
+
+// ensureId marshals doc and assigns it a new ObjectID when it has no _id, so the inserted id is known
+// up front (bulk write results do not report them)
+func ensureId(doc interface{}) (bson.D, interface{}, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(data, &d); err != nil {
+		return nil, nil, err
+	}
+	for _, e := range d {
+		if e.Key == "_id" {
+			return d, e.Value, nil
+		}
+	}
+	id := primitive.NewObjectID()
+	return append(bson.D{{Key: "_id", Value: id}}, d...), id, nil
+}
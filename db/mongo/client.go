@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/DeimosTech/hookie/db"
 	in "github.com/DeimosTech/hookie/instance"
 	"go.mongodb.org/mongo-driver/bson"
@@ -19,20 +20,29 @@ type Mongo struct {
 	*mongo.Client
 	Database *mongo.Database
 	Logger   *slog.Logger
-	hook     in.Hook
+	hooks    *in.Chain
+	mode     AuditMode
 }
 
 var instance *Mongo
 
-func InitMongo(cl *mongo.Client, dbName string, hook in.Hook) *Mongo {
+// InitMongo connects to database dbName, running hooks in the given order around every write and read.
+// More hooks can be added to the chain returned by Hooks.
+func InitMongo(cl *mongo.Client, dbName string, hooks ...in.Hook) *Mongo {
 	instance = &Mongo{
 		Client:   cl,
 		Database: cl.Database(dbName),
 		Logger:   slog.Default(),
-		hook:     hook,
+		hooks:    in.NewChain(hooks...),
 	}
 	return instance
 }
+
+// Hooks returns the hook chain driven by the client
+func (d *Mongo) Hooks() *in.Chain {
+	return d.hooks
+}
+
 func GetDbConnection() *Mongo {
 	return instance
 }
@@ -89,48 +99,114 @@ func (d *Mongo) DropIndices(ctx context.Context, col string, index []db.Index) e
 
 // Insert inserts doc into collection
 func (d *Mongo) Insert(ctx context.Context, col string, doc interface{}) error {
-	var (
-		err    error
-		insRes *mongo.InsertOneResult
-	)
-	d.hook.PreSave(ctx, doc, nil, col, "insert", "")
-	if insRes, err = d.Database.Collection(col).InsertOne(ctx, doc); err != nil {
-		return err
-	}
-	d.hook.PostSave(ctx, doc, nil, col, "insert", insRes.InsertedID.(primitive.ObjectID).Hex())
-	return nil
+	return d.atomic(ctx, func(ctx context.Context) error {
+		var (
+			err    error
+			insRes *mongo.InsertOneResult
+		)
+		if err = d.preSave(ctx, doc, nil, col, "insert", ""); err != nil {
+			return err
+		}
+		toInsert, writes, err := d.insertWrites(ctx, []interface{}{doc})
+		if err != nil {
+			return err
+		}
+		outboxId, err := d.openOutbox(ctx, col, writes)
+		if err != nil {
+			return err
+		}
+		if insRes, err = d.Database.Collection(col).InsertOne(ctx, toInsert[0]); err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		return d.closeOutbox(ctx, outboxId, d.postSave(ctx, doc, nil, col, "insert", idToString(insRes.InsertedID)))
+	})
 }
 
+// InsertMany inserts docs into collection, running the save hooks for each doc
 func (d *Mongo) InsertMany(ctx context.Context, col string, docs []interface{}) error {
-	if _, err := d.Database.Collection(col).InsertMany(ctx, docs); err != nil {
-		return err
+	return d.atomic(ctx, func(ctx context.Context) error {
+		for _, doc := range docs {
+			if err := d.preSave(ctx, doc, nil, col, "insert", ""); err != nil {
+				return err
+			}
+		}
+		toInsert, writes, err := d.insertWrites(ctx, docs)
+		if err != nil {
+			return err
+		}
+		outboxId, err := d.openOutbox(ctx, col, writes)
+		if err != nil {
+			return err
+		}
+		insRes, err := d.Database.Collection(col).InsertMany(ctx, toInsert)
+		if err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		var errs []error
+		for i, doc := range docs {
+			errs = append(errs, d.postSave(ctx, doc, nil, col, "insert", idToString(insRes.InsertedIDs[i])))
+		}
+		return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+	})
+}
+
+// insertWrites returns the docs to insert and their outbox writes. Through the outbox, docs are given
+// their _id up front so the relay can find them.
+func (d *Mongo) insertWrites(ctx context.Context, docs []interface{}) ([]interface{}, []outboxWrite, error) {
+	if !d.outboxActive(ctx) {
+		return docs, nil, nil
 	}
-	return nil
+	toInsert := make([]interface{}, len(docs))
+	writes := make([]outboxWrite, len(docs))
+	for i, doc := range docs {
+		withId, id, err := ensureId(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		toInsert[i], writes[i] = withId, outboxWrite{Ops: "insert", DocId: id}
+	}
+	return toInsert, writes, nil
 }
 
-// FindOne finds a doc by query
+// FindOne finds a doc by query. A doc dropped by a PostFind hook is reported as not found.
 func (d *Mongo) FindOne(ctx context.Context, col string, q interface{}, v interface{}, sort ...interface{}) error {
 	findOneOpts := options.FindOne()
 	if len(sort) > 0 {
 		findOneOpts = findOneOpts.SetSort(sort[0])
 	}
+	q, err := db.RunPreFind(ctx, d.hooks, db.ScopeFilter(ctx, col, q), v, col, "findOne")
+	if err != nil {
+		return err
+	}
 
-	err := d.Database.Collection(col).FindOne(ctx, q, findOneOpts).Decode(v)
+	err = d.Database.Collection(col).FindOne(ctx, q, findOneOpts).Decode(v)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return db.ErrNotFound
 		}
 		return err
 	}
-	return nil
+	dropped, err := db.RunPostFind(ctx, d.hooks, v, q, col, "findOne")
+	if err != nil {
+		return err
+	}
+	if dropped {
+		return db.ErrNotFound
+	}
+	return db.RunPostRead(ctx, d.hooks, v, q, col, "findOne")
 }
 
-// List finds list of docs that matches query with skip and limit
+// List finds list of docs that matches query with skip and limit. Docs dropped by PostFind hooks are
+// left out, so fewer than limit docs may be returned.
 func (d *Mongo) List(ctx context.Context, col string, filter interface{}, skip, limit int64, v interface{}, sort ...interface{}) error {
 	findOpts := options.Find().SetSkip(skip).SetLimit(limit)
 	if len(sort) > 0 {
 		findOpts = findOpts.SetSort(sort[0])
 	}
+	filter, err := db.RunPreFind(ctx, d.hooks, db.ScopeFilter(ctx, col, filter), v, col, "list")
+	if err != nil {
+		return err
+	}
 	cursor, err := d.Database.Collection(col).Find(ctx, filter, findOpts)
 	if err != nil {
 		return err
@@ -139,23 +215,30 @@ func (d *Mongo) List(ctx context.Context, col string, filter interface{}, skip,
 		return err
 	}
 
-	return nil
+	if err = db.RunPostFindAll(ctx, d.hooks, v, filter, col, "list"); err != nil {
+		return err
+	}
+	return db.RunPostRead(ctx, d.hooks, v, filter, col, "list")
 }
 
 // Aggregate runs aggregation q on docs and store the result on v
 func (d *Mongo) Aggregate(ctx context.Context, col string, q []interface{}, v interface{}) error {
-	cursor, err := d.Database.Collection(col).Aggregate(ctx, q)
+	return d.aggregate(ctx, col, q, v, options.Aggregate())
+}
+
+func (d *Mongo) AggregateWithDiskUse(ctx context.Context, col string, q []interface{}, v interface{}) error {
+	return d.aggregate(ctx, col, q, v, options.Aggregate().SetAllowDiskUse(true))
+}
+
+// aggregate runs the pipeline q, which the PreFind hooks may rewrite, and the PostFind hooks on its results
+func (d *Mongo) aggregate(ctx context.Context, col string, q []interface{}, v interface{}, opt *options.AggregateOptions) error {
+	pipeline, err := db.RunPreFind(ctx, d.hooks, db.ScopePipeline(ctx, col, q), v, col, "aggregate")
 	if err != nil {
 		return err
 	}
-	if err := cursor.All(ctx, v); err != nil {
+	if q, err = db.AggregatePipeline(pipeline); err != nil {
 		return err
 	}
-	return nil
-}
-
-func (d *Mongo) AggregateWithDiskUse(ctx context.Context, col string, q []interface{}, v interface{}) error {
-	opt := options.Aggregate().SetAllowDiskUse(true)
 	cursor, err := d.Database.Collection(col).Aggregate(ctx, q, opt)
 	if err != nil {
 		return err
@@ -163,11 +246,11 @@ func (d *Mongo) AggregateWithDiskUse(ctx context.Context, col string, q []interf
 	if err := cursor.All(ctx, v); err != nil {
 		return err
 	}
-	return nil
+	return db.RunPostFindAll(ctx, d.hooks, v, q, col, "aggregate")
 }
 
 func (d *Mongo) Distinct(ctx context.Context, col, field string, q interface{}, v interface{}) error {
-	interfaces, err := d.Database.Collection(col).Distinct(ctx, field, q)
+	interfaces, err := d.Database.Collection(col).Distinct(ctx, field, db.ScopeFilter(ctx, col, q))
 	if err != nil {
 		return err
 	}
@@ -178,34 +261,153 @@ func (d *Mongo) Distinct(ctx context.Context, col, field string, q interface{},
 	return json.Unmarshal(data, v)
 }
 
+// PartialUpdateMany sets data on all docs matching filter, running the save hooks for each doc
 func (d *Mongo) PartialUpdateMany(ctx context.Context, col string, filter interface{}, data interface{}) error {
-	_, err := d.Database.Collection(col).UpdateMany(ctx, filter, bson.M{"$set": data})
-	if err != nil {
-		return err
-	}
-	return nil
+	return d.atomic(ctx, func(ctx context.Context) error {
+		docs, err := d.findMatches(ctx, col, filter, false, true)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		ids := idsOf(docs)
+		for _, id := range ids {
+			if err = d.preSave(ctx, data, filter, col, "update", idToString(id)); err != nil {
+				return err
+			}
+		}
+		outboxId, err := d.openOutbox(ctx, col, writesOf("update", docs))
+		if err != nil {
+			return err
+		}
+		update, versioned := db.IncrementVersion(col, bson.M{"$set": data})
+		_, err = d.Database.Collection(col).UpdateMany(ctx, restrictToIds(filter, ids), update)
+		if err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		var errs []error
+		if versioned {
+			// The hooks record the version each doc was left at
+			docs, err = d.docsByIds(ctx, col, ids)
+			if err != nil {
+				return err
+			}
+			for _, doc := range docs {
+				errs = append(errs, d.postSave(db.WithStoredVersion(ctx, col, doc), data, filter, col, "update", idToString(doc["_id"])))
+			}
+			return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+		}
+		for _, id := range ids {
+			errs = append(errs, d.postSave(ctx, data, filter, col, "update", idToString(id)))
+		}
+		return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+	})
 }
 
+// PartialUpdateManyByQuery applies query to all docs matching filter. As the update operators
+// are arbitrary, PostSave receives the stored document after the update.
 func (d *Mongo) PartialUpdateManyByQuery(ctx context.Context, col string, filter interface{}, query db.UnorderedDbQuery) error {
-	_, err := d.Database.Collection(col).UpdateMany(ctx, filter, query)
-	if err != nil {
-		return err
-	}
-	return nil
+	return d.atomic(ctx, func(ctx context.Context) error {
+		matched, err := d.findMatches(ctx, col, filter, false, true)
+		if err != nil {
+			return err
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		ids := idsOf(matched)
+		for _, id := range ids {
+			if err = d.preSave(ctx, query, filter, col, "update", idToString(id)); err != nil {
+				return err
+			}
+		}
+		outboxId, err := d.openOutbox(ctx, col, writesOf("update", matched))
+		if err != nil {
+			return err
+		}
+		update, _ := db.IncrementVersion(col, bson.M(query))
+		_, err = d.Database.Collection(col).UpdateMany(ctx, restrictToIds(filter, ids), update)
+		if err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		docs, err := d.docsByIds(ctx, col, ids)
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, doc := range docs {
+			errs = append(errs, d.postSave(ctx, in.Document(doc), filter, col, "update", idToString(doc["_id"])))
+		}
+		return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+	})
 }
 
-func (d *Mongo) BulkUpdate(ctx context.Context, col string, models []mongo.WriteModel) error {
-	_, err := d.Database.Collection(col).BulkWrite(ctx, models)
-	return err
+// DeleteOne deletes the first doc matching filter. Docs of soft deleted models are marked instead.
+func (d *Mongo) DeleteOne(ctx context.Context, col string, filter interface{}) error {
+	if field, ok := db.SoftDeleting(ctx, col); ok {
+		return db.MarkDeleted(ctx, d, col, field, filter, true)
+	}
+	return d.atomic(ctx, func(ctx context.Context) error {
+		var doc bson.M
+		if err := d.Database.Collection(col).FindOne(ctx, filter).Decode(&doc); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return db.ErrNotFound
+			}
+			return err
+		}
+		docId := idToString(doc["_id"])
+		if err := d.preDelete(ctx, in.Document(doc), filter, col, docId); err != nil {
+			return err
+		}
+		outboxId, err := d.openOutbox(ctx, col, writesOf("delete", []bson.M{doc}))
+		if err != nil {
+			return err
+		}
+		if _, err := d.Database.Collection(col).DeleteOne(ctx, bson.M{"_id": doc["_id"]}); err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		return d.closeOutbox(ctx, outboxId, d.postDelete(ctx, in.Document(doc), filter, col, docId))
+	})
 }
 
+// DeleteMany deletes all docs matching filter, running the delete hooks for each one. Docs of soft deleted
+// models are marked instead.
 func (d *Mongo) DeleteMany(ctx context.Context, col string, filter interface{}) error {
-	_, err := d.Database.Collection(col).DeleteMany(ctx, filter)
-	return err
+	if field, ok := db.SoftDeleting(ctx, col); ok {
+		return db.MarkDeleted(ctx, d, col, field, filter, false)
+	}
+	return d.atomic(ctx, func(ctx context.Context) error {
+		docs, err := d.findMatches(ctx, col, filter, false, false)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			if err = d.preDelete(ctx, in.Document(doc), filter, col, idToString(doc["_id"])); err != nil {
+				return err
+			}
+		}
+		outboxId, err := d.openOutbox(ctx, col, writesOf("delete", docs))
+		if err != nil {
+			return err
+		}
+		// Only delete the docs the hooks have seen, not ones that started matching since
+		if _, err = d.Database.Collection(col).DeleteMany(ctx, restrictToIds(filter, idsOf(docs))); err != nil {
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		var errs []error
+		for _, doc := range docs {
+			errs = append(errs, d.postDelete(ctx, in.Document(doc), filter, col, idToString(doc["_id"])))
+		}
+		return d.closeOutbox(ctx, outboxId, errors.Join(errs...))
+	})
 }
 
 func (d *Mongo) Count(ctx context.Context, col string, q interface{}) (int64, error) {
-	cnt, err := d.Database.Collection(col).CountDocuments(ctx, q)
+	cnt, err := d.Database.Collection(col).CountDocuments(ctx, db.ScopeFilter(ctx, col, q))
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return 0, db.ErrNotFound
@@ -215,21 +417,122 @@ func (d *Mongo) Count(ctx context.Context, col string, q interface{}) (int64, er
 	return cnt, nil
 }
 
+// Update sets data on the first doc matching filter. For versioned models the version is incremented,
+// and when data carries a version the doc is only updated if it still has it, else a *db.ConflictError
+// is returned.
 func (d *Mongo) Update(ctx context.Context, col string, filter interface{}, data interface{}) error {
-	var (
-		err  error
-		opts = options.FindOneAndUpdate().SetReturnDocument(options.After)
-		res  bson.M
-	)
-	update := bson.M{
-		"$set": data,
-	}
-	d.hook.PreSave(ctx, data, filter, col, "update", "")
-	if err = d.Database.Collection(col).FindOneAndUpdate(ctx, filter, update, opts).Decode(&res); err != nil {
-		return err
+	return d.atomic(ctx, func(ctx context.Context) error {
+		var (
+			err  error
+			opts = options.FindOneAndUpdate().SetReturnDocument(options.After)
+			res  bson.M
+		)
+		if err = d.preSave(ctx, data, filter, col, "update", ""); err != nil {
+			return err
+		}
+		target, update, checked, err := db.VersionedUpdate(col, filter, data)
+		if err != nil {
+			return err
+		}
+		outboxId := primitive.NilObjectID
+		if d.outboxActive(ctx) {
+			// The doc is found first to be recorded, and then updated by its id
+			docs, err := d.findMatches(ctx, col, target, true, true)
+			if err != nil {
+				return err
+			}
+			if len(docs) > 0 {
+				target = restrictToIds(target, idsOf(docs))
+			}
+			if outboxId, err = d.openOutbox(ctx, col, writesOf("update", docs)); err != nil {
+				return err
+			}
+		}
+		if err = d.Database.Collection(col).FindOneAndUpdate(ctx, target, update, opts).Decode(&res); err != nil {
+			if checked != nil && errors.Is(err, mongo.ErrNoDocuments) {
+				return d.abortOutbox(ctx, outboxId, db.Conflict(ctx, d, col, filter, *checked))
+			}
+			return d.abortOutbox(ctx, outboxId, err)
+		}
+		return d.closeOutbox(ctx, outboxId, d.postSave(db.WithStoredVersion(ctx, col, res), data, filter, col, "update", idToString(res["_id"])))
+	})
+}
+
+func (d *Mongo) preSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return db.RunPreSave(ctx, d.hooks, model, filter, col, ops, docId)
+}
+
+func (d *Mongo) postSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return db.RunPostSave(ctx, d.hooks, model, filter, col, ops, docId)
+}
+
+func (d *Mongo) preDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return db.RunPreDelete(ctx, d.hooks, model, filter, col, docId)
+}
+
+func (d *Mongo) postDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return db.RunPostDelete(ctx, d.hooks, model, filter, col, docId)
+}
+
+// idToString converts a document _id to the string form used by the hooks
+func idToString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
 	}
-	if id, ok := res["_id"].(primitive.ObjectID); ok {
-		d.hook.PostSave(ctx, data, filter, col, "update", id.Hex())
+	return fmt.Sprintf("%v", id)
+}
+
+// findMatches returns the docs matched by filter, limited to the first one when one is set and
+// projected to their _id when idsOnly is set
+func (d *Mongo) findMatches(ctx context.Context, col string, filter interface{}, one, idsOnly bool) ([]bson.M, error) {
+	if filter == nil {
+		filter = bson.M{}
 	}
-	return nil
+	opts := options.Find()
+	if one {
+		opts.SetLimit(1)
+	}
+	if idsOnly {
+		opts.SetProjection(bson.M{"_id": 1})
+	}
+	cursor, err := d.Database.Collection(col).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// docsByIds loads the stored docs with the given ids
+func (d *Mongo) docsByIds(ctx context.Context, col string, ids []interface{}) ([]bson.M, error) {
+	cursor, err := d.Database.Collection(col).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// restrictToIds narrows filter to the docs the hooks were run for
+func restrictToIds(filter interface{}, ids []interface{}) bson.M {
+	idFilter := bson.M{"_id": bson.M{"$in": ids}}
+	if filter == nil {
+		return idFilter
+	}
+	return bson.M{"$and": bson.A{filter, idFilter}}
+}
+
+// idsOf returns the _id of each doc
+func idsOf(docs []bson.M) []interface{} {
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	return ids
 }
@@ -0,0 +1,282 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// outboxCollection keeps the writes whose post hooks have not completed yet
+const outboxCollection = "audit_outbox"
+
+// AuditMode decides how writes are kept consistent with what their post hooks write, such as audit entries
+type AuditMode int
+
+const (
+	AuditAfterWrite  AuditMode = iota // post hooks run after the write, a crash in between loses their writes
+	AuditTransaction                  // the write and its hooks run in one transaction, a failing post hook rolls the write back
+	AuditOutbox                       // writes are recorded in the outbox first, an OutboxRelay runs the post hooks that did not complete
+)
+
+func (m AuditMode) String() string {
+	switch m {
+	case AuditTransaction:
+		return "transaction"
+	case AuditOutbox:
+		return "outbox"
+	}
+	return "after write"
+}
+
+// SetAuditMode sets how writes are kept consistent with their post hooks, AuditAfterWrite by default.
+// Set it before the client is used. AuditTransaction needs a replica set or a sharded cluster.
+func (d *Mongo) SetAuditMode(mode AuditMode) *Mongo {
+	d.mode = mode
+	return d
+}
+
+// UseAtomicAudit commits writes together with the audit entries written by their hooks: in a transaction
+// when the deployment supports them, else through the outbox. It returns the mode chosen. Only hooks writing
+// through this client take part, entries handed to other sinks are written on their own.
+func (d *Mongo) UseAtomicAudit(ctx context.Context) (AuditMode, error) {
+	var hello bson.M
+	if err := d.Database.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return d.mode, fmt.Errorf("could not read deployment topology: %w", err)
+	}
+	// Transactions need a replica set member or a mongos router
+	_, replicaSet := hello["setName"]
+	if replicaSet || hello["msg"] == "isdbgrid" {
+		d.mode = AuditTransaction
+	} else {
+		d.mode = AuditOutbox
+	}
+	return d.mode, nil
+}
+
+// atomic runs write in a transaction in AuditTransaction mode. Writes made by the hooks with the context
+// they receive join it, as do nested writes.
+func (d *Mongo) atomic(ctx context.Context, write func(ctx context.Context) error) error {
+	if d.mode != AuditTransaction || db.HooksDisabled(ctx) || mongo.SessionFromContext(ctx) != nil {
+		return write(ctx)
+	}
+	return d.Client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(tc mongo.SessionContext) (interface{}, error) {
+			return nil, write(tc)
+		})
+		return err
+	})
+}
+
+// outboxEntry records a write whose post hooks have not completed yet
+type outboxEntry struct {
+	Id           primitive.ObjectID `bson:"_id"`
+	Col          string             `bson:"col"`
+	Writes       []outboxWrite      `bson:"writes"`
+	Attempts     int                `bson:"attempts"`
+	LastError    string             `bson:"last_error,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	ClaimedUntil *time.Time         `bson:"claimed_until,omitempty"`
+}
+
+// outboxWrite is a doc changed by the write of an outbox entry
+type outboxWrite struct {
+	Ops   string      `bson:"ops"` // "insert", "update" or "delete"
+	DocId interface{} `bson:"doc_id"`
+	Doc   bson.M      `bson:"doc,omitempty"` // the deleted doc, which the delete hooks receive
+}
+
+// openOutbox records writes in the outbox before they are made, in AuditOutbox mode. It returns the id
+// to pass to closeOutbox once the post hooks have run, the nil id when nothing was recorded.
+func (d *Mongo) openOutbox(ctx context.Context, col string, writes []outboxWrite) (primitive.ObjectID, error) {
+	if d.mode != AuditOutbox || db.HooksDisabled(ctx) || len(writes) == 0 {
+		return primitive.NilObjectID, nil
+	}
+	entry := outboxEntry{Id: primitive.NewObjectID(), Col: col, Writes: writes, CreatedAt: time.Now()}
+	if _, err := d.Database.Collection(outboxCollection).InsertOne(ctx, entry); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("could not record write in outbox: %w", err)
+	}
+	return entry.Id, nil
+}
+
+// closeOutbox removes the outbox entry id once the post hooks succeeded. Entries of failed hooks are left
+// for the relay to retry. It returns hookErr.
+func (d *Mongo) closeOutbox(ctx context.Context, id primitive.ObjectID, hookErr error) error {
+	if id.IsZero() || hookErr != nil {
+		return hookErr
+	}
+	if _, err := d.Database.Collection(outboxCollection).DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		// The relay runs the hooks again, which is harmless for audit entries
+		d.Logger.Warn("could not remove outbox entry", "id", id.Hex(), "error", err)
+	}
+	return nil
+}
+
+// abortOutbox removes the outbox entry id of a write that failed, so the relay does not run the post hooks
+// of a write that was not made. Like in the other modes, the hooks of the docs a failed write of several
+// docs changed before failing do not run either. It returns writeErr.
+func (d *Mongo) abortOutbox(ctx context.Context, id primitive.ObjectID, writeErr error) error {
+	if id.IsZero() {
+		return writeErr
+	}
+	// The write may have failed because ctx is done
+	if _, err := d.Database.Collection(outboxCollection).DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": id}); err != nil {
+		return errors.Join(writeErr, fmt.Errorf("could not remove outbox entry of failed write: %w", err))
+	}
+	return writeErr
+}
+
+// outboxActive reports whether writes made with ctx go through the outbox
+func (d *Mongo) outboxActive(ctx context.Context) bool {
+	return d.mode == AuditOutbox && !db.HooksDisabled(ctx)
+}
+
+// writesOf returns an outbox write of ops for each doc, keeping the docs being deleted
+func writesOf(ops string, docs []bson.M) []outboxWrite {
+	writes := make([]outboxWrite, len(docs))
+	for i, doc := range docs {
+		writes[i] = outboxWrite{Ops: ops, DocId: doc["_id"]}
+		if ops == "delete" {
+			writes[i].Doc = doc
+		}
+	}
+	return writes
+}
+
+// OutboxRelay runs the post hooks of the writes left in the outbox, by a crash or a failing hook, in the
+// AuditOutbox mode. Hooks receive the stored doc and a context marked by db.WithRedelivery, as they may have
+// run already.
+type OutboxRelay struct {
+	d           *Mongo
+	interval    time.Duration
+	grace       time.Duration
+	maxAttempts int
+}
+
+// RelayOption configures an OutboxRelay
+type RelayOption func(*OutboxRelay)
+
+// WithRelayInterval sets how often Run looks for entries, every 10 seconds by default
+func WithRelayInterval(interval time.Duration) RelayOption {
+	return func(r *OutboxRelay) {
+		r.interval = interval
+	}
+}
+
+// WithRelayGrace sets the age entries are relayed at, a minute by default. Younger entries may belong
+// to writes still running.
+func WithRelayGrace(grace time.Duration) RelayOption {
+	return func(r *OutboxRelay) {
+		r.grace = grace
+	}
+}
+
+// WithMaxAttempts sets how many times an entry is relayed before it is left in the outbox for inspection,
+// 10 by default
+func WithMaxAttempts(n int) RelayOption {
+	return func(r *OutboxRelay) {
+		r.maxAttempts = n
+	}
+}
+
+func NewOutboxRelay(d *Mongo, opts ...RelayOption) *OutboxRelay {
+	r := &OutboxRelay{d: d, interval: 10 * time.Second, grace: time.Minute, maxAttempts: 10}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run relays entries until ctx is done
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.RelayOnce(ctx); err != nil {
+			r.d.Logger.Error("could not relay outbox", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOnce relays every entry old enough and returns how many were completed. Entries are claimed before
+// being relayed, so several relays can run against the same database.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	outbox := r.d.Database.Collection(outboxCollection)
+	relayed := 0
+	var errs []error
+	for ctx.Err() == nil {
+		now := time.Now()
+		claim := bson.M{
+			"created_at": bson.M{"$lte": now.Add(-r.grace)},
+			"attempts":   bson.M{"$lt": r.maxAttempts},
+			"$or": bson.A{
+				bson.M{"claimed_until": bson.M{"$exists": false}},
+				bson.M{"claimed_until": bson.M{"$lte": now}},
+			},
+		}
+		opts := options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)
+		var entry outboxEntry
+		err := outbox.FindOneAndUpdate(ctx, claim, bson.M{"$set": bson.M{"claimed_until": now.Add(r.grace)}}, opts).Decode(&entry)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				break
+			}
+			return relayed, errors.Join(append(errs, err)...)
+		}
+		if err = r.relay(ctx, entry); err != nil {
+			errs = append(errs, err)
+			// The claim is kept, so the entry is retried once it expires
+			update := bson.M{"$inc": bson.M{"attempts": 1}, "$set": bson.M{"last_error": err.Error()}}
+			if _, err = outbox.UpdateOne(ctx, bson.M{"_id": entry.Id}, update); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if _, err = outbox.DeleteOne(ctx, bson.M{"_id": entry.Id}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		relayed++
+	}
+	return relayed, errors.Join(errs...)
+}
+
+// relay runs the post hooks of the writes of entry that were made
+func (r *OutboxRelay) relay(ctx context.Context, entry outboxEntry) error {
+	ctx = db.WithRedelivery(ctx)
+	var errs []error
+	for _, w := range entry.Writes {
+		docId := idToString(w.DocId)
+		var doc bson.M
+		err := r.d.Database.Collection(entry.Col).FindOne(ctx, bson.M{"_id": w.DocId}).Decode(&doc)
+		found := err == nil
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			errs = append(errs, err)
+			continue
+		}
+		switch w.Ops {
+		case "delete":
+			// A doc still stored was not deleted
+			if !found && w.Doc != nil {
+				errs = append(errs, r.d.postDelete(ctx, in.Document(w.Doc), nil, entry.Col, docId))
+			}
+		default:
+			// A doc missing was not saved, or has been deleted since
+			if found {
+				errs = append(errs, r.d.postSave(ctx, in.Document(doc), nil, entry.Col, w.Ops, docId))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,303 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/DeimosTech/hookie/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHook records the post hooks it runs, failing them with err
+type recordingHook struct {
+	mu    sync.Mutex
+	calls []string // ops, doc id and whether the hook was redelivered
+	err   error
+}
+
+func (h *recordingHook) record(ctx context.Context, ops, docId string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	call := ops + " " + docId
+	if db.IsRedelivery(ctx) {
+		call += " redelivered"
+	}
+	h.calls = append(h.calls, call)
+	return h.err
+}
+
+func (h *recordingHook) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return nil
+}
+
+func (h *recordingHook) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return h.record(ctx, ops, docId)
+}
+
+func (h *recordingHook) PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return nil
+}
+
+func (h *recordingHook) PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return h.record(ctx, "delete", docId)
+}
+
+// commands returns the name and collection of the commands sent by mt since the last call
+func commands(mt *mtest.T) []string {
+	var names []string
+	for _, started := range mt.GetAllStartedEvents() {
+		name := started.CommandName
+		if target, ok := started.Command.Lookup(name).StringValueOK(); ok {
+			name += " " + target
+		}
+		names = append(names, name)
+	}
+	mt.ClearEvents()
+	return names
+}
+
+var (
+	ok         = mtest.CreateSuccessResponse()
+	duplicate  = mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"})
+	writeError = mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down", Name: "ShutdownInProgress"})
+)
+
+func cursor(docs ...bson.D) bson.D {
+	return mtest.CreateCursorResponse(0, "test.items", mtest.FirstBatch, docs...)
+}
+
+func TestUseAtomicAudit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	tests := []struct {
+		name  string
+		hello bson.D
+		want  AuditMode
+		err   bool
+	}{
+		{"replica set", mtest.CreateSuccessResponse(bson.E{Key: "setName", Value: "rs0"}), AuditTransaction, false},
+		{"sharded cluster", mtest.CreateSuccessResponse(bson.E{Key: "msg", Value: "isdbgrid"}), AuditTransaction, false},
+		{"standalone", ok, AuditOutbox, false},
+		{"unreachable", writeError, AuditAfterWrite, true},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			d := InitMongo(mt.Client, "test")
+			mt.AddMockResponses(tt.hello)
+			mode, err := d.UseAtomicAudit(context.Background())
+			if (err != nil) != tt.err || mode != tt.want || d.mode != tt.want {
+				mt.Errorf("UseAtomicAudit() = %s, %v, want %s", mode, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	tests := []struct {
+		name string
+		mode AuditMode
+		ctx  context.Context
+	}{
+		{"after write", AuditAfterWrite, context.Background()},
+		{"outbox", AuditOutbox, context.Background()},
+		{"hooks disabled", AuditTransaction, db.WithoutHooks(context.Background())},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			d := InitMongo(mt.Client, "test").SetAuditMode(tt.mode)
+			writeErr := errors.New("write failed")
+			calls := 0
+			err := d.atomic(tt.ctx, func(ctx context.Context) error {
+				calls++
+				if ctx != tt.ctx {
+					mt.Errorf("write ran with another context")
+				}
+				return writeErr
+			})
+			if calls != 1 || !errors.Is(err, writeErr) {
+				mt.Errorf("atomic() = %v after %d writes, want the error of one write", err, calls)
+			}
+			if got := commands(mt); len(got) > 0 {
+				mt.Errorf("atomic sent %v, want no transaction", got)
+			}
+		})
+	}
+}
+
+func TestOutboxWrites(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	ctx := context.Background()
+	doc := bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "a"}}
+	tests := []struct {
+		name      string
+		hookErr   error
+		responses []bson.D
+		write     func(d *Mongo) error
+		err       bool
+		commands  []string
+		calls     []string
+	}{
+		{
+			name:      "insert",
+			responses: []bson.D{ok, ok, ok},
+			write:     func(d *Mongo) error { return d.Insert(ctx, "items", bson.M{"_id": 1}) },
+			commands:  []string{"insert audit_outbox", "insert items", "delete audit_outbox"},
+			calls:     []string{"insert 1"},
+		},
+		{
+			name:      "failed insert",
+			responses: []bson.D{ok, duplicate, ok},
+			write:     func(d *Mongo) error { return d.Insert(ctx, "items", bson.M{"_id": 1}) },
+			err:       true,
+			commands:  []string{"insert audit_outbox", "insert items", "delete audit_outbox"},
+		},
+		{
+			name:      "failed hook",
+			hookErr:   errors.New("audit down"),
+			responses: []bson.D{ok, ok},
+			write:     func(d *Mongo) error { return d.Insert(ctx, "items", bson.M{"_id": 1}) },
+			err:       true,
+			// The entry is left for the relay
+			commands: []string{"insert audit_outbox", "insert items"},
+			calls:    []string{"insert 1"},
+		},
+		{
+			name:      "failed update",
+			responses: []bson.D{cursor(doc), ok, writeError, ok},
+			write:     func(d *Mongo) error { return d.Update(ctx, "items", bson.M{"_id": 1}, bson.M{"name": "b"}) },
+			err:       true,
+			commands:  []string{"find items", "insert audit_outbox", "findAndModify items", "delete audit_outbox"},
+		},
+		{
+			name:      "failed update of several docs",
+			responses: []bson.D{cursor(doc), ok, writeError, ok},
+			write:     func(d *Mongo) error { return d.PartialUpdateMany(ctx, "items", bson.M{}, bson.M{"name": "b"}) },
+			err:       true,
+			commands:  []string{"find items", "insert audit_outbox", "update items", "delete audit_outbox"},
+		},
+		{
+			name:      "failed delete",
+			responses: []bson.D{cursor(doc), ok, writeError, ok},
+			write:     func(d *Mongo) error { return d.DeleteOne(ctx, "items", bson.M{"_id": 1}) },
+			err:       true,
+			commands:  []string{"find items", "insert audit_outbox", "delete items", "delete audit_outbox"},
+		},
+		{
+			name:     "hooks disabled",
+			write:    func(d *Mongo) error { return d.Insert(db.WithoutHooks(ctx), "items", bson.M{"_id": 1}) },
+			commands: []string{"insert items"},
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			hook := &recordingHook{err: tt.hookErr}
+			d := InitMongo(mt.Client, "test", hook).SetAuditMode(AuditOutbox)
+			responses := tt.responses
+			if responses == nil {
+				responses = []bson.D{ok}
+			}
+			mt.AddMockResponses(responses...)
+			if err := tt.write(d); (err != nil) != tt.err {
+				mt.Fatalf("write = %v, want an error %v", err, tt.err)
+			}
+			if got := commands(mt); !reflect.DeepEqual(got, tt.commands) {
+				mt.Errorf("commands = %v, want %v", got, tt.commands)
+			}
+			if !reflect.DeepEqual(hook.calls, tt.calls) {
+				mt.Errorf("hooks ran for %v, want %v", hook.calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	ctx := context.Background()
+	entry := func(writes ...bson.D) bson.D {
+		value := bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "col", Value: "items"},
+			{Key: "writes", Value: writes},
+			{Key: "created_at", Value: time.Now().Add(-time.Hour)},
+		}
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: value})
+	}
+	write := func(ops string, id int32, doc bson.D) bson.D {
+		return bson.D{{Key: "ops", Value: ops}, {Key: "doc_id", Value: id}, {Key: "doc", Value: doc}}
+	}
+	stored := bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "a"}}
+	none := mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+
+	tests := []struct {
+		name      string
+		hookErr   error
+		responses []bson.D
+		relayed   int
+		err       bool
+		commands  []string
+		calls     []string
+	}{
+		{
+			name:      "empty outbox",
+			responses: []bson.D{none},
+			commands:  []string{"findAndModify audit_outbox"},
+		},
+		{
+			name:      "saved doc",
+			responses: []bson.D{entry(write("insert", 1, nil)), cursor(stored), ok, none},
+			relayed:   1,
+			commands:  []string{"findAndModify audit_outbox", "find items", "delete audit_outbox", "findAndModify audit_outbox"},
+			calls:     []string{"insert 1 redelivered"},
+		},
+		{
+			name:      "doc that was not saved",
+			responses: []bson.D{entry(write("update", 1, nil)), cursor(), ok, none},
+			relayed:   1,
+			commands:  []string{"findAndModify audit_outbox", "find items", "delete audit_outbox", "findAndModify audit_outbox"},
+		},
+		{
+			name:      "deleted doc",
+			responses: []bson.D{entry(write("delete", 1, stored)), cursor(), ok, none},
+			relayed:   1,
+			commands:  []string{"findAndModify audit_outbox", "find items", "delete audit_outbox", "findAndModify audit_outbox"},
+			calls:     []string{"delete 1 redelivered"},
+		},
+		{
+			name:      "doc that was not deleted",
+			responses: []bson.D{entry(write("delete", 1, stored)), cursor(stored), ok, none},
+			relayed:   1,
+			commands:  []string{"findAndModify audit_outbox", "find items", "delete audit_outbox", "findAndModify audit_outbox"},
+		},
+		{
+			name:      "failing hook",
+			hookErr:   errors.New("audit down"),
+			responses: []bson.D{entry(write("insert", 1, nil)), cursor(stored), ok, none},
+			err:       true,
+			// The attempt is counted and the entry kept
+			commands: []string{"findAndModify audit_outbox", "find items", "update audit_outbox", "findAndModify audit_outbox"},
+			calls:    []string{"insert 1 redelivered"},
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			hook := &recordingHook{err: tt.hookErr}
+			d := InitMongo(mt.Client, "test", hook).SetAuditMode(AuditOutbox)
+			mt.AddMockResponses(tt.responses...)
+			relayed, err := NewOutboxRelay(d).RelayOnce(ctx)
+			if relayed != tt.relayed || (err != nil) != tt.err {
+				mt.Errorf("RelayOnce() = %d, %v, want %d", relayed, err, tt.relayed)
+			}
+			if got := commands(mt); !reflect.DeepEqual(got, tt.commands) {
+				mt.Errorf("commands = %v, want %v", got, tt.commands)
+			}
+			if !reflect.DeepEqual(hook.calls, tt.calls) {
+				mt.Errorf("hooks ran for %v, want %v", hook.calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+type scopeKey struct{}
+
+type hardDeleteKey struct{}
+
+type eventKey struct{}
+
+// Scopes of the reads of soft deleted models
+const (
+	scopeLive = iota
+	scopeWithDeleted
+	scopeOnlyDeleted
+)
+
+// WithDeleted returns a copy of ctx for which reads of soft deleted models include the deleted documents
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scopeWithDeleted)
+}
+
+// OnlyDeleted returns a copy of ctx for which reads of soft deleted models only return the deleted documents
+func OnlyDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scopeOnlyDeleted)
+}
+
+// WithHardDelete returns a copy of ctx for which deletes of soft deleted models remove the documents
+func WithHardDelete(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hardDeleteKey{}, true)
+}
+
+// WithAuditEvent returns a copy of ctx for which the audit entries of updates record event instead of "update"
+func WithAuditEvent(ctx context.Context, event string) context.Context {
+	return context.WithValue(ctx, eventKey{}, event)
+}
+
+// AuditEvent returns the event set by WithAuditEvent, or event when none was set
+func AuditEvent(ctx context.Context, event string) string {
+	if e, ok := ctx.Value(eventKey{}).(string); ok {
+		return e
+	}
+	return event
+}
+
+// SoftDeleteField returns the field marking the soft deleted documents of col, empty when the model
+// registered for col is not soft deleted
+func SoftDeleteField(col string) string {
+	if cfg, ok := registry.LookupCollection(col); ok {
+		return cfg.SoftDelete
+	}
+	return ""
+}
+
+// SoftDeleting returns the field deletes of col made with ctx set instead of removing the documents
+func SoftDeleting(ctx context.Context, col string) (string, bool) {
+	if hard, _ := ctx.Value(hardDeleteKey{}).(bool); hard {
+		return "", false
+	}
+	field := SoftDeleteField(col)
+	return field, field != ""
+}
+
+// ScopeFilter restricts filter to the documents of col visible to reads made with ctx
+func ScopeFilter(ctx context.Context, col string, filter interface{}) interface{} {
+	field := SoftDeleteField(col)
+	if field == "" {
+		return filter
+	}
+	scope, _ := ctx.Value(scopeKey{}).(int)
+	switch scope {
+	case scopeWithDeleted:
+		return filter
+	case scopeOnlyDeleted:
+		return and(filter, bson.M{field: bson.M{"$ne": nil}})
+	}
+	return and(filter, bson.M{field: nil})
+}
+
+// ScopePipeline restricts the aggregate pipeline of col like ScopeFilter, by prepending a $match stage
+func ScopePipeline(ctx context.Context, col string, pipeline []interface{}) []interface{} {
+	predicate := ScopeFilter(ctx, col, nil)
+	if predicate == nil {
+		return pipeline
+	}
+	return append([]interface{}{bson.M{"$match": predicate}}, pipeline...)
+}
+
+// MarkDeleted soft deletes the documents of col matching filter, only the first one when one is set, by
+// setting field on them. The update is audited as a "soft_delete" event. It returns ErrNotFound when one
+// is set and no document matches.
+func MarkDeleted(ctx context.Context, store NoSql, col, field string, filter interface{}, one bool) error {
+	live := and(filter, bson.M{field: nil})
+	if one {
+		// The lookup is not a read of the caller, it must not run the find hooks
+		var doc bson.M
+		if err := store.FindOne(WithoutHooks(WithDeleted(ctx)), col, live, &doc); err != nil {
+			return err
+		}
+		live = bson.M{"_id": doc["_id"]}
+	}
+	return store.PartialUpdateMany(WithAuditEvent(ctx, "soft_delete"), col, live, bson.M{field: time.Now()})
+}
+
+// Restore undoes the soft delete of the documents of col matching filter. The update is audited as a
+// "restore" event.
+func Restore(ctx context.Context, store NoSql, col string, filter interface{}) error {
+	field := SoftDeleteField(col)
+	if field == "" {
+		return nil
+	}
+	deleted := and(filter, bson.M{field: bson.M{"$ne": nil}})
+	return store.PartialUpdateManyByQuery(WithAuditEvent(ctx, "restore"), col, deleted, UnorderedDbQuery{"$unset": bson.M{field: ""}})
+}
+
+// and combines filter with predicate
+func and(filter interface{}, predicate bson.M) interface{} {
+	if filter == nil {
+		return predicate
+	}
+	if m, ok := filter.(bson.M); ok && len(m) == 0 {
+		return predicate
+	}
+	return bson.M{"$and": bson.A{filter, predicate}}
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"reflect"
+)
+
+type versionKey struct{}
+
+// VersionField returns the version field of the model registered for col, empty when it is not versioned
+func VersionField(col string) string {
+	if cfg, ok := registry.LookupCollection(col); ok {
+		return cfg.VersionField
+	}
+	return ""
+}
+
+// WithDocumentVersion returns a copy of ctx carrying the version an update stored, set by the clients for
+// the PostSave hooks of updates of versioned models
+func WithDocumentVersion(ctx context.Context, version int64) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// DocumentVersion returns the version set by WithDocumentVersion
+func DocumentVersion(ctx context.Context) (int64, bool) {
+	version, ok := ctx.Value(versionKey{}).(int64)
+	return version, ok
+}
+
+// WithStoredVersion returns ctx carrying the version of doc, as stored in col by an update, when col is
+// versioned
+func WithStoredVersion(ctx context.Context, col string, doc bson.M) context.Context {
+	field := VersionField(col)
+	if field == "" {
+		return ctx
+	}
+	if version, ok := VersionOf(doc[field]); ok {
+		return WithDocumentVersion(ctx, version)
+	}
+	return ctx
+}
+
+// VersionOf converts the stored value of a version field to an int64
+func VersionOf(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// VersionedUpdate returns the filter and update an Update of col setting data runs with. For versioned
+// models the stored version is incremented instead of set, and when data carries a version the filter
+// only matches the document if it still has that version, which is returned as checked. A struct always
+// carries its version field unless it is omitempty, so a zero version in a struct is taken as unset and
+// not checked; a map sets version 0 explicitly to check it.
+func VersionedUpdate(col string, filter, data interface{}) (interface{}, bson.M, *int64, error) {
+	field := VersionField(col)
+	if field == "" {
+		return filter, bson.M{"$set": data}, nil, nil
+	}
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidData, err)
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidData, err)
+	}
+	var checked *int64
+	set := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if e.Key != field {
+			set = append(set, e)
+			continue
+		}
+		version, ok := VersionOf(e.Value)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("%w: version field %s is a %T", ErrInvalidData, field, e.Value)
+		}
+		if version == 0 && isStruct(data) {
+			continue
+		}
+		checked = &version
+	}
+	update := bson.M{"$inc": bson.M{field: 1}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if checked == nil {
+		return filter, update, nil, nil
+	}
+	expected := bson.M{field: *checked}
+	if *checked == 0 {
+		// Documents inserted without the field are at version 0
+		expected = bson.M{field: bson.M{"$in": bson.A{int64(0), nil}}}
+	}
+	return and(filter, expected), update, checked, nil
+}
+
+// isStruct reports whether data is a struct or a pointer to one
+func isStruct(data interface{}) bool {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct
+}
+
+// IncrementVersion adds the increment of the version of col to update, unless update writes the version
+// itself. It reports whether col is versioned.
+func IncrementVersion(col string, update bson.M) (bson.M, bool) {
+	field := VersionField(col)
+	if field == "" {
+		return update, false
+	}
+	for _, fields := range update {
+		switch m := fields.(type) {
+		case bson.M:
+			if _, ok := m[field]; ok {
+				return update, true
+			}
+		case bson.D:
+			for _, e := range m {
+				if e.Key == field {
+					return update, true
+				}
+			}
+		}
+	}
+	versioned := make(bson.M, len(update)+1)
+	for op, fields := range update {
+		versioned[op] = fields
+	}
+	switch inc := update["$inc"].(type) {
+	case nil:
+		versioned["$inc"] = bson.M{field: 1}
+	case bson.M:
+		incremented := bson.M{field: 1}
+		for key, value := range inc {
+			incremented[key] = value
+		}
+		versioned["$inc"] = incremented
+	case bson.D:
+		versioned["$inc"] = append(append(bson.D{}, inc...), bson.E{Key: field, Value: 1})
+	}
+	return versioned, true
+}
+
+// Conflict returns the error of an Update of col that matched no document while checking version: a
+// *ConflictError when the document matching filter has another version, else mongo.ErrNoDocuments
+func Conflict(ctx context.Context, store NoSql, col string, filter interface{}, version int64) error {
+	var doc bson.M
+	// The lookup is not a read of the caller, it must not run the find hooks
+	if err := store.FindOne(WithoutHooks(WithDeleted(ctx)), col, filter, &doc); err != nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, mongo.ErrNoDocuments) {
+			return mongo.ErrNoDocuments
+		}
+		return err
+	}
+	docId := fmt.Sprintf("%v", doc["_id"])
+	if oid, ok := doc["_id"].(primitive.ObjectID); ok {
+		docId = oid.Hex()
+	}
+	current, _ := VersionOf(doc[VersionField(col)])
+	return &ConflictError{Col: col, DocId: docId, Version: version, Current: current}
+}
@@ -1,14 +1,132 @@
 package hookie
 
 import (
-	_ "github.com/DeimosTech/hookie/internal/hook"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
 	"log/slog"
+	"reflect"
+	"time"
 )
 
 func init() {
 	slog.Default().Info("hookiee in action")
 }
 
+// Option configures a model registered with Register
+type Option func(*in.ModelConfig)
+
+// ErrDuplicateCollection is returned by NewRepository, and Register panics with it, when another model
+// is registered for the collection
+var ErrDuplicateCollection = registry.ErrDuplicateCollection
+
+// Register registers the struct type T for audit logging, without the need to embed in.Inject. It
+// panics if another type is registered for the same collection.
+func Register[T any](opts ...Option) {
+	cfg := in.ModelConfig{Type: reflect.TypeOf((*T)(nil)).Elem()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := registry.RegisterType(cfg); err != nil {
+		panic(err)
+	}
+}
+
+// WithCollection sets the collection the model is stored in
+func WithCollection(col string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.Collection = col
+	}
+}
+
+// WithFields limits auditing to the given document fields
+func WithFields(fields ...string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.Fields = append(cfg.Fields, fields...)
+	}
+}
+
+// WithRedaction keeps the values of the given document fields out of audit storage. Struct fields can also
+// be protected with the hookie tag: hookie:"redact", hookie:"mask=last4" or hookie:"hash".
+func WithRedaction(fields ...string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.Redact = append(cfg.Redact, fields...)
+	}
+}
+
+// WithIgnoredFields leaves the given document fields out of audit storage, like the hookie:"-" tag
+func WithIgnoredFields(fields ...string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.Ignore = append(cfg.Ignore, fields...)
+	}
+}
+
+// WithTrackOnlyFields records changes of the given document fields without creating an audit entry when
+// they are the only change, like the hookie:"trackonly" tag. Their changes are reported by the next entry.
+func WithTrackOnlyFields(fields ...string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.TrackOnly = append(cfg.TrackOnly, fields...)
+	}
+}
+
+// WithAccessLog logs the reads of the model through FindOne and List to the audit_access_logs collection,
+// with the actor, the filter and the ids of the documents returned
+func WithAccessLog() Option {
+	return func(cfg *in.ModelConfig) {
+		accessLog(cfg)
+	}
+}
+
+// WithAccessSampling logs only the given fraction of reads, between 0 and 1. It enables access logging.
+func WithAccessSampling(rate float64) Option {
+	return func(cfg *in.ModelConfig) {
+		accessLog(cfg).SampleRate = rate
+	}
+}
+
+// WithAccessDedup logs reads of the same documents by the same actor once per window. It enables access
+// logging.
+func WithAccessDedup(window time.Duration) Option {
+	return func(cfg *in.ModelConfig) {
+		accessLog(cfg).DedupWindow = window
+	}
+}
+
+func accessLog(cfg *in.ModelConfig) *in.AccessLogConfig {
+	if cfg.AccessLog == nil {
+		cfg.AccessLog = &in.AccessLogConfig{}
+	}
+	return cfg.AccessLog
+}
+
+// WithSoftDelete makes deletes of the model set its deleted_at field instead of removing it, and hides the
+// documents deleted so from reads. See db.WithDeleted, db.OnlyDeleted and db.Restore.
+func WithSoftDelete() Option {
+	return WithSoftDeleteField("deleted_at")
+}
+
+// WithSoftDeleteField is WithSoftDelete with the given field
+func WithSoftDeleteField(field string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.SoftDelete = field
+	}
+}
+
+// WithVersionField makes field the version of the model. Update increments it, and when the doc written
+// carries a version, only updates the document if it is still at that version, returning a
+// *db.ConflictError matching db.ErrVersionConflict otherwise. A struct at version 0 carries no version
+// and is not checked. Audit entries record the version the document is left at.
+func WithVersionField(field string) Option {
+	return func(cfg *in.ModelConfig) {
+		cfg.VersionField = field
+	}
+}
+
+// RegisterGenerated is called from files generated by hookie gen to register the models found at build
+// time
+func RegisterGenerated(keys ...string) {
+	registry.RegisterGenerated(keys...)
+}
+
 //func main() {
 //	defaultHooks := &hooks.DefaultHooks{}
 //	defaultHooks.PostSave(in.Test{})
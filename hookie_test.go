@@ -0,0 +1,85 @@
+package hookie
+
+import (
+	"context"
+	"errors"
+	"github.com/DeimosTech/hookie/db/memory"
+	"github.com/DeimosTech/hookie/hooks"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+type registeredOrder struct {
+	Id   string `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+type injectedNote struct {
+	in.Inject `bson:"-"`
+	Id        string `bson:"_id"`
+	Name      string `bson:"name"`
+}
+
+type unregisteredNote struct {
+	Id   string `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func TestRegisterWithInjectedModels(t *testing.T) {
+	ctx := context.Background()
+	Register[registeredOrder](WithCollection("register_orders"))
+	audit := memory.New()
+	store := memory.New(hooks.NewDefaultHookWithStore(audit))
+	tests := []struct {
+		col  string
+		doc  interface{}
+		id   string
+		want int64 // audit metas of the document
+	}{
+		{"register_orders", registeredOrder{Id: "o1", Name: "a"}, "o1", 1},
+		{"register_notes", injectedNote{Id: "n1", Name: "a"}, "n1", 1},
+		{"register_unaudited", unregisteredNote{Id: "u1", Name: "a"}, "u1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.col, func(t *testing.T) {
+			if err := store.Insert(ctx, tt.col, tt.doc); err != nil {
+				t.Fatal(err)
+			}
+			n, err := audit.Count(ctx, "audit_logs_meta", bson.M{"document_current_state._id": tt.id})
+			if err != nil || n != tt.want {
+				t.Errorf("got %d audit metas, %v, want %d", n, err, tt.want)
+			}
+		})
+	}
+}
+
+type firstOwner struct {
+	Id int `bson:"_id"`
+}
+
+type secondOwner struct {
+	Id int `bson:"_id"`
+}
+
+func (secondOwner) CollectionName() string {
+	return "register_shared"
+}
+
+func TestRegisterDuplicateCollection(t *testing.T) {
+	Register[firstOwner](WithCollection("register_shared"))
+	// Registering the same type again is allowed
+	Register[firstOwner](WithCollection("register_shared"), WithSoftDelete())
+
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrDuplicateCollection) {
+				t.Errorf("Register of a taken collection panicked with %v, want ErrDuplicateCollection", err)
+			}
+		}()
+		Register[secondOwner](WithCollection("register_shared"))
+	}()
+	if _, err := NewRepository[secondOwner](memory.New()); !errors.Is(err, ErrDuplicateCollection) {
+		t.Errorf("NewRepository() = %v, want ErrDuplicateCollection", err)
+	}
+}
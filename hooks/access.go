@@ -0,0 +1,197 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogs is the collection reads are logged to
+const accessLogs = "audit_access_logs"
+
+// accessDedup remembers the reads logged within their dedup window. Windows are kept per process.
+type accessDedup struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+	swept time.Time
+}
+
+// first reports whether key was not logged within window, and starts a new window for it if so
+func (a *accessDedup) first(key string, window time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.until == nil {
+		a.until = make(map[string]time.Time)
+	}
+	if now.Sub(a.swept) > time.Minute {
+		for k, until := range a.until {
+			if now.After(until) {
+				delete(a.until, k)
+			}
+		}
+		a.swept = now
+	}
+	if until, ok := a.until[key]; ok && now.Before(until) {
+		return false
+	}
+	a.until[key] = now.Add(window)
+	return true
+}
+
+// PostRead logs reads through FindOne and List of models with access logging enabled, with the actor, the
+// filter and the ids of the documents returned
+func (h *DefaultHooks) PostRead(ctx context.Context, result interface{}, filter interface{}, col, ops string) error {
+	if ops != "findOne" && ops != "list" {
+		return nil
+	}
+	cfg, ok := readConfig(result, col)
+	if !ok || cfg.AccessLog == nil {
+		return nil
+	}
+	ids := resultIds(result)
+	if len(ids) == 0 {
+		return nil
+	}
+	settings := cfg.AccessLog
+	if settings.SampleRate > 0 && settings.SampleRate < 1 && rand.Float64() >= settings.SampleRate {
+		return nil
+	}
+	actor, _ := in.ActorFrom(ctx)
+	info, _ := in.RequestInfoFrom(ctx)
+	if settings.DedupWindow > 0 {
+		key := strings.Join([]string{actor.UserType, actor.UserID, info.IPAddress, col, strings.Join(ids, ",")}, "|")
+		if !h.reads.first(key, settings.DedupWindow) {
+			return nil
+		}
+	}
+
+	db, err := h.store()
+	if err != nil {
+		return err
+	}
+	currentTime := time.Now()
+	entry := in.AccessLog{
+		Id:              primitive.NewObjectID(),
+		AccessEvent:     "read",
+		AccessOperation: ops,
+		AccessCol:       col,
+		AccessFilter:    accessFilter(filter, rulesOf(cfg.Type, cfg)),
+		AccessDocIds:    ids,
+		AccessURL:       info.URL,
+		AccessIPAddress: info.IPAddress,
+		AccessUserAgent: info.UserAgent,
+		AccessRequestId: info.RequestID,
+		AccessCreatedAt: &currentTime,
+		UserID:          actor.UserID,
+		UserType:        actor.UserType,
+	}
+	if settings.SampleRate > 0 && settings.SampleRate < 1 {
+		entry.AccessSampleRate = settings.SampleRate
+	}
+	// Access log writes must not run the hooks again
+	if err = db.Insert(hookiedb.WithoutHooks(ctx), accessLogs, entry); err != nil {
+		return fmt.Errorf("could not save access log: %w", err)
+	}
+	return nil
+}
+
+// readConfig returns the settings of the model registered for col, or of the type result decodes into
+func readConfig(result interface{}, col string) (*in.ModelConfig, bool) {
+	if cfg, ok := registry.LookupCollection(col); ok {
+		return cfg, true
+	}
+	t := reflect.TypeOf(result)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice) {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, false
+	}
+	return registry.LookupType(t)
+}
+
+// resultIds returns the sorted ids of the documents result points to
+func resultIds(result interface{}) []string {
+	v := reflect.ValueOf(result)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	var docs []interface{}
+	if v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			docs = append(docs, v.Index(i).Interface())
+		}
+	} else if v.IsValid() {
+		docs = append(docs, v.Interface())
+	}
+	var ids []string
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			continue
+		}
+		id, err := bson.Raw(raw).LookupErr("_id")
+		if err != nil {
+			continue
+		}
+		if oid, ok := id.ObjectIDOK(); ok {
+			ids = append(ids, oid.Hex())
+		} else if s, ok := id.StringValueOK(); ok {
+			ids = append(ids, s)
+		} else {
+			ids = append(ids, id.String())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// accessFilter converts filter to the form kept in the access log, protecting the values of protected
+// fields it matches on
+func accessFilter(filter interface{}, rules *auditRules) interface{} {
+	if filter == nil {
+		return nil
+	}
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		return nil
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	state := normalizeValue(doc).(map[string]interface{})
+	if err = protectFilter(state, rules); err != nil {
+		return nil
+	}
+	return state
+}
+
+// protectFilter strips the ignored fields filter matches on and protects the values of protected ones,
+// within the clauses of its logical operators too
+func protectFilter(filter map[string]interface{}, rules *auditRules) error {
+	for _, op := range []string{"$and", "$or", "$nor"} {
+		clauses, _ := filter[op].([]interface{})
+		for _, clause := range clauses {
+			if clause, ok := clause.(map[string]interface{}); ok {
+				if err := protectFilter(clause, rules); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	rules.strip(filter)
+	_, err := protect(filter, rules.protect, "")
+	return err
+}
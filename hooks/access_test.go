@@ -0,0 +1,221 @@
+package hooks
+
+import (
+	"context"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type patient struct {
+	Id    primitive.ObjectID `bson:"_id"`
+	Name  string             `bson:"name"`
+	Email string             `bson:"email" hookie:"hash"`
+	Notes string             `bson:"notes" hookie:"redact"`
+	Cache string             `bson:"cache" hookie:"-"`
+}
+
+// accessLogsOf returns the access logs written to audit since the last call, and removes them
+func accessLogsOf(t *testing.T, audit hookiedb.NoSql) []in.AccessLog {
+	t.Helper()
+	ctx := hookiedb.WithoutHooks(context.Background())
+	var logs []in.AccessLog
+	if err := audit.List(ctx, accessLogs, nil, 0, 0, &logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.DeleteMany(ctx, accessLogs, bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	return logs
+}
+
+func TestAccessLog(t *testing.T) {
+	const col = "access_patients"
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(patient{}), Collection: col,
+		AccessLog: &in.AccessLogConfig{DedupWindow: time.Hour}})
+	a := patient{Id: primitive.NewObjectID(), Name: "a", Email: "a@example.com", Notes: "n"}
+	b := patient{Id: primitive.NewObjectID(), Name: "b"}
+	if err := store.InsertMany(context.Background(), col, []interface{}{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{a.Id.Hex(), b.Id.Hex()}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	emailDigest, err := digestOf("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := in.WithActor(context.Background(), in.Actor{UserID: "alice", UserType: "staff"})
+	request := in.WithRequestInfo(alice, in.RequestInfo{IPAddress: "203.0.113.7", UserAgent: "test", URL: "http://example.com/patients", RequestID: "r1"})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		read func(ctx context.Context) error
+		want []in.AccessLog // with the fields compared, nil when no read must be logged
+	}{
+		{
+			name: "findOne",
+			ctx:  request,
+			read: func(ctx context.Context) error {
+				var doc patient
+				return store.FindOne(ctx, col, bson.M{"_id": a.Id}, &doc)
+			},
+			want: []in.AccessLog{{AccessOperation: "findOne", AccessFilter: map[string]interface{}{"_id": a.Id},
+				AccessDocIds: []string{a.Id.Hex()}, AccessURL: "http://example.com/patients", AccessIPAddress: "203.0.113.7",
+				AccessUserAgent: "test", AccessRequestId: "r1", UserID: "alice", UserType: "staff"}},
+		},
+		{
+			name: "same read within the dedup window",
+			ctx:  request,
+			read: func(ctx context.Context) error {
+				var doc patient
+				return store.FindOne(ctx, col, bson.M{"_id": a.Id}, &doc)
+			},
+		},
+		{
+			name: "same read by another actor",
+			ctx:  in.WithActor(context.Background(), in.Actor{UserID: "bob", UserType: "staff"}),
+			read: func(ctx context.Context) error {
+				var doc patient
+				return store.FindOne(ctx, col, bson.M{"_id": a.Id}, &doc)
+			},
+			want: []in.AccessLog{{AccessOperation: "findOne", AccessFilter: map[string]interface{}{"_id": a.Id},
+				AccessDocIds: []string{a.Id.Hex()}, UserID: "bob", UserType: "staff"}},
+		},
+		{
+			name: "list with protected and ignored fields in the filter",
+			ctx:  alice,
+			read: func(ctx context.Context) error {
+				var docs []patient
+				filter := bson.M{"$or": bson.A{bson.M{"email": "a@example.com"}, bson.M{"notes": bson.M{"$ne": "x"}, "cache": bson.M{"$ne": "c"}}}}
+				return store.List(ctx, col, filter, 0, 0, &docs)
+			},
+			want: []in.AccessLog{{AccessOperation: "list", AccessDocIds: ids, UserID: "alice", UserType: "staff",
+				AccessFilter: map[string]interface{}{"$or": []interface{}{
+					map[string]interface{}{"email": "sha256:" + emailDigest},
+					map[string]interface{}{"notes": redacted},
+				}}}},
+		},
+		{
+			name: "read without results",
+			ctx:  alice,
+			read: func(ctx context.Context) error {
+				var docs []patient
+				return store.List(ctx, col, bson.M{"name": "c"}, 0, 0, &docs)
+			},
+		},
+		{
+			name: "aggregate",
+			ctx:  alice,
+			read: func(ctx context.Context) error {
+				var docs []patient
+				return store.Aggregate(ctx, col, []interface{}{bson.M{"$match": bson.M{"name": "b"}}}, &docs)
+			},
+		},
+		{
+			name: "hooks disabled",
+			ctx:  hookiedb.WithoutHooks(alice),
+			read: func(ctx context.Context) error {
+				var docs []patient
+				return store.List(ctx, col, bson.M{"name": "b"}, 0, 0, &docs)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.read(tt.ctx); err != nil {
+				t.Fatal(err)
+			}
+			logs := accessLogsOf(t, audit)
+			for i := range logs {
+				if logs[i].Id.IsZero() || logs[i].AccessEvent != "read" || logs[i].AccessCol != col || logs[i].AccessCreatedAt == nil {
+					t.Errorf("access log %+v misses its id, event, collection or time", logs[i])
+				}
+				logs[i].Id, logs[i].AccessEvent, logs[i].AccessCol, logs[i].AccessCreatedAt = primitive.ObjectID{}, "", "", nil
+				logs[i].AccessFilter = normalizeValue(logs[i].AccessFilter)
+			}
+			if (len(logs) > 0 || tt.want != nil) && !reflect.DeepEqual(logs, tt.want) {
+				t.Errorf("access logs = %+v, want %+v", logs, tt.want)
+			}
+		})
+	}
+
+	t.Run("model without access logging", func(t *testing.T) {
+		const col = "access_plain"
+		if err := registry.RegisterType(in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Insert(alice, col, account{Id: primitive.NewObjectID()}); err != nil {
+			t.Fatal(err)
+		}
+		var docs []account
+		if err := store.List(alice, col, nil, 0, 0, &docs); err != nil {
+			t.Fatal(err)
+		}
+		if logs := accessLogsOf(t, audit); len(logs) != 0 {
+			t.Errorf("got access logs %+v, want none", logs)
+		}
+	})
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	const col = "access_sampled"
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col,
+		AccessLog: &in.AccessLogConfig{SampleRate: 0.5}})
+	ctx := context.Background()
+	doc := account{Id: primitive.NewObjectID()}
+	if err := store.Insert(ctx, col, doc); err != nil {
+		t.Fatal(err)
+	}
+	const reads = 400
+	for i := 0; i < reads; i++ {
+		var got account
+		if err := store.FindOne(ctx, col, bson.M{"_id": doc.Id}, &got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs := accessLogsOf(t, audit)
+	// Within 5 standard deviations of the 200 expected
+	if len(logs) < 150 || len(logs) > 250 {
+		t.Errorf("logged %d of %d reads sampled at 0.5", len(logs), reads)
+	}
+	for _, log := range logs {
+		if log.AccessSampleRate != 0.5 {
+			t.Fatalf("access log sample rate = %v, want 0.5", log.AccessSampleRate)
+		}
+	}
+}
+
+func TestAccessDedup(t *testing.T) {
+	var d accessDedup
+	if !d.first("a", time.Hour) || d.first("a", time.Hour) {
+		t.Error("read logged twice within its window")
+	}
+	if !d.first("b", time.Hour) {
+		t.Error("read of other documents not logged")
+	}
+	if !d.first("c", time.Millisecond) {
+		t.Fatal("first read not logged")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !d.first("c", time.Millisecond) {
+		t.Error("read not logged again after its window")
+	}
+	// Expired windows are swept once a minute
+	d.swept = time.Now().Add(-2 * time.Minute)
+	time.Sleep(2 * time.Millisecond)
+	d.first("d", time.Hour)
+	if _, ok := d.until["c"]; ok {
+		t.Error("expired window of c was kept")
+	}
+	if _, ok := d.until["a"]; !ok {
+		t.Error("window of a was swept before it expired")
+	}
+}
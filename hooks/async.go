@@ -0,0 +1,410 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrWriterClosed is returned when writing to a closed AsyncWriter
+var ErrWriterClosed = errors.New("hooks: audit writer closed")
+
+// OverflowPolicy decides what an AsyncWriter does with an entry when its queue is full
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota // wait for room in the queue
+	OverflowDrop                        // drop the entry, counted in AsyncStats.Dropped
+	OverflowSpill                       // append the entry to the spill file, see WithSpillFile
+)
+
+// AsyncStats are the counters of an AsyncWriter
+type AsyncStats struct {
+	Queued  int    // entries waiting to be written
+	Dropped uint64 // entries dropped because the queue was full
+	Spilled uint64 // entries written to the spill file
+	Failed  uint64 // entries the sink failed to write and that could not be spilled
+}
+
+// AsyncWriter is an AuditSink queueing entries and writing them to another sink in the background, so
+// audit writes do not add to the latency of the audited write. Workers write every entry available in
+// the queue at once, up to the batch size, so entries are batched under load.
+type AsyncWriter struct {
+	sink      AuditSink
+	queue     chan in.AuditLog
+	workers   int
+	batchSize int
+	policy    OverflowPolicy
+	spillPath string
+	spill     *spillFile
+	onError   func(error)
+
+	closing   chan struct{} // closed by Close, releasing the writes waiting for room in the queue
+	closeOnce sync.Once
+	closeMu   sync.RWMutex
+	closed    bool
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	pending int
+	idle    chan struct{} // closed when no entry is pending
+
+	dropped, spilled, failed atomic.Uint64
+}
+
+// AsyncOption configures an AsyncWriter
+type AsyncOption func(*AsyncWriter)
+
+// WithQueueSize sets the number of entries the queue holds, 1024 by default
+func WithQueueSize(n int) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.queue = make(chan in.AuditLog, n)
+	}
+}
+
+// WithWorkers sets the number of workers writing to the sink, 1 by default
+func WithWorkers(n int) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.workers = n
+	}
+}
+
+// WithBatchSize sets the maximum number of entries written at once, 100 by default
+func WithBatchSize(n int) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.batchSize = n
+	}
+}
+
+// WithOverflow sets what happens to entries when the queue is full, OverflowBlock by default
+func WithOverflow(policy OverflowPolicy) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.policy = policy
+	}
+}
+
+// WithSpillFile sets the file entries are spilled to, by OverflowSpill and when the sink fails.
+// Spilled entries are written to the sink by ReplaySpill.
+func WithSpillFile(path string) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.spillPath = path
+	}
+}
+
+// WithErrorHandler sets the function called with the errors of the background writes, which are logged
+// by default
+func WithErrorHandler(fn func(error)) AsyncOption {
+	return func(w *AsyncWriter) {
+		w.onError = fn
+	}
+}
+
+// NewAsyncWriter starts the workers writing to sink
+func NewAsyncWriter(sink AuditSink, opts ...AsyncOption) (*AsyncWriter, error) {
+	w := &AsyncWriter{
+		sink:      sink,
+		queue:     make(chan in.AuditLog, 1024),
+		workers:   1,
+		batchSize: 100,
+		idle:      make(chan struct{}),
+		closing:   make(chan struct{}),
+		onError: func(err error) {
+			slog.Default().Error("could not write audit logs", "error", err)
+		},
+	}
+	close(w.idle)
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.policy == OverflowSpill && w.spillPath == "" {
+		return nil, errors.New("hooks: OverflowSpill needs WithSpillFile")
+	}
+	if w.spillPath != "" {
+		w.spill = &spillFile{path: w.spillPath}
+	}
+	if w.workers < 1 {
+		w.workers = 1
+	}
+	if w.batchSize < 1 {
+		w.batchSize = 1
+	}
+	w.wg.Add(w.workers)
+	for i := 0; i < w.workers; i++ {
+		go w.work()
+	}
+	return w, nil
+}
+
+// Write queues logs, handling a full queue according to the overflow policy
+func (w *AsyncWriter) Write(ctx context.Context, logs []in.AuditLog) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	for _, log := range logs {
+		w.track(1)
+		select {
+		case w.queue <- log:
+			continue
+		default:
+		}
+		switch w.policy {
+		case OverflowDrop:
+			w.track(-1)
+			w.dropped.Add(1)
+		case OverflowSpill:
+			err := w.spill.write([]in.AuditLog{log})
+			w.track(-1)
+			if err != nil {
+				return fmt.Errorf("could not spill audit log: %w", err)
+			}
+			w.spilled.Add(1)
+		default:
+			select {
+			case w.queue <- log:
+			case <-w.closing:
+				w.track(-1)
+				return ErrWriterClosed
+			case <-ctx.Done():
+				w.track(-1)
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// Flush waits until every queued entry has been written
+func (w *AsyncWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	idle := w.idle
+	w.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting entries, writes the queued ones and closes the sink when it is an io.Closer
+func (w *AsyncWriter) Close(ctx context.Context) error {
+	// Writes waiting for room in the queue give up, so they no longer hold closeMu
+	w.closeOnce.Do(func() { close(w.closing) })
+	w.closeMu.Lock()
+	if w.closed {
+		w.closeMu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c, ok := w.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Stats returns the counters of the writer
+func (w *AsyncWriter) Stats() AsyncStats {
+	return AsyncStats{
+		Queued:  len(w.queue),
+		Dropped: w.dropped.Load(),
+		Spilled: w.spilled.Load(),
+		Failed:  w.failed.Load(),
+	}
+}
+
+// ReplaySpill writes the entries of the spill file to the sink and empties the file
+func (w *AsyncWriter) ReplaySpill(ctx context.Context) error {
+	if w.spill == nil {
+		return nil
+	}
+	return w.spill.replay(func(logs []in.AuditLog) error {
+		return w.sink.Write(ctx, logs)
+	}, w.batchSize)
+}
+
+func (w *AsyncWriter) work() {
+	defer w.wg.Done()
+	for log := range w.queue {
+		batch := []in.AuditLog{log}
+	drain:
+		for len(batch) < w.batchSize {
+			select {
+			case next, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		w.write(batch)
+	}
+}
+
+// write writes batch to the sink, spilling it when the sink fails
+func (w *AsyncWriter) write(batch []in.AuditLog) {
+	defer w.track(-len(batch))
+	err := w.sink.Write(context.Background(), batch)
+	if err == nil {
+		return
+	}
+	if w.spill != nil {
+		spillErr := w.spill.write(batch)
+		if spillErr == nil {
+			w.spilled.Add(uint64(len(batch)))
+			w.onError(fmt.Errorf("audit logs spilled after write failed: %w", err))
+			return
+		}
+		err = errors.Join(err, spillErr)
+	}
+	w.failed.Add(uint64(len(batch)))
+	w.onError(err)
+}
+
+// track adds n to the number of pending entries
+func (w *AsyncWriter) track(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == 0 && n > 0 {
+		w.idle = make(chan struct{})
+	}
+	w.pending += n
+	if w.pending == 0 && n < 0 {
+		close(w.idle)
+	}
+}
+
+// spillFile keeps entries as lines of extended JSON, which decode back to the same in.AuditLog
+type spillFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *spillFile) write(logs []in.AuditLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(logs)
+}
+
+func (s *spillFile) append(logs []in.AuditLog) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if err = writeLines(f, logs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewrite replaces the file with logs. They are written to a temporary file renamed over it, so the
+// entries are in one of the two files whenever writing fails.
+func (s *spillFile) rewrite(logs []in.AuditLog) error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err = writeLines(f, logs); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), s.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// writeLines writes logs to f, one line of extended JSON each
+func writeLines(f *os.File, logs []in.AuditLog) error {
+	bw := bufio.NewWriter(f)
+	for _, log := range logs {
+		line, err := bson.MarshalExtJSON(log, true, false)
+		if err != nil {
+			return err
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// replay hands the spilled entries to write in batches of size. Written entries are removed from the file,
+// the others are kept when write fails.
+func (s *spillFile) replay(write func([]in.AuditLog) error, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logs, err := s.read()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(logs); start += size {
+		end := start + size
+		if end > len(logs) {
+			end = len(logs)
+		}
+		if err = write(logs[start:end]); err != nil {
+			if start == 0 {
+				return err
+			}
+			return errors.Join(err, s.rewrite(logs[start:]))
+		}
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	return os.Truncate(s.path, 0)
+}
+
+func (s *spillFile) read() ([]in.AuditLog, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var logs []in.AuditLog
+	for scanner.Scan() {
+		var log in.AuditLog
+		if err = bson.UnmarshalExtJSON(scanner.Bytes(), true, &log); err != nil {
+			return nil, fmt.Errorf("could not read spilled audit log: %w", err)
+		}
+		logs = append(logs, log)
+	}
+	return logs, scanner.Err()
+}
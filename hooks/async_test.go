@@ -0,0 +1,275 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	in "github.com/DeimosTech/hookie/instance"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the entries written to it. Writes wait for gate when it is set, and fail with the
+// error fail returns for their batch.
+type fakeSink struct {
+	mu     sync.Mutex
+	logs   []in.AuditLog
+	gate   chan struct{}
+	fail   func(batch []in.AuditLog) error
+	closed bool
+}
+
+func (s *fakeSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		if err := s.fail(logs); err != nil {
+			return err
+		}
+	}
+	s.logs = append(s.logs, logs...)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// events returns the events of the entries written to the sink
+func (s *fakeSink) events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []string
+	for _, log := range s.logs {
+		events = append(events, log.AuditEvent)
+	}
+	return events
+}
+
+func entries(events ...string) []in.AuditLog {
+	logs := make([]in.AuditLog, len(events))
+	for i, event := range events {
+		logs[i] = in.AuditLog{AuditEvent: event}
+	}
+	return logs
+}
+
+// spilledEvents returns the events of the entries in the spill file at path
+func spilledEvents(t *testing.T, path string) []string {
+	t.Helper()
+	logs, err := (&spillFile{path: path}).read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, log := range logs {
+		events = append(events, log.AuditEvent)
+	}
+	return events
+}
+
+func TestAsyncWriterOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		err     error // of the write overflowing the queue
+		stats   AsyncStats
+		spilled []string
+	}{
+		{policy: OverflowBlock, err: context.DeadlineExceeded},
+		{policy: OverflowDrop, stats: AsyncStats{Dropped: 1}},
+		{policy: OverflowSpill, stats: AsyncStats{Spilled: 1}, spilled: []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(map[OverflowPolicy]string{OverflowBlock: "block", OverflowDrop: "drop", OverflowSpill: "spill"}[tt.policy], func(t *testing.T) {
+			sink := &fakeSink{gate: make(chan struct{})}
+			spill := filepath.Join(t.TempDir(), "spill.jsonl")
+			w, err := NewAsyncWriter(sink, WithQueueSize(1), WithOverflow(tt.policy), WithSpillFile(spill))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			// a is taken by the worker, which waits for the gate, and b fills the queue
+			if err = w.Write(ctx, entries("a")); err != nil {
+				t.Fatal(err)
+			}
+			for w.Stats().Queued > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if err = w.Write(ctx, entries("b")); err != nil {
+				t.Fatal(err)
+			}
+
+			timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			if err = w.Write(timeout, entries("c")); !errors.Is(err, tt.err) {
+				t.Errorf("Write() = %v, want %v", err, tt.err)
+			}
+			close(sink.gate)
+			if err = w.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			tt.stats.Queued = 0
+			if got := w.Stats(); got != tt.stats {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.stats)
+			}
+			if got := sink.events(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+				t.Errorf("written = %v, want [a b]", got)
+			}
+			if got := spilledEvents(t, spill); !reflect.DeepEqual(got, tt.spilled) {
+				t.Errorf("spilled = %v, want %v", got, tt.spilled)
+			}
+		})
+	}
+}
+
+func TestAsyncWriterFlushAndClose(t *testing.T) {
+	ctx := context.Background()
+	sink := &fakeSink{gate: make(chan struct{})}
+	w, err := NewAsyncWriter(sink, WithQueueSize(1), WithBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Flush(ctx); err != nil {
+		t.Fatalf("Flush without entries: %v", err)
+	}
+	if err = w.Write(ctx, entries("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err = w.Flush(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush of a waiting entry = %v, want context.DeadlineExceeded", err)
+	}
+
+	// A write waiting for room in the full queue must not keep Close from closing it
+	blocked := make(chan error)
+	go func() {
+		blocked <- w.Write(ctx, entries("c"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan error)
+	go func() {
+		closed <- w.Close(ctx)
+	}()
+	select {
+	case err = <-blocked:
+		if !errors.Is(err, ErrWriterClosed) {
+			t.Errorf("blocked Write() = %v, want ErrWriterClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not release the blocked Write")
+	}
+	close(sink.gate)
+	if err = <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err = w.Flush(ctx); err != nil {
+		t.Errorf("Flush after Close: %v", err)
+	}
+	if got := sink.events(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("written = %v, want [a b]", got)
+	}
+	if !sink.closed {
+		t.Error("Close did not close the sink")
+	}
+	if err = w.Write(ctx, entries("d")); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Write after Close = %v, want ErrWriterClosed", err)
+	}
+	if err = w.Close(ctx); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestAsyncWriterSpillAndReplay(t *testing.T) {
+	ctx := context.Background()
+	down := errors.New("sink down")
+	dir := t.TempDir()
+	spill := filepath.Join(dir, "spill.jsonl")
+	sink := &fakeSink{fail: func([]in.AuditLog) error { return down }}
+	var reported []error
+	w, err := NewAsyncWriter(sink, WithBatchSize(2), WithSpillFile(spill), WithErrorHandler(func(err error) {
+		reported = append(reported, err)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writes of the failing sink are spilled
+	for _, event := range []string{"a", "b", "c", "d", "e"} {
+		if err = w.Write(ctx, entries(event)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := w.Stats(); got.Spilled != 5 || got.Failed != 0 || len(reported) != 5 || !errors.Is(reported[0], down) {
+		t.Fatalf("Stats() = %+v with errors %v, want 5 spilled entries", got, reported)
+	}
+
+	tests := []struct {
+		name    string
+		fail    func(batch []in.AuditLog) error
+		err     error
+		written []string
+		spilled []string
+	}{
+		{
+			name: "sink still down",
+			fail: func([]in.AuditLog) error { return down },
+			err:  down,
+			// Nothing was written, the file is left as it is
+			spilled: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name: "second batch fails",
+			fail: func(batch []in.AuditLog) error {
+				if batch[0].AuditEvent == "c" {
+					return down
+				}
+				return nil
+			},
+			err:     down,
+			written: []string{"a", "b"},
+			spilled: []string{"c", "d", "e"},
+		},
+		{
+			name:    "sink back",
+			written: []string{"a", "b", "c", "d", "e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.mu.Lock()
+			sink.fail = tt.fail
+			sink.mu.Unlock()
+			if err := w.ReplaySpill(ctx); !errors.Is(err, tt.err) {
+				t.Fatalf("ReplaySpill() = %v, want %v", err, tt.err)
+			}
+			if got := sink.events(); !reflect.DeepEqual(got, tt.written) {
+				t.Errorf("written = %v, want %v", got, tt.written)
+			}
+			if got := spilledEvents(t, spill); !reflect.DeepEqual(got, tt.spilled) {
+				t.Errorf("spilled = %v, want %v", got, tt.spilled)
+			}
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Errorf("files next to the spill file: %v", files)
+			}
+		})
+	}
+	if err = w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
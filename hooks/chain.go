@@ -0,0 +1,329 @@
+package hooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// Problems reported by Verify
+const (
+	IssueUnchained    = "unchained"     // entry written before audit logs were chained
+	IssueGap          = "gap"           // entries are missing before this one
+	IssueDuplicate    = "duplicate"     // another entry has the same sequence number
+	IssueHashMismatch = "hash mismatch" // entry was modified after it was written
+	IssueBrokenLink   = "broken link"   // entry does not follow the previous one
+	IssueTruncated    = "truncated"     // entries are missing after the last one
+	IssueMissingMeta  = "missing meta"  // entries exist for a document whose meta was removed
+	IssueUnsigned     = "unsigned"      // entry has no signature, reported when verifying with keys
+	IssueBadSignature = "bad signature" // signature does not match or its key is unknown
+)
+
+// ChainIssue is a problem found in the audit chain of a document
+type ChainIssue struct {
+	MetaId  string
+	DocId   string
+	Version int64  // sequence number of the entry, 0 when the issue is not about a single entry
+	AuditId string // id of the entry, empty when the issue is not about a single entry
+	Problem string // one of the Issue constants
+	Detail  string
+}
+
+func (i ChainIssue) String() string {
+	return fmt.Sprintf("meta %s (document %s) version %d entry %s: %s: %s", i.MetaId, i.DocId, i.Version, i.AuditId, i.Problem, i.Detail)
+}
+
+// verifyBatch is the number of metas read at a time by Verify
+const verifyBatch = 500
+
+// Verify walks the audit chain of every document and reports gaps, modified entries and broken links.
+// Signatures are checked too when the history has keys.
+func (h *History) Verify(ctx context.Context) ([]ChainIssue, error) {
+	db, err := auditStore(h.db)
+	if err != nil {
+		return nil, err
+	}
+	var issues []ChainIssue
+	seen := make(map[string]bool)
+	for skip := int64(0); ; skip += verifyBatch {
+		var metas []in.AuditLogMeta
+		if err = db.List(ctx, "audit_logs_meta", bson.M{}, skip, verifyBatch, &metas, bson.D{{Key: "_id", Value: 1}}); err != nil {
+			return nil, fmt.Errorf("could not list audit log metas: %w", err)
+		}
+		for i := range metas {
+			found, err := verifyChain(ctx, db, &metas[i], h.keys)
+			if err != nil {
+				return nil, err
+			}
+			issues = append(issues, found...)
+			seen[metas[i].Id.Hex()] = true
+		}
+		if len(metas) < verifyBatch {
+			break
+		}
+	}
+
+	// Removing the meta hides every entry of a document from the walk above
+	var metaIds []string
+	if err = db.Distinct(ctx, "audit_logs", "audit_meta_id", bson.M{}, &metaIds); err != nil {
+		return nil, fmt.Errorf("could not list audited documents: %w", err)
+	}
+	for _, metaId := range metaIds {
+		if !seen[metaId] {
+			issues = append(issues, ChainIssue{MetaId: metaId, Problem: IssueMissingMeta, Detail: "audit entries without meta"})
+		}
+	}
+	return issues, nil
+}
+
+// VerifyDocument walks the audit chain of the document docId
+func (h *History) VerifyDocument(ctx context.Context, docId string) ([]ChainIssue, error) {
+	db, err := auditStore(h.db)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := findAuditLogMeta(ctx, db, docId)
+	if err != nil {
+		return nil, err
+	}
+	return verifyChain(ctx, db, meta, h.keys)
+}
+
+// verifyChain checks that the entries of meta are numbered from 1 without gaps, that each is unmodified
+// and links to the one before it, and that the last one is the one meta points to
+func verifyChain(ctx context.Context, db hookiedb.NoSql, meta *in.AuditLogMeta, keys *KeySet) ([]ChainIssue, error) {
+	logs, err := auditLogs(ctx, db, meta.Id)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(logs))
+	for i := range logs {
+		if hashes[i], err = hashAuditLog(logs[i]); err != nil {
+			return nil, err
+		}
+	}
+	docId, _ := meta.DocumentCurrentState["_id"].(string)
+	issues, expected, lastHash := checkChain(meta.Id.Hex(), docId, logs, hashes, keys)
+	tail := ChainIssue{MetaId: meta.Id.Hex(), DocId: docId}
+	switch {
+	case meta.Version >= expected:
+		tail.Problem, tail.Detail = IssueTruncated, fmt.Sprintf("versions %d to %d are missing", expected, meta.Version)
+		issues = append(issues, tail)
+	case meta.LastHash != "" && meta.LastHash != lastHash:
+		tail.Problem, tail.Detail = IssueBrokenLink, "last entry is not the one recorded in the meta"
+		issues = append(issues, tail)
+	}
+	return issues, nil
+}
+
+// checkChain checks the entries of one document, ordered by sequence number, against the hashes computed
+// from their content. Signatures are checked when keys is set. It returns the issues found, the next
+// expected sequence number and the hash of the last entry.
+func checkChain(metaId, docId string, logs []in.AuditLog, hashes []string, keys *KeySet) ([]ChainIssue, int64, string) {
+	var issues []ChainIssue
+	report := func(entry *in.AuditLog, problem, detail string) {
+		issues = append(issues, ChainIssue{
+			MetaId:  metaId,
+			DocId:   docId,
+			Version: entry.AuditVersion,
+			AuditId: entry.Id.Hex(),
+			Problem: problem,
+			Detail:  detail,
+		})
+	}
+
+	expected, prevHash := int64(1), ""
+	for i := range logs {
+		entry := &logs[i]
+		if entry.AuditVersion == 0 && entry.AuditHash == "" {
+			// Entries written before chaining count towards the sequence like nextVersion does
+			report(entry, IssueUnchained, "entry has no sequence number or hash")
+			expected++
+			continue
+		}
+		switch {
+		case entry.AuditVersion > expected:
+			report(entry, IssueGap, fmt.Sprintf("versions %d to %d are missing", expected, entry.AuditVersion-1))
+		case entry.AuditVersion < expected:
+			report(entry, IssueDuplicate, fmt.Sprintf("version %d appears more than once", entry.AuditVersion))
+		case entry.AuditPrevHash != prevHash:
+			report(entry, IssueBrokenLink, "previous hash does not match the previous entry")
+		}
+		if hashes[i] != entry.AuditHash {
+			report(entry, IssueHashMismatch, "content does not match its hash")
+		} else if keys != nil {
+			if entry.AuditSignature == "" {
+				report(entry, IssueUnsigned, "entry has no signature")
+			} else if err := keys.verifyAuditLog(entry); err != nil {
+				report(entry, IssueBadSignature, err.Error())
+			}
+		}
+		expected, prevHash = entry.AuditVersion+1, entry.AuditHash
+	}
+	return issues, expected, prevHash
+}
+
+// errStaleMeta is returned by advanceMeta when another entry was chained to the document first
+var errStaleMeta = errors.New("hooks: audit meta changed concurrently")
+
+// errPendingMeta is returned while the last entry chained to the document is still being written
+var errPendingMeta = errors.New("hooks: audit entry of the document is being written")
+
+// staleMetaRetries bounds how often an entry is chained again after losing to concurrent writes
+const staleMetaRetries = 100
+
+const (
+	// pendingTimeout is how long writers wait for the entry chained last to be written. The claim of a
+	// writer that stopped before settling it is taken over after that.
+	pendingTimeout = 30 * time.Second
+	// pendingPoll is how often writers check whether the entry chained last was written
+	pendingPoll = 5 * time.Millisecond
+)
+
+// advanceMeta stores state as the meta of the document following meta, unless another entry was chained
+// to the document since meta was read, in which case it returns errStaleMeta
+func advanceMeta(ctx context.Context, db hookiedb.NoSql, meta *in.AuditLogMeta, state in.AuditLogMeta) error {
+	filter := bson.M{"_id": meta.Id, "version": meta.Version}
+	if meta.Version == 0 {
+		// Metas written before entries were versioned have no version
+		filter["version"] = nil
+	}
+	var data interface{} = state
+	if meta.Deleted && !state.Deleted {
+		// The document was inserted again, its meta is no longer the one of a deleted document
+		raw, err := bson.Marshal(state)
+		if err != nil {
+			return err
+		}
+		var fields bson.M
+		if err = bson.Unmarshal(raw, &fields); err != nil {
+			return err
+		}
+		fields["deleted"] = false
+		data = fields
+	}
+	if err := db.Update(ctx, "audit_logs_meta", filter, data); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errStaleMeta
+		}
+		return fmt.Errorf("could not update audit log meta: %w", err)
+	}
+	return nil
+}
+
+// checkSettled returns errPendingMeta while the entry chained last to meta is being written
+func checkSettled(meta *in.AuditLogMeta) error {
+	if meta.Pending != 0 && time.Since(meta.Pending.Time()) < pendingTimeout {
+		return errPendingMeta
+	}
+	return nil
+}
+
+// settleMeta marks the entry at version, chained to the meta metaId, as written
+func settleMeta(ctx context.Context, db hookiedb.NoSql, metaId primitive.ObjectID, version int64) error {
+	if err := db.Update(ctx, "audit_logs_meta", bson.M{"_id": metaId, "version": version}, bson.M{"pending": primitive.DateTime(0)}); err != nil {
+		return fmt.Errorf("could not settle audit log meta: %w", err)
+	}
+	return nil
+}
+
+// rollbackMeta restores meta, as it was before the entry at version was chained to it, when that entry
+// could not be written. Other writers wait for the entry, so the meta is still at version.
+func rollbackMeta(ctx context.Context, db hookiedb.NoSql, meta *in.AuditLogMeta, version int64) error {
+	var prevVersion interface{} = meta.Version
+	if meta.Version == 0 {
+		prevVersion = nil
+	}
+	restore := bson.M{
+		"document_current_state": meta.DocumentCurrentState,
+		"version":                prevVersion,
+		"last_hash":              meta.LastHash,
+		"digests":                meta.Digests,
+		"digest_salt":            meta.DigestSalt,
+		"deleted":                meta.Deleted,
+		"pending":                primitive.DateTime(0),
+	}
+	if err := db.Update(ctx, "audit_logs_meta", bson.M{"_id": meta.Id, "version": version}, restore); err != nil {
+		return fmt.Errorf("could not roll back audit log meta: %w", err)
+	}
+	return nil
+}
+
+// isDuplicateKey reports whether err is the violation of a unique index
+func isDuplicateKey(err error) bool {
+	return errors.Is(err, hookiedb.ErrDuplicateKey) || mongo.IsDuplicateKeyError(err)
+}
+
+// retryStaleMeta runs chain, which reads the meta of a document and chains an entry to it, again for as
+// long as it loses to concurrent writes to the document, or waits for the entry chained last to be written
+func retryStaleMeta(chain func() error) error {
+	var err error
+	for attempt := 0; attempt < staleMetaRetries; {
+		err = chain()
+		switch {
+		case errors.Is(err, errPendingMeta):
+			time.Sleep(pendingPoll)
+		case errors.Is(err, errStaleMeta):
+			attempt++
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// chainAuditLog links entry to the last entry recorded in meta and seals it with its hash, signed by
+// signer when it is set
+func chainAuditLog(entry *in.AuditLog, meta *in.AuditLogMeta, signer Signer) error {
+	entry.AuditPrevHash = meta.LastHash
+	if signer != nil {
+		entry.AuditKeyId = signer.KeyID()
+	}
+	hash, err := hashAuditLog(*entry)
+	if err != nil {
+		return fmt.Errorf("could not hash audit log: %w", err)
+	}
+	entry.AuditHash = hash
+	if signer != nil {
+		return signAuditLog(entry, signer)
+	}
+	return nil
+}
+
+// hashAuditLog returns the SHA-256 of the canonical form of entry without its hash and signature
+func hashAuditLog(entry in.AuditLog) (string, error) {
+	entry.AuditHash, entry.AuditSignature = "", ""
+	canonical, err := canonicalAuditLog(entry)
+	if err != nil {
+		return "", err
+	}
+	return hashCanonical(canonical), nil
+}
+
+func hashCanonical(canonical []byte) string {
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalAuditLog encodes entry the way it is stored and then as JSON, which sorts document keys, so
+// the encoding is the same after reading the entry back or decoding an export
+func canonicalAuditLog(entry in.AuditLog) ([]byte, error) {
+	data, err := bson.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalizeValue(doc))
+}
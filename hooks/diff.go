@@ -0,0 +1,372 @@
+package hooks
+
+import (
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// compareDocumentStates returns the changes from oldDoc to newDoc keyed by their path, leaving out the
+// fields ignored by rules. When partial is set newDoc only holds the fields being updated, possibly by
+// dotted path, so fields missing from it are not reported as removed. significant is false when every
+// change is to a track-only field, in which case no audit entry is needed.
+func compareDocumentStates(oldDoc, newDoc map[string]interface{}, partial bool, rules *auditRules) (map[string]in.AuditChange, bool) {
+	changes := diffStates(oldDoc, newDoc, partial)
+	significant := false
+	for path := range changes {
+		if rules.ignored(path) {
+			delete(changes, path)
+		} else if !rules.tracked(path) {
+			significant = true
+		}
+	}
+	return changes, significant
+}
+
+// diffStates returns every change from oldDoc to newDoc keyed by its path
+func diffStates(oldDoc, newDoc map[string]interface{}, partial bool) map[string]in.AuditChange {
+	changes := make(map[string]in.AuditChange)
+	if partial {
+		for key, newVal := range newDoc {
+			if key == "_id" {
+				continue
+			}
+			if oldVal, ok := valueAt(oldDoc, key); ok {
+				diffValues(key, oldVal, newVal, changes)
+			} else {
+				changes[key] = in.AuditChange{Type: in.ChangeAdded, New: newVal}
+			}
+		}
+		return changes
+	}
+	for _, key := range unionKeys(oldDoc, newDoc) {
+		if key == "_id" {
+			continue
+		}
+		oldVal, inOld := oldDoc[key]
+		newVal, inNew := newDoc[key]
+		switch {
+		case !inNew:
+			changes[key] = in.AuditChange{Type: in.ChangeRemoved, Old: oldVal}
+		case !inOld:
+			changes[key] = in.AuditChange{Type: in.ChangeAdded, New: newVal}
+		default:
+			diffValues(key, oldVal, newVal, changes)
+		}
+	}
+	return changes
+}
+
+// diffValues adds the changes between oldVal and newVal at path, descending into documents and arrays
+func diffValues(path string, oldVal, newVal interface{}, changes map[string]in.AuditChange) {
+	oldMap, oldIsMap := oldVal.(map[string]interface{})
+	newMap, newIsMap := newVal.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		for _, key := range unionKeys(oldMap, newMap) {
+			o, inOld := oldMap[key]
+			n, inNew := newMap[key]
+			switch {
+			case !inNew:
+				changes[path+"."+key] = in.AuditChange{Type: in.ChangeRemoved, Old: o}
+			case !inOld:
+				changes[path+"."+key] = in.AuditChange{Type: in.ChangeAdded, New: n}
+			default:
+				diffValues(path+"."+key, o, n, changes)
+			}
+		}
+		return
+	}
+
+	oldArr, oldIsArr := oldVal.([]interface{})
+	newArr, newIsArr := newVal.([]interface{})
+	if oldIsArr && newIsArr {
+		for i := 0; i < len(oldArr) || i < len(newArr); i++ {
+			elemPath := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(newArr):
+				changes[elemPath] = in.AuditChange{Type: in.ChangeRemoved, Old: oldArr[i]}
+			case i >= len(oldArr):
+				changes[elemPath] = in.AuditChange{Type: in.ChangeAdded, New: newArr[i]}
+			default:
+				diffValues(elemPath, oldArr[i], newArr[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(oldVal, newVal) {
+		changes[path] = in.AuditChange{Type: in.ChangeModified, Old: oldVal, New: newVal}
+	}
+}
+
+// changeList returns changes as recorded in audit entries, ordered by path
+func changeList(changes map[string]in.AuditChange) []in.AuditChange {
+	if len(changes) == 0 {
+		return nil
+	}
+	list := make([]in.AuditChange, 0, len(changes))
+	for path, change := range changes {
+		change.Path = path
+		list = append(list, change)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return comparePaths(list[i].Path, list[j].Path) < 0
+	})
+	return list
+}
+
+// mergeStates returns the state of the document after newDoc has been saved over oldDoc
+func mergeStates(oldDoc, newDoc map[string]interface{}, partial bool) map[string]interface{} {
+	merged := make(map[string]interface{}, len(oldDoc)+len(newDoc))
+	if !partial {
+		for key, value := range newDoc {
+			merged[key] = value
+		}
+	} else {
+		for key, value := range oldDoc {
+			merged[key] = normalizeValue(value)
+		}
+		for key, value := range newDoc {
+			if key != "_id" {
+				setValueAt(merged, key, value)
+			}
+		}
+	}
+	// The meta is looked up by the _id it holds, which must survive any update
+	if id, ok := oldDoc["_id"]; ok {
+		merged["_id"] = id
+	}
+	return merged
+}
+
+// valueAt returns the value at path in doc. Paths are dotted, array elements are addressed as "tags[2]"
+// or as "tags.2".
+func valueAt(doc map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range splitPath(path) {
+		switch val := cur.(type) {
+		case map[string]interface{}:
+			next, ok := val[part]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(val) {
+				return nil, false
+			}
+			cur = val[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setValueAt sets the value at path in doc, creating the documents leading to it.
+// doc must not share nested values with other states.
+func setValueAt(doc map[string]interface{}, path string, value interface{}) {
+	parts := splitPath(path)
+	var cur interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch val := cur.(type) {
+		case map[string]interface{}:
+			if last {
+				val[part] = value
+				return
+			}
+			next, ok := val[part].(map[string]interface{})
+			if !ok {
+				if arr, isArr := val[part].([]interface{}); isArr {
+					cur = arr
+					continue
+				}
+				next = make(map[string]interface{})
+				val[part] = next
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(val) {
+				return
+			}
+			if last {
+				val[idx] = value
+				return
+			}
+			cur = val[idx]
+		default:
+			return
+		}
+	}
+}
+
+// insertValueAt sets the value at path in doc like setValueAt, but inserts it when path is an array
+// element instead of replacing the element at that index
+func insertValueAt(doc map[string]interface{}, path string, value interface{}) {
+	insertAt(doc, splitPath(path), value)
+}
+
+func insertAt(cur interface{}, parts []string, value interface{}) interface{} {
+	last := len(parts) == 1
+	switch val := cur.(type) {
+	case map[string]interface{}:
+		if last {
+			val[parts[0]] = value
+			return val
+		}
+		next, ok := val[parts[0]]
+		if !ok {
+			next = make(map[string]interface{})
+		}
+		val[parts[0]] = insertAt(next, parts[1:], value)
+		return val
+	case []interface{}:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return val
+		}
+		if last {
+			if idx > len(val) {
+				idx = len(val)
+			}
+			val = append(val, nil)
+			copy(val[idx+1:], val[idx:])
+			val[idx] = value
+			return val
+		}
+		if idx < len(val) {
+			val[idx] = insertAt(val[idx], parts[1:], value)
+		}
+		return val
+	}
+	return cur
+}
+
+// removeValueAt removes the value at path from doc. Array elements are removed from the array rather
+// than set to nil.
+func removeValueAt(doc map[string]interface{}, path string) {
+	removeAt(doc, splitPath(path))
+}
+
+func removeAt(cur interface{}, parts []string) interface{} {
+	last := len(parts) == 1
+	switch val := cur.(type) {
+	case map[string]interface{}:
+		if last {
+			delete(val, parts[0])
+			return val
+		}
+		if next, ok := val[parts[0]]; ok {
+			val[parts[0]] = removeAt(next, parts[1:])
+		}
+		return val
+	case []interface{}:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 || idx >= len(val) {
+			return val
+		}
+		if last {
+			return append(val[:idx:idx], val[idx+1:]...)
+		}
+		val[idx] = removeAt(val[idx], parts[1:])
+		return val
+	}
+	return cur
+}
+
+// splitPath splits a path such as "items[2].name" or "items.2.name" into its parts
+func splitPath(path string) []string {
+	return strings.Split(pathReplacer.Replace(path), ".")
+}
+
+var pathReplacer = strings.NewReplacer("[", ".", "]", "")
+
+// comparePaths orders paths part by part, comparing array indexes as numbers
+func comparePaths(a, b string) int {
+	pa, pb := splitPath(a), splitPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] == pb[i] {
+			continue
+		}
+		ia, errA := strconv.Atoi(pa[i])
+		ib, errB := strconv.Atoi(pb[i])
+		if errA == nil && errB == nil {
+			return ia - ib
+		}
+		return strings.Compare(pa[i], pb[i])
+	}
+	return len(pa) - len(pb)
+}
+
+// normalizeState round-trips state through BSON so a freshly built state compares equal to one read back
+// from audit storage. Nested documents become maps and arrays become slices.
+func normalizeState(state map[string]interface{}) (map[string]interface{}, error) {
+	data, err := bson.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return normalizeValue(doc).(map[string]interface{}), nil
+}
+
+// normalizeValue converts the document and array types of the BSON decoder to plain maps and slices
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(val))
+		for _, e := range val {
+			m[e.Key] = normalizeValue(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]interface{}, len(val))
+		for key, value := range val {
+			m[key] = normalizeValue(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for key, value := range val {
+			m[key] = normalizeValue(value)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(val))
+		for i, value := range val {
+			a[i] = normalizeValue(value)
+		}
+		return a
+	case []interface{}:
+		a := make([]interface{}, len(val))
+		for i, value := range val {
+			a[i] = normalizeValue(value)
+		}
+		return a
+	}
+	return v
+}
+
+// unionKeys returns the keys of both maps, sorted
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
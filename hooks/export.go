@@ -0,0 +1,126 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"sort"
+)
+
+// exportBatch is the number of audit entries read at a time by Export
+const exportBatch = 1000
+
+// Export writes every audit entry to w as a line of JSON, ordered by document and version. Entries are
+// written in the canonical form their hash is computed over, so VerifyExport can check them without
+// access to the database.
+func (h *History) Export(ctx context.Context, w io.Writer) error {
+	db, err := auditStore(h.db)
+	if err != nil {
+		return err
+	}
+	order := bson.D{{Key: "audit_meta_id", Value: 1}, {Key: "audit_version", Value: 1}, {Key: "audit_created_at", Value: 1}, {Key: "_id", Value: 1}}
+	for skip := int64(0); ; skip += exportBatch {
+		var logs []in.AuditLog
+		if err = db.List(ctx, "audit_logs", bson.M{}, skip, exportBatch, &logs, order); err != nil {
+			return fmt.Errorf("could not list audit logs: %w", err)
+		}
+		for _, entry := range logs {
+			line, err := canonicalAuditLog(entry)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+		}
+		if len(logs) < exportBatch {
+			return nil
+		}
+	}
+}
+
+// VerifyExport checks audit entries written by Export like Verify does, and their signatures when keys
+// is set. Entries removed from the end of a chain can not be detected without the meta kept in the database.
+func VerifyExport(r io.Reader, keys *KeySet) ([]ChainIssue, error) {
+	dec := json.NewDecoder(r)
+	// Numbers are kept as written so that they encode to the same canonical form
+	dec.UseNumber()
+	type exported struct {
+		entry in.AuditLog
+		hash  string
+	}
+	chains := make(map[string][]exported)
+	var metaIds []string
+	for {
+		var doc map[string]interface{}
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("could not read audit log export: %w", err)
+		}
+		entry, err := exportedAuditLog(doc)
+		if err != nil {
+			return nil, err
+		}
+		delete(doc, "audit_hash")
+		delete(doc, "audit_signature")
+		canonical, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := chains[entry.AuditMetaId]; !ok {
+			metaIds = append(metaIds, entry.AuditMetaId)
+		}
+		chains[entry.AuditMetaId] = append(chains[entry.AuditMetaId], exported{entry: entry, hash: hashCanonical(canonical)})
+	}
+
+	var issues []ChainIssue
+	for _, metaId := range metaIds {
+		chain := chains[metaId]
+		sort.SliceStable(chain, func(i, j int) bool {
+			return chain[i].entry.AuditVersion < chain[j].entry.AuditVersion
+		})
+		logs, hashes := make([]in.AuditLog, len(chain)), make([]string, len(chain))
+		for i, e := range chain {
+			logs[i], hashes[i] = e.entry, e.hash
+		}
+		found, _, _ := checkChain(metaId, "", logs, hashes, keys)
+		issues = append(issues, found...)
+	}
+	return issues, nil
+}
+
+// exportedAuditLog reads the fields of an exported entry the chain is checked with
+func exportedAuditLog(doc map[string]interface{}) (in.AuditLog, error) {
+	str := func(key string) string {
+		s, _ := doc[key].(string)
+		return s
+	}
+	var entry in.AuditLog
+	if id := str("_id"); id != "" {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return entry, fmt.Errorf("malformed audit log id %q: %w", id, err)
+		}
+		entry.Id = oid
+	}
+	if n, ok := doc["audit_version"].(json.Number); ok {
+		version, err := n.Int64()
+		if err != nil {
+			return entry, fmt.Errorf("malformed audit log version %q: %w", n, err)
+		}
+		entry.AuditVersion = version
+	}
+	entry.AuditMetaId = str("audit_meta_id")
+	entry.AuditPrevHash = str("audit_prev_hash")
+	entry.AuditHash = str("audit_hash")
+	entry.AuditKeyId = str("audit_key_id")
+	entry.AuditSignature = str("audit_signature")
+	return entry, nil
+}
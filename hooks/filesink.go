@@ -0,0 +1,175 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the timestamp suffix of rotated files, it sorts by age
+const backupLayout = "20060102T150405.000000000"
+
+// FileSink appends audit entries to a file as lines of JSON, in the canonical form read by VerifyExport.
+// When the file grows past its maximum size it is renamed with a timestamp suffix and a new one is started.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// FileSinkOption configures a FileSink
+type FileSinkOption func(*FileSink)
+
+// WithMaxSize rotates the file before it grows past bytes, 0 never rotates
+func WithMaxSize(bytes int64) FileSinkOption {
+	return func(s *FileSink) {
+		s.maxSize = bytes
+	}
+}
+
+// WithMaxBackups keeps at most n rotated files, removing the oldest. 0 keeps them all.
+func WithMaxBackups(n int) FileSinkOption {
+	return func(s *FileSink) {
+		s.maxBackups = n
+	}
+}
+
+// NewFileSink opens the file at path for appending, creating it when needed
+func NewFileSink(path string, opts ...FileSinkOption) (*FileSink, error) {
+	s := &FileSink{path: path}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	for _, log := range logs {
+		line, err := canonicalAuditLog(log)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+			if err = s.rotate(); err != nil {
+				if s.f == nil {
+					return err
+				}
+				// The entry is still written, to the file that could not be rotated
+				slog.Default().Error("could not rotate audit file", "path", s.path, "error", err)
+			}
+		}
+		n, err := s.f.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the file, later writes fail
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// rotate renames the current file and starts a new one. When the file cannot be renamed it is reopened to
+// keep appending to it, only a failure to reopen leaves the sink closed.
+func (s *FileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err == nil {
+		err = os.Rename(s.path, fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format(backupLayout)))
+	}
+	if reopened := s.open(); reopened != nil {
+		return errors.Join(err, reopened)
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.pruneBackups(); err != nil {
+		// The rotation is done, old files are removed on the next one
+		slog.Default().Error("could not remove rotated audit files", "path", s.path, "error", err)
+	}
+	return nil
+}
+
+// backups returns the rotated files of the sink, oldest first. The directory is listed rather than globbed,
+// as the path may hold pattern characters.
+func (s *FileSink) backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(s.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err = time.Parse(backupLayout, strings.TrimPrefix(name, prefix)); err == nil {
+			backups = append(backups, filepath.Join(filepath.Dir(s.path), name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// pruneBackups removes the oldest rotated files beyond maxBackups
+func (s *FileSink) pruneBackups() error {
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.maxBackups {
+		if err = os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
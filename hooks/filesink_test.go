@@ -0,0 +1,112 @@
+package hooks
+
+import (
+	"context"
+	in "github.com/DeimosTech/hookie/instance"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileLines returns the lines of the file at path
+func fileLines(t *testing.T, path string) []string {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+func TestFileSinkRotate(t *testing.T) {
+	ctx := context.Background()
+	entry := in.AuditLog{AuditEvent: "update", UserID: "u1"}
+	line, err := canonicalAuditLog(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each file holds two entries
+	maxSize := int64(2 * (len(line) + 1))
+
+	tests := []struct {
+		name    string
+		file    string // name of the sink file, audit.log when empty
+		between func(t *testing.T, path string)
+		kept    string // file next to the sink that must not be removed
+	}{
+		{
+			name:    "oldest backups are removed",
+			between: func(t *testing.T, path string) {},
+		},
+		{
+			name: "unrelated files are kept",
+			between: func(t *testing.T, path string) {
+				if err := os.WriteFile(path+".bak", nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kept: "audit.log.bak",
+		},
+		{
+			name: "pattern characters in the path",
+			file: "audit[1]*?.log",
+			between: func(t *testing.T, path string) {
+				// A backup of another sink, which the path would match as a pattern
+				other := filepath.Join(filepath.Dir(path), "audit1xy.log."+time.Now().UTC().Format(backupLayout))
+				if err := os.WriteFile(other, nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kept: "audit1xy.log.",
+		},
+		{
+			name: "file removed before rotating",
+			between: func(t *testing.T, path string) {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.file == "" {
+				tt.file = "audit.log"
+			}
+			path := filepath.Join(t.TempDir(), tt.file)
+			sink, err := NewFileSink(path, WithMaxSize(maxSize), WithMaxBackups(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			if err = sink.Write(ctx, []in.AuditLog{entry, entry}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			tt.between(t, path)
+			for i := 0; i < 4; i++ {
+				if err = sink.Write(ctx, []in.AuditLog{entry, entry}); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+
+			if lines := fileLines(t, path); len(lines) != 2 || lines[0] != string(line) {
+				t.Errorf("current file = %q, want two entries", lines)
+			}
+			backups, err := sink.backups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != 2 {
+				t.Errorf("got backups %v, want 2", backups)
+			}
+			if tt.kept != "" {
+				kept, err := filepath.Glob(filepath.Join(filepath.Dir(path), tt.kept+"*"))
+				if err != nil || len(kept) != 1 {
+					t.Errorf("unrelated file %s was removed: %v", tt.kept, err)
+				}
+			}
+		})
+	}
+}
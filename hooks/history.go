@@ -0,0 +1,177 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+// Version is a document as it was after one of its audit entries
+type Version struct {
+	Number int64  // 1 for the first entry of the document
+	Event  string // insert, update, revert or delete
+	At     time.Time
+	Log    in.AuditLog
+	State  map[string]interface{} // nil once the document has been deleted
+}
+
+// History reads the versions of audited documents from the audit collections
+type History struct {
+	db   hookiedb.NoSql
+	keys *KeySet
+}
+
+// NewHistory returns a history reading from store, or from the connection set up by mongo.InitMongo
+// when store is nil
+func NewHistory(store hookiedb.NoSql) *History {
+	return &History{db: store}
+}
+
+// WithKeys makes Verify and VerifyDocument check the signature of every entry against keys
+func (h *History) WithKeys(keys *KeySet) *History {
+	h.keys = keys
+	return h
+}
+
+// Versions returns every version of the document docId, oldest first. It returns db.ErrNotFound when
+// the document has no audit history.
+func (h *History) Versions(ctx context.Context, docId string) ([]Version, error) {
+	db, err := auditStore(h.db)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := findAuditLogMeta(ctx, db, docId)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := auditLogs(ctx, db, meta.Id)
+	if err != nil {
+		return nil, err
+	}
+	return buildVersions(meta, logs), nil
+}
+
+// AtVersion returns the state of the document docId at version number. It returns db.ErrNotFound when
+// there is no such version or the document was deleted by it.
+func (h *History) AtVersion(ctx context.Context, docId string, number int64) (map[string]interface{}, error) {
+	versions, err := h.Versions(ctx, docId)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Number == number {
+			return stateOf(v)
+		}
+	}
+	return nil, fmt.Errorf("version %d of %s: %w", number, docId, hookiedb.ErrNotFound)
+}
+
+// At returns the state of the document docId at t, which is the state of its last version created at
+// or before t. It returns db.ErrNotFound when the document did not exist at t.
+func (h *History) At(ctx context.Context, docId string, t time.Time) (map[string]interface{}, error) {
+	versions, err := h.Versions(ctx, docId)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].At.After(t)
+	})
+	if i == 0 {
+		return nil, fmt.Errorf("%s at %s: %w", docId, t.Format(time.RFC3339), hookiedb.ErrNotFound)
+	}
+	return stateOf(versions[i-1])
+}
+
+func stateOf(v Version) (map[string]interface{}, error) {
+	if v.State == nil {
+		return nil, fmt.Errorf("version %d was a %s: %w", v.Number, v.Event, hookiedb.ErrNotFound)
+	}
+	return v.State, nil
+}
+
+// auditLogs returns the audit entries recorded under the meta metaId, oldest first
+func auditLogs(ctx context.Context, db hookiedb.NoSql, metaId primitive.ObjectID) ([]in.AuditLog, error) {
+	var logs []in.AuditLog
+	order := bson.D{{Key: "audit_version", Value: 1}, {Key: "audit_created_at", Value: 1}, {Key: "_id", Value: 1}}
+	if err := db.List(ctx, "audit_logs", bson.M{"audit_meta_id": metaId.Hex()}, 0, 0, &logs, order); err != nil {
+		return nil, fmt.Errorf("could not list audit logs: %w", err)
+	}
+	for i := range logs {
+		for j, change := range logs[i].Change {
+			logs[i].Change[j].Old, logs[i].Change[j].New = normalizeValue(change.Old), normalizeValue(change.New)
+		}
+	}
+	return logs, nil
+}
+
+// buildVersions rebuilds the state after each of logs by undoing their changes one by one, starting from
+// the current state kept in meta
+func buildVersions(meta *in.AuditLogMeta, logs []in.AuditLog) []Version {
+	versions := make([]Version, len(logs))
+	var state map[string]interface{}
+	if len(logs) == 0 || logs[len(logs)-1].AuditEvent != "delete" {
+		state = copyState(meta.DocumentCurrentState)
+	}
+	for i := len(logs) - 1; i >= 0; i-- {
+		log := logs[i]
+		v := Version{Number: log.AuditVersion, Event: log.AuditEvent, Log: log, State: copyState(state)}
+		if log.AuditEvent == "delete" {
+			// A document inserted again after its delete continues the same chain
+			v.State = nil
+		}
+		if v.Number == 0 {
+			// Entries written before versioning are numbered by position
+			v.Number = int64(i + 1)
+		}
+		if log.AuditCreatedAt != nil {
+			v.At = *log.AuditCreatedAt
+		}
+		versions[i] = v
+		if state == nil {
+			state = map[string]interface{}{"_id": meta.DocumentCurrentState["_id"]}
+		}
+		undoChanges(state, log.Change)
+	}
+	return versions
+}
+
+// undoChanges reverts changes on state. Array elements are restored in ascending and removed in
+// descending index order so that the indexes recorded in changes stay valid.
+func undoChanges(state map[string]interface{}, changes []in.AuditChange) {
+	var restored, removed []in.AuditChange
+	for _, change := range changes {
+		switch change.Type {
+		case in.ChangeModified:
+			setValueAt(state, change.Path, normalizeValue(change.Old))
+		case in.ChangeRemoved:
+			restored = append(restored, change)
+		case in.ChangeAdded:
+			removed = append(removed, change)
+		}
+	}
+	sort.Slice(restored, func(i, j int) bool {
+		return comparePaths(restored[i].Path, restored[j].Path) < 0
+	})
+	sort.Slice(removed, func(i, j int) bool {
+		return comparePaths(removed[i].Path, removed[j].Path) > 0
+	})
+	for _, change := range restored {
+		insertValueAt(state, change.Path, normalizeValue(change.Old))
+	}
+	for _, change := range removed {
+		removeValueAt(state, change.Path)
+	}
+}
+
+// copyState returns a deep copy of state, nil when state is nil
+func copyState(state map[string]interface{}) map[string]interface{} {
+	if state == nil {
+		return nil
+	}
+	return normalizeValue(state).(map[string]interface{})
+}
@@ -0,0 +1,134 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	"github.com/DeimosTech/hookie/db/memory"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSharedStore returns a store auditing the model registered with cfg into its own audit collections,
+// the way a single connection is used by History and Revert
+func newSharedStore(t *testing.T, cfg in.ModelConfig) *memory.Memory {
+	t.Helper()
+	if err := registry.RegisterType(cfg); err != nil {
+		t.Fatal(err)
+	}
+	store := memory.New()
+	store.Hooks().Use(NewDefaultHookWithStore(store))
+	return store
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	const col = "history_accounts"
+	store := newSharedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col})
+	doc := account{Id: primitive.NewObjectID(), Name: "a", Count: 1}
+	before := time.Now()
+	// Audit entries are stored with millisecond precision
+	time.Sleep(2 * time.Millisecond)
+	if err := store.Insert(ctx, col, doc); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	doc.Name = "b"
+	if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	doc.Count = 7
+	if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	updated := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if err := store.DeleteOne(ctx, col, bson.M{"_id": doc.Id}); err != nil {
+		t.Fatalf("DeleteOne: %v", err)
+	}
+
+	history := NewHistory(store)
+	versions, err := history.Versions(ctx, doc.Id.Hex())
+	if err != nil {
+		t.Fatalf("Versions: %v", err)
+	}
+	var events []string
+	for _, v := range versions {
+		events = append(events, v.Event)
+	}
+	if want := []string{"insert", "update", "update", "delete"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("Versions() events = %v, want %v", events, want)
+	}
+
+	tests := []struct {
+		name      string
+		state     func() (map[string]interface{}, error)
+		wantName  string
+		wantCount int32
+		notFound  bool
+	}{
+		{
+			name:      "first version",
+			state:     func() (map[string]interface{}, error) { return history.AtVersion(ctx, doc.Id.Hex(), 1) },
+			wantName:  "a",
+			wantCount: 1,
+		},
+		{
+			name:      "version between updates",
+			state:     func() (map[string]interface{}, error) { return history.AtVersion(ctx, doc.Id.Hex(), 2) },
+			wantName:  "b",
+			wantCount: 1,
+		},
+		{
+			name:     "deleting version",
+			state:    func() (map[string]interface{}, error) { return history.AtVersion(ctx, doc.Id.Hex(), 4) },
+			notFound: true,
+		},
+		{
+			name:     "missing version",
+			state:    func() (map[string]interface{}, error) { return history.AtVersion(ctx, doc.Id.Hex(), 9) },
+			notFound: true,
+		},
+		{
+			name:     "before the insert",
+			state:    func() (map[string]interface{}, error) { return history.At(ctx, doc.Id.Hex(), before) },
+			notFound: true,
+		},
+		{
+			name:      "after the updates",
+			state:     func() (map[string]interface{}, error) { return history.At(ctx, doc.Id.Hex(), updated) },
+			wantName:  "b",
+			wantCount: 7,
+		},
+		{
+			name:     "after the delete",
+			state:    func() (map[string]interface{}, error) { return history.At(ctx, doc.Id.Hex(), time.Now()) },
+			notFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := tt.state()
+			if tt.notFound {
+				if !errors.Is(err, hookiedb.ErrNotFound) {
+					t.Fatalf("got %v, %v, want db.ErrNotFound", state, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state["name"] != tt.wantName || state["count"] != tt.wantCount {
+				t.Errorf("state = %v, want name %s and count %d", state, tt.wantName, tt.wantCount)
+			}
+		})
+	}
+
+	if _, err = history.Versions(ctx, primitive.NewObjectID().Hex()); !errors.Is(err, hookiedb.ErrNotFound) {
+		t.Errorf("Versions of an unaudited document returned %v, want db.ErrNotFound", err)
+	}
+}
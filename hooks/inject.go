@@ -2,108 +2,432 @@ package hooks
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
 	"github.com/DeimosTech/hookie/db/mongo"
 	in "github.com/DeimosTech/hookie/instance"
-	"github.com/DeimosTech/hookie/internal/hook"
+	"github.com/DeimosTech/hookie/internal/registry"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"log/slog"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
 
+// redacted replaces the value of redacted fields in audit storage
+const redacted = "[REDACTED]"
+
+// errNoStore is returned when audit storage is needed before mongo.InitMongo was called
+var errNoStore = errors.New("hooks: no audit store, call mongo.InitMongo or use NewDefaultHookWithStore")
+
 type DefaultHooks struct {
-	l *slog.Logger
+	l      *slog.Logger
+	db     hookiedb.NoSql
+	mu     sync.RWMutex
+	signer Signer
+	sink   AuditSink
+	reads  accessDedup
+
+	metaIndex sync.Once
 }
 
 func NewDefaultHook() *DefaultHooks {
 	return &DefaultHooks{l: slog.Default()}
 }
 
-func (h *DefaultHooks) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) {
-	// Trigger PreSave hook if defined by user, else run default
-	if hasPreSaveHook(model) {
-		model.(in.Hook).PreSave(ctx, model, filter, col, ops, docId)
-		return
+// NewDefaultHookWithStore returns hooks writing audit logs to store instead of the connection set up
+// by mongo.InitMongo
+func NewDefaultHookWithStore(store hookiedb.NoSql) *DefaultHooks {
+	return &DefaultHooks{l: slog.Default(), db: store}
+}
+
+// SignWith signs every audit entry written from now on with signer. Calling it again rotates the key,
+// entries record the id of the key they were signed with.
+func (h *DefaultHooks) SignWith(signer Signer) *DefaultHooks {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.signer = signer
+	return h
+}
+
+func (h *DefaultHooks) currentSigner() Signer {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.signer
+}
+
+// WithSinks writes audit entries to every one of sinks instead of the audit_logs collection. The state
+// audit entries are computed from is still kept in the audit_logs_meta collection of the store. Include a
+// MongoSink to keep the entries available to History.
+func (h *DefaultHooks) WithSinks(sinks ...AuditSink) *DefaultHooks {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(sinks) == 1 {
+		h.sink = sinks[0]
+	} else {
+		h.sink = FanOut(sinks...)
 	}
-	h.l.Info("default PreSave hook triggered")
+	return h
 }
 
-func (h *DefaultHooks) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) {
-	if hasPostSaveHook(model) {
-		model.(in.Hook).PostSave(ctx, model, filter, col, ops, docId)
-		return
+// writeAuditLog hands entry to the configured sinks, or writes it to the audit_logs collection of db
+func (h *DefaultHooks) writeAuditLog(ctx context.Context, db hookiedb.NoSql, entry in.AuditLog) error {
+	h.mu.RLock()
+	sink := h.sink
+	h.mu.RUnlock()
+	if sink == nil {
+		sink = NewMongoSink(db)
 	}
-	if isAuditLogEnabled(model) {
-		db := mongo.GetDbConnection()
-		if ops == "insert" {
-			state, err := structToMap(model)
-			if err != nil {
-				h.l.Error(err.Error())
-				return
-			}
+	if err := sink.Write(ctx, []in.AuditLog{entry}); err != nil {
+		return fmt.Errorf("could not save audit log: %w", err)
+	}
+	return nil
+}
 
-			auditLogMeta := in.AuditLogMeta{
-				Id:                   primitive.NewObjectID(),
-				DocumentCurrentState: state,
-			}
-			_, err = db.Database.Collection("audit_logs_meta").InsertOne(context.Background(), auditLogMeta)
-			if err != nil {
-				db.Logger.Error(err.Error())
-				return
-			}
+// commitAuditLog chains entry to meta by storing state as the meta of the document, then writes entry.
+// Until the entry is written the meta is pending, so no other entry is chained to it, and it is rolled
+// back when the entry cannot be written.
+func (h *DefaultHooks) commitAuditLog(ctx context.Context, db hookiedb.NoSql, meta *in.AuditLogMeta, state in.AuditLogMeta, entry in.AuditLog) error {
+	state.Pending = primitive.NewDateTimeFromTime(time.Now())
+	if err := advanceMeta(ctx, db, meta, state); err != nil {
+		return err
+	}
+	if err := h.writeAuditLog(ctx, db, entry); err != nil {
+		return errors.Join(err, rollbackMeta(ctx, db, meta, state.Version))
+	}
+	return settleMeta(ctx, db, meta.Id, state.Version)
+}
 
-		} else if ops == "update" {
-			auditFilter := bson.D{{"document_current_state._id", docId}}
-			findOneOpts := options.FindOne()
-			var auditLogMeta in.AuditLogMeta
-			err := db.Database.Collection("audit_logs_meta").FindOne(ctx, auditFilter, findOneOpts).Decode(&auditLogMeta)
-			if err != nil {
-				h.l.Error(err.Error())
-				return
+func (h *DefaultHooks) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	// Trigger PreSave hook if defined by user, else run default
+	if hook, ok := model.(in.PreSaveHook); ok {
+		return hook.PreSave(ctx, model, filter, col, ops, docId)
+	}
+	h.l.Info("default PreSave hook triggered")
+	return nil
+}
+
+func (h *DefaultHooks) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	if hook, ok := model.(in.PostSaveHook); ok {
+		return hook.PostSave(ctx, model, filter, col, ops, docId)
+	}
+	cfg, enabled := auditConfig(model, col)
+	if enabled || (ops == "update" && isMapModel(model)) {
+		db, err := h.store()
+		if err != nil {
+			return err
+		}
+		// Audit writes must not run the hooks again
+		auditCtx := hookiedb.WithoutHooks(ctx)
+		rules := modelRules(model, cfg)
+		if ops == "insert" && hookiedb.IsRedelivery(ctx) {
+			// A replayed insert may have been audited already, its entry is then diffed like an update
+			if _, err := findAuditLogMeta(auditCtx, db, docId); err == nil {
+				ops = "update"
+			} else if !errors.Is(err, hookiedb.ErrNotFound) {
+				return fmt.Errorf("could not find audit log meta: %w", err)
 			}
-			newDoc, err := structToMap(model)
-			if err != nil {
-				h.l.Error(err.Error())
-				return
+		}
+		if ops == "insert" {
+			err = h.auditInsert(ctx, db, model, cfg, rules, col, docId)
+			if isDuplicateKey(err) {
+				// The document was audited first by another writer, such as a ChangeWatcher, the insert is
+				// then diffed against that entry like an update
+				ops = "update"
+			} else if err != nil {
+				return err
 			}
-			currentTime := time.Now()
-			changeLog := compareDocumentStates(auditLogMeta.DocumentCurrentState, newDoc)
-			_, err = db.Database.Collection("audit_logs").InsertOne(context.Background(), in.AuditLog{
-				Id:             primitive.NewObjectID(),
-				AuditURL:       "example.com",
-				AuditIPAddress: ctx.Value("ip_addr").(string),
-				AuditUserAgent: ctx.Value("user_agent").(string),
-				AuditTags:      []string{"audit", "log"},
-				AuditCreatedAt: &currentTime,
-				UserID:         ctx.Value("user_id").(string),
-				UserType:       "unknown",
-				Change:         changeLog,
+		}
+		if ops == "update" {
+			// The meta only advances from the version it was read at, a concurrent write to the same
+			// document makes the update be diffed again against the state that write left
+			err = retryStaleMeta(func() error {
+				return h.auditUpdate(ctx, db, model, cfg, rules, col, docId)
 			})
 			if err != nil {
-				h.l.Error(err.Error())
-				return
-			}
-			update := bson.M{
-				"$set": in.AuditLogMeta{DocumentCurrentState: auditLogMeta.DocumentCurrentState},
-			}
-			_, err = db.Database.Collection("audit_logs_meta").UpdateByID(context.Background(), auditLogMeta.Id, update)
-			if err != nil {
-				h.l.Error(err.Error())
-				return
+				return err
 			}
 		}
 	}
 	h.l.Info("default PostSave hook triggered")
+	return nil
+}
+
+// auditInsert records the "insert" audit entry of the document docId of col, saved from model, along with
+// the meta its later entries are chained to
+func (h *DefaultHooks) auditInsert(ctx context.Context, db hookiedb.NoSql, model interface{}, cfg *in.ModelConfig, rules *auditRules, col, docId string) error {
+	auditCtx := hookiedb.WithoutHooks(ctx)
+	salt, err := newDigestSalt()
+	if err != nil {
+		return err
+	}
+	state, digests, err := snapshot(model, cfg, rules, salt)
+	if err != nil {
+		return err
+	}
+	keyState(state, docId)
+	auditLogMeta := in.AuditLogMeta{
+		Id:                   primitive.NewObjectID(),
+		DocumentCurrentState: state,
+		Digests:              digests,
+		DigestSalt:           salt,
+	}
+	// The first version of the document, which its history is rebuilt from
+	changeLog, _ := compareDocumentStates(map[string]interface{}{}, state, false, rules)
+	auditLog := newAuditLog(ctx, "insert", auditLogMeta.Id, 1, changeLog)
+	auditLog.DocVersion = docVersion(ctx, col, state)
+	if err = chainAuditLog(&auditLog, &auditLogMeta, h.currentSigner()); err != nil {
+		return err
+	}
+	auditLogMeta.Version, auditLogMeta.LastHash = auditLog.AuditVersion, auditLog.AuditHash
+	h.ensureMetaIndex(auditCtx, db)
+	if err = db.Insert(auditCtx, "audit_logs_meta", auditLogMeta); err != nil {
+		if isDuplicateKey(err) {
+			return err
+		}
+		return fmt.Errorf("could not save audit log meta: %w", err)
+	}
+	return h.writeAuditLog(auditCtx, db, auditLog)
+}
+
+// keyState sets the _id of state to docId. Metas are found by the id the hooks are given, which is a
+// string whatever the type of the _id of the document.
+func keyState(state map[string]interface{}, docId string) {
+	if docId != "" {
+		state["_id"] = docId
+	}
+}
+
+// ensureMetaIndex makes the metas of db unique per document, so writers auditing the insert of a
+// document at the same time do not fork its history. It is tried once per DefaultHooks.
+func (h *DefaultHooks) ensureMetaIndex(ctx context.Context, db hookiedb.NoSql) {
+	h.metaIndex.Do(func() {
+		unique := true
+		index := hookiedb.Index{
+			Name:   "document_id",
+			Keys:   []hookiedb.IndexKey{{Key: "document_current_state._id", Asc: 1}},
+			Unique: &unique,
+		}
+		if err := db.EnsureIndices(ctx, "audit_logs_meta", []hookiedb.Index{index}); err != nil {
+			h.l.Error("hookie: could not make audit log metas unique per document", "error", err)
+		}
+	})
+}
+
+// auditUpdate records the "update" audit entry of the document docId of col, saved from model
+func (h *DefaultHooks) auditUpdate(ctx context.Context, db hookiedb.NoSql, model interface{}, cfg *in.ModelConfig, rules *auditRules, col, docId string) error {
+	auditCtx := hookiedb.WithoutHooks(ctx)
+	auditLogMeta, err := findAuditLogMeta(auditCtx, db, docId)
+	if err != nil {
+		// Documents and update payloads are only audited when they have audit history
+		if errors.Is(err, hookiedb.ErrNotFound) && isMapModel(model) {
+			return nil
+		}
+		return fmt.Errorf("could not find audit log meta: %w", err)
+	}
+	if err = checkSettled(auditLogMeta); err != nil {
+		return err
+	}
+	salt, oldDigests := auditLogMeta.DigestSalt, auditLogMeta.Digests
+	if salt == "" {
+		// The digests of metas written before they were salted cannot be compared and are dropped
+		if salt, err = newDigestSalt(); err != nil {
+			return err
+		}
+		oldDigests = nil
+	}
+	newDoc, digests, err := snapshot(model, cfg, rules, salt)
+	if err != nil {
+		return err
+	}
+	keyState(newDoc, docId)
+	if field := hookiedb.VersionField(col); field != "" {
+		// The version carried by the model is the one the update checked, not the one it stored
+		if version, ok := hookiedb.DocumentVersion(ctx); ok && (cfg == nil || len(cfg.Fields) == 0 || hasField(cfg.Fields, field)) {
+			newDoc[field] = version
+		}
+	}
+	// Only stored documents are complete, other models carry just the fields being set
+	partial := !isStoredDocument(model)
+	event, oldDoc := hookiedb.AuditEvent(ctx, "update"), auditLogMeta.DocumentCurrentState
+	if auditLogMeta.Deleted && hookiedb.IsRedelivery(ctx) {
+		// A replayed write of a document whose delete was recorded since
+		return nil
+	}
+	if auditLogMeta.Deleted {
+		// A document inserted again after its delete continues the history of the deleted one
+		event, oldDoc, oldDigests, partial = "insert", map[string]interface{}{}, nil, false
+	}
+	changeLog, significant := compareDocumentStates(oldDoc, newDoc, partial, rules)
+	if protectedChanges(changeLog, oldDoc, newDoc, oldDigests, digests, rules) {
+		significant = true
+	}
+	if !significant {
+		// Track-only changes are left for the next audit entry, which diffs against the meta
+		return nil
+	}
+	version, err := nextVersion(auditCtx, db, auditLogMeta)
+	if err != nil {
+		return err
+	}
+	auditLog := newAuditLog(ctx, event, auditLogMeta.Id, version, changeLog)
+	auditLog.DocVersion = docVersion(ctx, col, newDoc)
+	if err = chainAuditLog(&auditLog, auditLogMeta, h.currentSigner()); err != nil {
+		return err
+	}
+	state := in.AuditLogMeta{
+		DocumentCurrentState: mergeStates(oldDoc, newDoc, partial),
+		Digests:              mergeDigests(oldDigests, digests, partial),
+		DigestSalt:           salt,
+		Version:              version,
+		LastHash:             auditLog.AuditHash,
+	}
+	return h.commitAuditLog(auditCtx, db, auditLogMeta, state, auditLog)
+}
+
+func (h *DefaultHooks) PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	h.l.Info("default PreDelete hook triggered")
+	return nil
+}
+
+// PostDelete records a "delete" audit entry for documents that have audit history
+func (h *DefaultHooks) PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	db, err := h.store()
+	if err != nil {
+		return err
+	}
+	err = retryStaleMeta(func() error {
+		return h.auditDelete(ctx, db, model, col, docId)
+	})
+	if err != nil {
+		return err
+	}
+	h.l.Info("default PostDelete hook triggered")
+	return nil
+}
+
+// auditDelete records the "delete" audit entry of the document docId of col
+func (h *DefaultHooks) auditDelete(ctx context.Context, db hookiedb.NoSql, model interface{}, col, docId string) error {
+	auditCtx := hookiedb.WithoutHooks(ctx)
+	auditLogMeta, err := findAuditLogMeta(auditCtx, db, docId)
+	if err != nil {
+		// Documents without meta were never audited
+		if errors.Is(err, hookiedb.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("could not find audit log meta: %w", err)
+	}
+	if err = checkSettled(auditLogMeta); err != nil {
+		return err
+	}
+	if auditLogMeta.Deleted && hookiedb.IsRedelivery(ctx) {
+		return nil
+	}
+	cfg, _ := auditConfig(model, col)
+	changeLog, _ := compareDocumentStates(auditLogMeta.DocumentCurrentState, map[string]interface{}{}, false, modelRules(model, cfg))
+	version, err := nextVersion(auditCtx, db, auditLogMeta)
+	if err != nil {
+		return err
+	}
+	auditLog := newAuditLog(ctx, "delete", auditLogMeta.Id, version, changeLog)
+	auditLog.DocVersion = docVersion(ctx, col, auditLogMeta.DocumentCurrentState)
+	if err = chainAuditLog(&auditLog, auditLogMeta, h.currentSigner()); err != nil {
+		return err
+	}
+	// The last state is kept so the history of the deleted document can still be rebuilt
+	state := in.AuditLogMeta{Version: version, LastHash: auditLog.AuditHash, Deleted: true}
+	return h.commitAuditLog(auditCtx, db, auditLogMeta, state, auditLog)
+}
+
+// store returns where audit logs are written
+func (h *DefaultHooks) store() (hookiedb.NoSql, error) {
+	return auditStore(h.db)
+}
+
+// auditStore returns store, or the connection set up by mongo.InitMongo when store is nil
+func auditStore(store hookiedb.NoSql) (hookiedb.NoSql, error) {
+	if store != nil {
+		return store, nil
+	}
+	if conn := mongo.GetDbConnection(); conn != nil {
+		return conn, nil
+	}
+	return nil, errNoStore
+}
+
+// findAuditLogMeta returns the last known state stored for docId
+func findAuditLogMeta(ctx context.Context, db hookiedb.NoSql, docId string) (*in.AuditLogMeta, error) {
+	var auditLogMeta in.AuditLogMeta
+	auditFilter := bson.D{{Key: "document_current_state._id", Value: docId}}
+	if err := db.FindOne(ctx, "audit_logs_meta", auditFilter, &auditLogMeta); err != nil {
+		return nil, err
+	}
+	if auditLogMeta.DocumentCurrentState != nil {
+		auditLogMeta.DocumentCurrentState = normalizeValue(auditLogMeta.DocumentCurrentState).(map[string]interface{})
+	}
+	return &auditLogMeta, nil
 }
 
-// isAuditLogEnabled Function to check if the model has audit logging enabled
-func isAuditLogEnabled(model interface{}) bool {
+// nextVersion returns the version of the next audit entry of the document described by meta. Documents
+// audited before entries were versioned count their existing entries.
+func nextVersion(ctx context.Context, db hookiedb.NoSql, meta *in.AuditLogMeta) (int64, error) {
+	if meta.Version > 0 {
+		return meta.Version + 1, nil
+	}
+	count, err := db.Count(ctx, "audit_logs", bson.M{"audit_meta_id": meta.Id.Hex()})
+	if err != nil {
+		return 0, fmt.Errorf("could not count audit logs: %w", err)
+	}
+	return count + 1, nil
+}
+
+// newAuditLog builds an audit entry for event using the actor and request details found in ctx
+func newAuditLog(ctx context.Context, event string, metaId primitive.ObjectID, version int64, changes map[string]in.AuditChange) in.AuditLog {
+	currentTime := time.Now()
+	actor, _ := in.ActorFrom(ctx)
+	info, _ := in.RequestInfoFrom(ctx)
+	return in.AuditLog{
+		Id:             primitive.NewObjectID(),
+		AuditMetaId:    metaId.Hex(),
+		AuditVersion:   version,
+		AuditEvent:     event,
+		AuditURL:       info.URL,
+		AuditIPAddress: info.IPAddress,
+		AuditUserAgent: info.UserAgent,
+		AuditRequestId: info.RequestID,
+		AuditTags:      []string{"audit", "log"},
+		AuditCreatedAt: &currentTime,
+		UserID:         actor.UserID,
+		UserType:       actor.UserType,
+		Change:         changeList(changes),
+	}
+}
+
+// docVersion returns the version of the versioned document of col described by state, the one the update
+// stored when ctx carries it
+func docVersion(ctx context.Context, col string, state map[string]interface{}) int64 {
+	field := hookiedb.VersionField(col)
+	if field == "" {
+		return 0
+	}
+	if version, ok := hookiedb.DocumentVersion(ctx); ok {
+		return version
+	}
+	version, _ := hookiedb.VersionOf(state[field])
+	return version
+}
+
+// auditConfig returns the audit settings of model and whether audit logging is enabled for it.
+// Stored documents use the settings of the model registered for col.
+func auditConfig(model interface{}, col string) (*in.ModelConfig, bool) {
+	if isMapModel(model) {
+		return registry.LookupCollection(col)
+	}
 	modelType := reflect.TypeOf(model)
 
 	// If the modelType is a pointer, get the underlying type
@@ -113,29 +437,73 @@ func isAuditLogEnabled(model interface{}) bool {
 
 	// Ensure it's a struct
 	if modelType.Kind() != reflect.Struct {
-		return false
+		return nil, false
 	}
 
-	// Get the type's name
-	typeName := modelType.Name()
+	// Models registered by type carry their own settings
+	if cfg, ok := registry.LookupType(modelType); ok {
+		return cfg, true
+	}
+	return &in.ModelConfig{Type: modelType}, registry.IsRegistered(modelType)
+}
 
-	// Get the package path using the types package
-	pkgPath := modelType.PkgPath()
-	return hook.AuditLogModels[pkgPath+typeName]
+// modelRules returns the field rules of model. Documents and update payloads follow the registered model.
+func modelRules(model interface{}, cfg *in.ModelConfig) *auditRules {
+	if cfg != nil && cfg.Type != nil {
+		return rulesOf(cfg.Type, cfg)
+	}
+	return rulesOf(reflect.TypeOf(model), cfg)
 }
 
-// hasPreSaveHook Check if the model has a PreSave method (custom user hook)
-func hasPreSaveHook(model interface{}) bool {
-	_, ok := reflect.TypeOf(model).MethodByName("PreSave")
-	return ok
+// snapshot converts model to the state kept in audit storage, honoring the fields of cfg and the ignored
+// and protected fields of rules. It also returns the digests of the redacted and masked values, keyed by
+// salt.
+func snapshot(model interface{}, cfg *in.ModelConfig, rules *auditRules, salt string) (map[string]interface{}, map[string]string, error) {
+	state, err := structToMap(model)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state, err = normalizeState(state); err != nil {
+		return nil, nil, err
+	}
+	if cfg != nil && len(cfg.Fields) > 0 {
+		for key := range state {
+			if key != "_id" && !hasField(cfg.Fields, key) {
+				delete(state, key)
+			}
+		}
+	}
+	rules.strip(state)
+	digests, err := protect(state, rules.protect, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return state, digests, nil
+}
+
+// hasField reports whether key, a field name or the dotted path of an update payload, is one of fields
+// or lies within one of them
+func hasField(fields []string, key string) bool {
+	for _, field := range fields {
+		if key == field || strings.HasPrefix(key, field+".") {
+			return true
+		}
+	}
+	return false
 }
 
-// hasPostSaveHook Check if the model has a PostSave method (custom user hook)
-func hasPostSaveHook(model interface{}) bool {
-	_, ok := reflect.TypeOf(model).MethodByName("PostSave")
+// isStoredDocument reports whether model is a complete document read back from the database
+func isStoredDocument(model interface{}) bool {
+	_, ok := model.(in.Document)
 	return ok
 }
 
+// isMapModel reports whether model is a document or an update payload keyed by field names
+func isMapModel(model interface{}) bool {
+	t := reflect.TypeOf(model)
+	return t != nil && t.Kind() == reflect.Map && t.Key().Kind() == reflect.String
+}
+
 // SaveAuditLog Function to save an audit log after saving the model
 func saveAuditLog(model interface{}) {
 	fmt.Printf("Audit log saved for model: %T\n", model)
@@ -143,8 +511,22 @@ func saveAuditLog(model interface{}) {
 
 func structToMap(obj interface{}) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
+
 	v := reflect.ValueOf(obj)
 
+	// Documents and update payloads are already keyed by their field names
+	if isMapModel(obj) {
+		iter := v.MapRange()
+		for iter.Next() {
+			key, value := iter.Key().String(), iter.Value().Interface()
+			if objectID, ok := value.(primitive.ObjectID); ok && key == "_id" {
+				value = objectID.Hex()
+			}
+			result[key] = value
+		}
+		return result, nil
+	}
+
 	// Check if the input is a pointer and get the element
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -159,36 +541,64 @@ func structToMap(obj interface{}) (map[string]interface{}, error) {
 	for i := 0; i < v.NumField(); i++ {
 		field := v.Type().Field(i)
 		value := v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
 
-		// Get the JSON and BSON tags
-		jsonTag := field.Tag.Get("json")
-		bsonTag := field.Tag.Get("bson")
-
-		// Check if the field should be omitted
-		if isOmitEmpty(value) {
-			continue // Skip adding this field if it's empty
+		name := fieldName(field)
+		if name == "-" {
+			continue
+		}
+		// Like the BSON encoder, only fields tagged omitempty are left out when empty. Other zero values
+		// are stored, and so are changes to them.
+		if hasOmitEmpty(field) && isOmitEmpty(value) {
+			continue
 		}
 
-		// Use JSON tag as the key if present; otherwise, fallback to BSON tag
-		if bsonTag != "" {
-			splitTag := strings.Split(bsonTag, ",")
-			if splitTag[0] == "_id" {
-				objectID := value.Interface().(primitive.ObjectID)
-				result[splitTag[0]] = objectID.Hex()
-				continue
-			}
-			result[splitTag[0]] = value.Interface()
-		} else if jsonTag != "" {
-			splitTag := strings.Split(jsonTag, ",")
-			result[splitTag[0]] = value.Interface()
-		} else {
-			result[convertToSnakeCase(field.Name)] = value.Interface()
+		if objectID, ok := value.Interface().(primitive.ObjectID); ok && name == "_id" {
+			result[name] = objectID.Hex()
+			continue
 		}
+		result[name] = value.Interface()
 	}
 
 	return result, nil
 }
 
+// fieldName returns the key structToMap stores field under: the name of its BSON tag, else of its JSON
+// tag, else its name in snake case
+func fieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("bson"), ",")[0]; name != "" {
+		return name
+	}
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return convertToSnakeCase(field.Name)
+}
+
+// bsonFieldName returns the key the BSON encoder stores field under
+func bsonFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("bson"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// hasOmitEmpty reports whether the tag field is named by has the omitempty option
+func hasOmitEmpty(field reflect.StructField) bool {
+	tag := field.Tag.Get("bson")
+	if tag == "" {
+		tag = field.Tag.Get("json")
+	}
+	for _, option := range strings.Split(tag, ",")[1:] {
+		if option == "omitempty" {
+			return true
+		}
+	}
+	return false
+}
+
 // isOmitEmpty checks if a value is considered "empty" according to the omitempty rule
 func isOmitEmpty(value reflect.Value) bool {
 	switch value.Kind() {
@@ -199,9 +609,9 @@ func isOmitEmpty(value reflect.Value) bool {
 	case reflect.Map:
 		return value.IsNil() || value.Len() == 0 // Nil or empty map is considered empty
 	default:
-		// For all other types, zero value is considered empty
-		zero := reflect.Zero(value.Type())
-		return value.Interface() == zero.Interface()
+		// For all other types, zero value is considered empty. IsZero also handles structs holding
+		// slices or maps, which can not be compared with ==.
+		return value.IsZero()
 	}
 }
 
@@ -224,22 +634,3 @@ func convertToSnakeCase(str string) string {
 	}
 	return snakeCase
 }
-
-func compareDocumentStates(oldDoc, newDoc map[string]interface{}) map[string]in.AuditChange {
-	changes := make(map[string]in.AuditChange)
-
-	for key, newVal := range newDoc {
-		if key == "_id" {
-			continue
-		}
-		oldVal, exists := oldDoc[key]
-		if !exists || oldVal != newVal {
-			changes[key] = in.AuditChange{
-				Old: fmt.Sprintf("%v", oldVal),
-				New: fmt.Sprintf("%v", newVal),
-			}
-		}
-	}
-
-	return changes
-}
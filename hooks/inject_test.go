@@ -0,0 +1,192 @@
+package hooks
+
+import (
+	"context"
+	"github.com/DeimosTech/hookie/db/memory"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+type address struct {
+	City  string   `bson:"city"`
+	Lines []string `bson:"lines"`
+}
+
+type account struct {
+	Id      primitive.ObjectID `bson:"_id"`
+	Name    string             `bson:"name"`
+	Count   int                `bson:"count"`
+	Note    string             `bson:"note,omitempty"`
+	Address address            `bson:"address"`
+}
+
+// newAuditedStore returns a store auditing the models registered for it to audit, with model registered
+// for col
+func newAuditedStore(t *testing.T, cfg in.ModelConfig) (*memory.Memory, *memory.Memory) {
+	t.Helper()
+	audit := memory.New()
+	if err := registry.RegisterType(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return memory.New(NewDefaultHookWithStore(audit)), audit
+}
+
+// auditEntries returns the audit entries of docId, oldest first
+func auditEntries(t *testing.T, audit *memory.Memory, docId string) []in.AuditLog {
+	t.Helper()
+	ctx := context.Background()
+	meta, err := findAuditLogMeta(ctx, audit, docId)
+	if err != nil {
+		t.Fatalf("no audit meta for %s: %v", docId, err)
+	}
+	logs, err := auditLogs(ctx, audit, meta.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logs
+}
+
+func TestStructToMap(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name  string
+		model interface{}
+		want  map[string]interface{}
+	}{
+		{
+			name:  "zero values without omitempty are kept",
+			model: account{Id: id},
+			want:  map[string]interface{}{"_id": id.Hex(), "name": "", "count": 0, "address": address{}},
+		},
+		{
+			name:  "omitempty fields are left out when empty",
+			model: &account{Id: id, Note: "n", Address: address{City: "Oslo", Lines: []string{"a"}}},
+			want: map[string]interface{}{"_id": id.Hex(), "name": "", "count": 0, "note": "n",
+				"address": address{City: "Oslo", Lines: []string{"a"}}},
+		},
+		{
+			name: "unexported and skipped fields are left out",
+			model: struct {
+				Name    string `bson:"name"`
+				Skipped string `bson:"-"`
+				hidden  string
+			}{Name: "a", Skipped: "b", hidden: "c"},
+			want: map[string]interface{}{"name": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := structToMap(tt.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("structToMap() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsOmitEmpty(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  bool
+	}{
+		{"zero struct with a slice", address{}, true},
+		{"struct with a slice", address{City: "Oslo"}, false},
+		{"zero int", 0, true},
+		{"empty slice", []string{}, true},
+		{"nil pointer", (*address)(nil), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOmitEmpty(reflect.ValueOf(tt.value)); got != tt.want {
+				t.Errorf("isOmitEmpty(%#v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostSaveAuditsNestedAndZeroValues(t *testing.T) {
+	ctx := context.Background()
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: "inject_accounts"})
+	doc := account{Id: primitive.NewObjectID(), Name: "a", Count: 5, Address: address{City: "Oslo", Lines: []string{"1 Main St"}}}
+	if err := store.Insert(ctx, "inject_accounts", doc); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	doc.Count = 0
+	doc.Address.City = "Bergen"
+	if err := store.Update(ctx, "inject_accounts", bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	logs := auditEntries(t, audit, doc.Id.Hex())
+	if len(logs) != 2 {
+		t.Fatalf("got %d audit entries, want 2", len(logs))
+	}
+	want := map[string]in.AuditChange{
+		"count":        {Path: "count", Type: in.ChangeModified, Old: int32(5), New: int32(0)},
+		"address.city": {Path: "address.city", Type: in.ChangeModified, Old: "Oslo", New: "Bergen"},
+	}
+	got := make(map[string]in.AuditChange)
+	for _, change := range logs[1].Change {
+		got[change.Path] = change
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("update changes = %#v, want %#v", got, want)
+	}
+}
+
+func TestPostSaveOtherIdTypes(t *testing.T) {
+	ctx := context.Background()
+	type numbered struct {
+		Id   int    `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	type named struct {
+		Id   string `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	tests := []struct {
+		name  string
+		docId string
+		cfg   in.ModelConfig
+		doc   func(name string) interface{}
+	}{
+		{
+			name:  "int",
+			docId: "7",
+			cfg:   in.ModelConfig{Type: reflect.TypeOf(numbered{}), Collection: "inject_numbered"},
+			doc:   func(name string) interface{} { return numbered{Id: 7, Name: name} },
+		},
+		{
+			name:  "string",
+			docId: "key",
+			cfg:   in.ModelConfig{Type: reflect.TypeOf(named{}), Collection: "inject_named"},
+			doc:   func(name string) interface{} { return named{Id: "key", Name: name} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, audit := newAuditedStore(t, tt.cfg)
+			if err := store.Insert(ctx, tt.cfg.Collection, tt.doc("a")); err != nil {
+				t.Fatal(err)
+			}
+			filter := bson.M{"_id": reflect.ValueOf(tt.doc("")).Field(0).Interface()}
+			if err := store.Update(ctx, tt.cfg.Collection, filter, tt.doc("b")); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := audit.Count(ctx, "audit_logs_meta", nil); err != nil || n != 1 {
+				t.Fatalf("got %d audit metas, %v, want 1", n, err)
+			}
+			if logs := auditEntries(t, audit, tt.docId); len(logs) != 2 {
+				t.Errorf("got %d audit entries, want 2", len(logs))
+			}
+		})
+	}
+}
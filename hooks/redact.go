@@ -0,0 +1,363 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options of the hookie struct tag
+const (
+	protectRedact = "redact"    // hookie:"redact" replaces the value with [REDACTED]
+	protectMask   = "mask"      // hookie:"mask=last4" keeps only the last 4 characters, mask=first2 the first 2
+	protectHash   = "hash"      // hookie:"hash" replaces the value with its unsalted SHA-256, guessable for values of low entropy
+	tagIgnore     = "-"         // hookie:"-" leaves the field out of audit storage
+	tagTrackOnly  = "trackonly" // hookie:"trackonly" records changes of the field without creating audit entries
+)
+
+// protection is how the value of a field is kept out of audit storage
+type protection struct {
+	mode  string
+	keep  int  // characters left visible by mask
+	first bool // keep the first characters instead of the last
+}
+
+// auditRules are the settings of the fields of a model, from its hookie tags and its config. Fields are
+// keyed by their path in the stored document.
+type auditRules struct {
+	protect   map[string]protection
+	ignore    []string // never audited
+	trackOnly []string // changes are recorded with the next audit entry, but do not create one
+}
+
+var rulesCache sync.Map // reflect.Type -> *auditRules
+
+// rulesOf returns the rules of the model type t combined with those of cfg
+func rulesOf(t reflect.Type, cfg *in.ModelConfig) *auditRules {
+	rules := &auditRules{protect: make(map[string]protection)}
+	if t != nil {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			cached, ok := rulesCache.Load(t)
+			if !ok {
+				found := &auditRules{protect: make(map[string]protection)}
+				collectRules(t, "", found, make(map[reflect.Type]bool))
+				cached, _ = rulesCache.LoadOrStore(t, found)
+			}
+			tagged := cached.(*auditRules)
+			for path, p := range tagged.protect {
+				rules.protect[path] = p
+			}
+			rules.ignore = append(rules.ignore, tagged.ignore...)
+			rules.trackOnly = append(rules.trackOnly, tagged.trackOnly...)
+		}
+	}
+	if cfg != nil {
+		for _, path := range cfg.Redact {
+			rules.protect[path] = protection{mode: protectRedact}
+		}
+		rules.ignore = append(rules.ignore, cfg.Ignore...)
+		rules.trackOnly = append(rules.trackOnly, cfg.TrackOnly...)
+	}
+	return rules
+}
+
+// ignored reports whether the change at path is left out of audit storage
+func (r *auditRules) ignored(path string) bool {
+	return r != nil && hasField(r.ignore, strings.Join(splitPath(path), "."))
+}
+
+// tracked reports whether the change at path does not create an audit entry on its own
+func (r *auditRules) tracked(path string) bool {
+	return r != nil && hasField(r.trackOnly, strings.Join(splitPath(path), "."))
+}
+
+// withheld returns how audit storage keeps the value at path, or a value within it, from being stored as it
+// is: the mode of its protection, or "ignored". It returns "" when the value is stored as it is.
+func (r *auditRules) withheld(path string) string {
+	if r == nil {
+		return ""
+	}
+	path = fieldPath(path)
+	for _, rule := range r.ignore {
+		if overlaps(path, rule) {
+			return "ignored"
+		}
+	}
+	rules := make([]string, 0, len(r.protect))
+	for rule := range r.protect {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		if overlaps(path, rule) {
+			return r.protect[rule].mode + "ed"
+		}
+	}
+	return ""
+}
+
+// fieldPath returns path without its array indexes, the way the fields of rules are named
+func fieldPath(path string) string {
+	parts := splitPath(path)
+	fields := parts[:0]
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			fields = append(fields, part)
+		}
+	}
+	return strings.Join(fields, ".")
+}
+
+// strip removes the ignored fields from state
+func (r *auditRules) strip(state map[string]interface{}) {
+	for _, path := range r.ignore {
+		for key := range state {
+			switch {
+			case key == path || strings.HasPrefix(key, path+"."):
+				delete(state, key)
+			case strings.HasPrefix(path, key+"."):
+				if nested, ok := state[key].(map[string]interface{}); ok {
+					removeValueAt(nested, strings.TrimPrefix(path, key+"."))
+				}
+			}
+		}
+	}
+}
+
+// collectRules adds the tagged fields of the struct t and its nested structs to found
+func collectRules(t reflect.Type, prefix string, found *auditRules, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		var name string
+		if prefix == "" {
+			// Top level fields are named like structToMap names them, nested ones like the BSON encoder
+			name = fieldName(field)
+		} else {
+			name = prefix + "." + bsonFieldName(field)
+		}
+		tag := field.Tag.Get("hookie")
+		if tag == tagIgnore {
+			found.ignore = append(found.ignore, name)
+			continue
+		}
+		if hasTagOption(tag, tagTrackOnly) {
+			found.trackOnly = append(found.trackOnly, name)
+		}
+		if p, ok := parseProtection(tag); ok {
+			found.protect[name] = p
+			continue
+		}
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}) {
+			collectRules(ft, name, found, seen)
+		}
+	}
+}
+
+func hasTagOption(tag, option string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if strings.TrimSpace(opt) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProtection reads the protection from the options of a hookie tag
+func parseProtection(tag string) (protection, bool) {
+	for _, opt := range strings.Split(tag, ",") {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == protectRedact:
+			return protection{mode: protectRedact}, true
+		case opt == protectHash:
+			return protection{mode: protectHash}, true
+		case opt == protectMask:
+			return protection{mode: protectMask, keep: 4}, true
+		case strings.HasPrefix(opt, protectMask+"="):
+			p := protection{mode: protectMask, keep: 4}
+			arg := strings.TrimPrefix(opt, protectMask+"=")
+			switch {
+			case strings.HasPrefix(arg, "last"):
+				arg = strings.TrimPrefix(arg, "last")
+			case strings.HasPrefix(arg, "first"):
+				arg, p.first = strings.TrimPrefix(arg, "first"), true
+			}
+			if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+				p.keep = n
+			}
+			return p, true
+		}
+	}
+	return protection{}, false
+}
+
+// protect replaces the protected values in state. It returns the digests of the redacted and masked
+// values, keyed by salt, which are kept in the meta only, so that a change of value is still reported when
+// the protected forms are the same.
+func protect(state map[string]interface{}, fields map[string]protection, salt string) (map[string]string, error) {
+	digests := make(map[string]string)
+	// apply protects the value at rest within the value of key, keys of update payloads may be dotted paths
+	apply := func(key, rest string, p protection) error {
+		value, ok := state[key]
+		if rest != "" {
+			nested, isMap := value.(map[string]interface{})
+			if !isMap {
+				return nil
+			}
+			value, ok = valueAt(nested, rest)
+		}
+		if !ok {
+			return nil
+		}
+		protected, err := p.apply(value)
+		if err != nil {
+			return err
+		}
+		path := key
+		if rest != "" {
+			path += "." + rest
+			setValueAt(state[key].(map[string]interface{}), rest, protected)
+		} else {
+			state[key] = protected
+		}
+		if p.mode != protectHash {
+			if digests[path], err = saltedDigestOf(salt, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for path, p := range fields {
+		for key := range state {
+			var err error
+			switch {
+			case key == path || strings.HasPrefix(key, path+"."):
+				// The field itself, or a value within it set by its dotted path
+				err = apply(key, "", p)
+			case strings.HasPrefix(path, key+"."):
+				// A field nested in a document being set
+				err = apply(key, strings.TrimPrefix(path, key+"."), p)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return digests, nil
+}
+
+func (p protection) apply(value interface{}) (interface{}, error) {
+	switch p.mode {
+	case protectMask:
+		s := []rune(fmt.Sprint(value))
+		if len(s) <= p.keep {
+			return strings.Repeat("*", len(s)), nil
+		}
+		if p.first {
+			return string(s[:p.keep]) + strings.Repeat("*", len(s)-p.keep), nil
+		}
+		return strings.Repeat("*", len(s)-p.keep) + string(s[len(s)-p.keep:]), nil
+	case protectHash:
+		digest, err := digestOf(value)
+		if err != nil {
+			return nil, err
+		}
+		return "sha256:" + digest, nil
+	}
+	return redacted, nil
+}
+
+// digestOf returns the SHA-256 of the JSON encoding of value. Being unsalted, the values of hashed fields
+// can be found by hashing guesses, unlike the digests kept in the meta.
+func digestOf(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// saltedDigestOf returns the HMAC-SHA256 of the JSON encoding of value keyed by salt
+func saltedDigestOf(salt string, value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newDigestSalt returns a random salt for the digests of a document
+func newDigestSalt() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("could not salt digests: %w", err)
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// protectedChanges adds a change for every protected value whose digest changed while its protected form
+// stayed the same, without revealing either value. It reports whether it added a change to a field that is
+// not track-only.
+func protectedChanges(changes map[string]in.AuditChange, oldState, newState map[string]interface{}, oldDigests, newDigests map[string]string, rules *auditRules) bool {
+	significant := false
+	for path, digest := range newDigests {
+		oldDigest, ok := oldDigests[path]
+		if !ok || oldDigest == digest {
+			continue
+		}
+		if _, ok = changes[path]; ok {
+			continue
+		}
+		oldVal, _ := valueAt(oldState, path)
+		newVal, ok := newState[path]
+		if !ok {
+			newVal, _ = valueAt(newState, path)
+		}
+		changes[path] = in.AuditChange{Type: in.ChangeModified, Old: oldVal, New: newVal}
+		significant = significant || !rules.tracked(path)
+	}
+	return significant
+}
+
+// mergeDigests returns the digests of the document after newDigests have been saved over oldDigests
+func mergeDigests(oldDigests, newDigests map[string]string, partial bool) map[string]string {
+	if !partial {
+		return newDigests
+	}
+	merged := make(map[string]string, len(oldDigests)+len(newDigests))
+	for path, digest := range oldDigests {
+		merged[path] = digest
+	}
+	for path, digest := range newDigests {
+		merged[path] = digest
+	}
+	return merged
+}
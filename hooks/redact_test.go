@@ -0,0 +1,223 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type credentials struct {
+	Id       primitive.ObjectID `bson:"_id"`
+	Password string             `bson:"password" hookie:"redact"`
+	Card     string             `bson:"card" hookie:"mask=last4"`
+	Email    string             `bson:"email" hookie:"hash"`
+	Token    string             `bson:"token"`
+}
+
+func TestProtectedFields(t *testing.T) {
+	ctx := context.Background()
+	const col = "redact_credentials"
+	// The token is redacted by the config of the model instead of a tag
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(credentials{}), Collection: col, Redact: []string{"token"}})
+	doc := credentials{Id: primitive.NewObjectID(), Password: "hunter2", Card: "4111111111111111", Email: "a@example.com", Token: "t0k3n"}
+	if err := store.Insert(ctx, col, doc); err != nil {
+		t.Fatal(err)
+	}
+	// Only the password changes, its redacted form stays the same
+	doc.Password = "hunter3"
+	if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailDigest, err := digestOf("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field string
+		want  interface{}
+	}{
+		{"password", redacted},
+		{"card", "************1111"},
+		{"email", "sha256:" + emailDigest},
+		{"token", redacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := meta.DocumentCurrentState[tt.field]; got != tt.want {
+				t.Errorf("stored %s = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("digests", func(t *testing.T) {
+		plain, err := digestOf("hunter3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		salted, err := saltedDigestOf(meta.DigestSalt, "hunter3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.DigestSalt == "" || meta.Digests["password"] != salted || salted == plain {
+			t.Errorf("password digest = %s with salt %q, want the salted %s", meta.Digests["password"], meta.DigestSalt, salted)
+		}
+		// The same value has another digest in another document
+		other := credentials{Id: primitive.NewObjectID(), Password: "hunter3"}
+		if err = store.Insert(ctx, col, other); err != nil {
+			t.Fatal(err)
+		}
+		otherMeta, err := findAuditLogMeta(ctx, audit, other.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if otherMeta.DigestSalt == meta.DigestSalt || otherMeta.Digests["password"] == meta.Digests["password"] {
+			t.Errorf("documents share salt %s and digest %s", meta.DigestSalt, meta.Digests["password"])
+		}
+	})
+
+	logs := auditEntries(t, audit, doc.Id.Hex())
+	if len(logs) != 2 {
+		t.Fatalf("got %d audit entries, want 2", len(logs))
+	}
+	want := []in.AuditChange{{Path: "password", Type: in.ChangeModified, Old: redacted, New: redacted}}
+	if !reflect.DeepEqual(logs[1].Change, want) {
+		t.Errorf("update changes = %#v, want %#v", logs[1].Change, want)
+	}
+	stored, err := json.Marshal(struct {
+		Meta interface{}
+		Logs interface{}
+	}{meta, logs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"hunter2", "hunter3", "4111111111111111", "a@example.com", "t0k3n"} {
+		if strings.Contains(string(stored), plain) {
+			t.Errorf("audit storage contains %q", plain)
+		}
+	}
+}
+
+type noisy struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	Name      string             `bson:"name"`
+	UpdatedAt int                `bson:"updated_at" hookie:"trackonly"`
+	Cache     string             `bson:"cache" hookie:"-"`
+	Seen      int                `bson:"seen"`
+}
+
+func TestIgnoredAndTrackOnlyFields(t *testing.T) {
+	ctx := context.Background()
+	const col = "redact_noisy"
+	// Seen is ignored by the config of the model instead of a tag
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(noisy{}), Collection: col, Ignore: []string{"seen"}})
+	doc := noisy{Id: primitive.NewObjectID(), Name: "a"}
+	if err := store.Insert(ctx, col, doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(doc *noisy)
+		want   []string // paths changed by the new audit entry, nil when none is written
+	}{
+		{
+			name:   "track-only field alone",
+			change: func(doc *noisy) { doc.UpdatedAt = 1 },
+		},
+		{
+			name:   "ignored fields",
+			change: func(doc *noisy) { doc.Cache, doc.Seen = "c", 1 },
+		},
+		{
+			name:   "track-only field with another",
+			change: func(doc *noisy) { doc.Name, doc.UpdatedAt, doc.Seen = "b", 2, 2 },
+			want:   []string{"name", "updated_at"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(auditEntries(t, audit, doc.Id.Hex()))
+			tt.change(&doc)
+			if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+				t.Fatal(err)
+			}
+			logs := auditEntries(t, audit, doc.Id.Hex())
+			if tt.want == nil {
+				if len(logs) != before {
+					t.Fatalf("got audit entry %+v, want none", logs[len(logs)-1])
+				}
+				return
+			}
+			if len(logs) != before+1 {
+				t.Fatalf("got %d audit entries, want %d", len(logs), before+1)
+			}
+			var paths []string
+			for _, change := range logs[len(logs)-1].Change {
+				paths = append(paths, change.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("changed paths = %v, want %v", paths, tt.want)
+			}
+		})
+	}
+
+	meta, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"cache", "seen"} {
+		if value, ok := meta.DocumentCurrentState[field]; ok {
+			t.Errorf("audit storage holds ignored field %s = %v", field, value)
+		}
+	}
+}
+
+func TestUnsaltedDigests(t *testing.T) {
+	ctx := context.Background()
+	const col = "redact_unsalted"
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(credentials{}), Collection: col})
+	doc := credentials{Id: primitive.NewObjectID(), Password: "hunter2"}
+	if err := store.Insert(ctx, col, doc); err != nil {
+		t.Fatal(err)
+	}
+	// A meta written before digests were salted
+	plain, err := digestOf("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsalted := bson.M{"digests": bson.M{"password": plain}, "digest_salt": ""}
+	if err = audit.Update(ctx, "audit_logs_meta", bson.M{"document_current_state._id": doc.Id.Hex()}, unsalted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old digest cannot be compared, so the change of the password alone is not reported
+	doc.Password, doc.Token = "hunter3", "t1"
+	if err = store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatal(err)
+	}
+	logs := auditEntries(t, audit, doc.Id.Hex())
+	want := []in.AuditChange{{Path: "token", Type: in.ChangeModified, Old: "", New: "t1"}}
+	if !reflect.DeepEqual(logs[len(logs)-1].Change, want) {
+		t.Errorf("update changes = %#v, want %#v", logs[len(logs)-1].Change, want)
+	}
+	meta, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	salted, err := saltedDigestOf(meta.DigestSalt, "hunter3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DigestSalt == "" || meta.Digests["password"] != salted {
+		t.Errorf("password digest = %s with salt %q, want it salted again", meta.Digests["password"], meta.DigestSalt)
+	}
+}
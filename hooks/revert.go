@@ -0,0 +1,156 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// List of revert errors
+var (
+	ErrRevertConflict = errors.New("hooks: revert conflicts with a later change")
+	ErrRevertWithheld = errors.New("hooks: revert of a value kept out of audit storage")
+)
+
+// Revert undoes the change recorded by an audit entry of the document docId in col, given either its
+// version number or the id of the audit entry. The fields it changed get back the values they had before
+// it, through Update so the revert is audited as a "revert" event. Fields it removed are restored and
+// fields it added are unset with a $unset update instead, as Update can only set fields.
+//
+// Only the changed paths are written, array elements by writing back their whole array. Audit storage does
+// not hold the values of redacted, masked, hashed and ignored fields, nor of the fields left out by
+// WithFields, so Revert returns ErrRevertWithheld rather than write what it kept in their place.
+//
+// Revert returns ErrRevertConflict when a later entry changed any of the same fields.
+func (h *History) Revert(ctx context.Context, col, docId, versionOrAuditId string) error {
+	db, err := auditStore(h.db)
+	if err != nil {
+		return err
+	}
+	versions, err := h.Versions(ctx, docId)
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i, v := range versions {
+		if strconv.FormatInt(v.Number, 10) == versionOrAuditId || v.Log.Id.Hex() == versionOrAuditId {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("audit entry %s of %s: %w", versionOrAuditId, docId, hookiedb.ErrNotFound)
+	}
+	entry := versions[target]
+	if entry.Event == "insert" || entry.Event == "delete" {
+		return fmt.Errorf("hooks: cannot revert the %s of %s", entry.Event, docId)
+	}
+
+	current := versions[len(versions)-1]
+	if current.State == nil {
+		return fmt.Errorf("%s was deleted: %w", docId, ErrRevertConflict)
+	}
+	paths := make([]string, 0, len(entry.Log.Change))
+	for _, change := range entry.Log.Change {
+		paths = append(paths, change.Path)
+	}
+	sort.Strings(paths)
+	for _, later := range versions[target+1:] {
+		for _, change := range later.Log.Change {
+			for _, p := range paths {
+				if overlaps(p, change.Path) {
+					return fmt.Errorf("%s changed again in version %d: %w", change.Path, later.Number, ErrRevertConflict)
+				}
+			}
+		}
+	}
+
+	cfg, _ := registry.LookupCollection(col)
+	var rules *auditRules
+	if cfg != nil {
+		rules = rulesOf(cfg.Type, cfg)
+	}
+	reverted := copyState(current.State)
+	undoChanges(reverted, entry.Log.Change)
+	set, unset := bson.M{}, bson.M{}
+	for _, path := range paths {
+		written := revertPath(path)
+		if how := rules.withheld(written); how != "" {
+			return fmt.Errorf("%w: %s is %s", ErrRevertWithheld, written, how)
+		}
+		if cfg != nil && len(cfg.Fields) > 0 && !hasField(cfg.Fields, written) {
+			return fmt.Errorf("%w: %s is not an audited field", ErrRevertWithheld, written)
+		}
+		if value, ok := valueAt(reverted, written); ok {
+			set[written] = value
+		} else {
+			unset[written] = ""
+		}
+	}
+
+	id, err := storedId(ctx, db, col, docId)
+	if err != nil {
+		return err
+	}
+	ctx = hookiedb.WithAuditEvent(ctx, "revert")
+	filter := bson.M{"_id": id}
+	if len(unset) == 0 {
+		return db.Update(ctx, col, filter, set)
+	}
+	query := hookiedb.UnorderedDbQuery{"$unset": unset}
+	if len(set) > 0 {
+		query["$set"] = set
+	}
+	return db.PartialUpdateManyByQuery(ctx, col, filter, query)
+}
+
+// revertPath returns the dotted path Revert writes to undo the change at path. Array elements can not be
+// inserted or removed by path, so the array holding them is written whole.
+func revertPath(path string) string {
+	if i := strings.Index(path, "["); i >= 0 {
+		path = path[:i]
+	}
+	parts := splitPath(path)
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			return strings.Join(parts[:i], ".")
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// overlaps reports whether the paths a and b address the same value or one lies within the other
+func overlaps(a, b string) bool {
+	pa, pb := strings.Join(splitPath(a), "."), strings.Join(splitPath(b), ".")
+	return pa == pb || strings.HasPrefix(pa, pb+".") || strings.HasPrefix(pb, pa+".")
+}
+
+// storedId returns the _id, with the type it is stored with, of the document of col the hooks were given as
+// docId. Ids given to the hooks are strings whatever their type, so every type docId may have been
+// converted from is looked up.
+func storedId(ctx context.Context, db hookiedb.NoSql, col, docId string) (interface{}, error) {
+	candidates := bson.A{docId}
+	if oid, err := primitive.ObjectIDFromHex(docId); err == nil {
+		candidates = append(candidates, oid)
+	}
+	if n, err := strconv.ParseInt(docId, 10, 64); err == nil {
+		candidates = append(candidates, n)
+	}
+	var doc bson.M
+	// The lookup is not a read of the caller, it must not run the find hooks
+	if err := db.FindOne(hookiedb.WithoutHooks(hookiedb.WithDeleted(ctx)), col, bson.M{"_id": bson.M{"$in": candidates}}, &doc); err != nil {
+		if errors.Is(err, hookiedb.ErrNotFound) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%s in %s: %w", docId, col, hookiedb.ErrNotFound)
+		}
+		return nil, err
+	}
+	return doc["_id"], nil
+}
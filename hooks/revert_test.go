@@ -0,0 +1,264 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRevert(t *testing.T) {
+	ctx := context.Background()
+	const col = "revert_accounts"
+	store := newSharedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col})
+	history := NewHistory(store)
+
+	tests := []struct {
+		name string
+		// later changes doc after the reverted version 2, which sets the name to "b"
+		later  func(doc *account)
+		target func(t *testing.T, docId string) string
+		err    error
+		want   account
+	}{
+		{
+			name:   "by version",
+			later:  func(doc *account) { doc.Count = 7 },
+			target: func(t *testing.T, docId string) string { return "2" },
+			want:   account{Name: "a", Count: 7},
+		},
+		{
+			name:  "by audit entry id",
+			later: func(doc *account) {},
+			target: func(t *testing.T, docId string) string {
+				return auditEntries(t, store, docId)[1].Id.Hex()
+			},
+			want: account{Name: "a"},
+		},
+		{
+			name:   "field changed again",
+			later:  func(doc *account) { doc.Name = "c" },
+			target: func(t *testing.T, docId string) string { return "2" },
+			err:    ErrRevertConflict,
+			want:   account{Name: "c"},
+		},
+		{
+			name:   "unknown version",
+			later:  func(doc *account) {},
+			target: func(t *testing.T, docId string) string { return "9" },
+			err:    hookiedb.ErrNotFound,
+			want:   account{Name: "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := account{Id: primitive.NewObjectID(), Name: "a"}
+			if err := store.Insert(ctx, col, doc); err != nil {
+				t.Fatal(err)
+			}
+			doc.Name = "b"
+			if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+				t.Fatal(err)
+			}
+			tt.later(&doc)
+			if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+				t.Fatal(err)
+			}
+
+			err := history.Revert(ctx, col, doc.Id.Hex(), tt.target(t, doc.Id.Hex()))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Revert() = %v, want %v", err, tt.err)
+			}
+			var got account
+			if err = store.FindOne(ctx, col, bson.M{"_id": doc.Id}, &got); err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Id = doc.Id
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("document = %+v, want %+v", got, tt.want)
+			}
+			logs := auditEntries(t, store, doc.Id.Hex())
+			if last := logs[len(logs)-1].AuditEvent; (tt.err == nil) != (last == "revert") {
+				t.Errorf("last audit event = %s", last)
+			}
+		})
+	}
+
+	t.Run("insert", func(t *testing.T) {
+		doc := account{Id: primitive.NewObjectID(), Name: "a"}
+		if err := store.Insert(ctx, col, doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := history.Revert(ctx, col, doc.Id.Hex(), "1"); err == nil {
+			t.Errorf("Revert of an insert returned no error")
+		}
+	})
+}
+
+type home struct {
+	City string `bson:"city"`
+	Code string `bson:"code" hookie:"-"`
+}
+
+type profile struct {
+	Id       int    `bson:"_id"`
+	Name     string `bson:"name"`
+	Password string `bson:"password" hookie:"redact"`
+	Card     string `bson:"card" hookie:"mask=last4"`
+	Email    string `bson:"email" hookie:"hash"`
+	Cache    string `bson:"cache" hookie:"-"`
+	Home     home   `bson:"home"`
+	Note     string `bson:"note"`
+}
+
+func TestRevertWithheldValues(t *testing.T) {
+	ctx := context.Background()
+	const col = "revert_profiles"
+	// The note is left out of audit storage by the fields of the config
+	store := newSharedStore(t, in.ModelConfig{Type: reflect.TypeOf(profile{}), Collection: col,
+		Fields: []string{"name", "password", "card", "email", "cache", "home"}})
+	history := NewHistory(store)
+	original := profile{Name: "a", Password: "p1", Card: "4111111111111111", Email: "a@example.com",
+		Cache: "c1", Home: home{City: "Oslo", Code: "x1"}, Note: "n1"}
+
+	tests := []struct {
+		name   string
+		change func(doc *profile)
+		err    error
+		want   func(doc profile) profile // document after the revert, from the one it reverts
+	}{
+		{
+			name:   "redacted",
+			change: func(doc *profile) { doc.Password = "p2" },
+			err:    ErrRevertWithheld,
+		},
+		{
+			name:   "masked",
+			change: func(doc *profile) { doc.Card = "5500000000000004" },
+			err:    ErrRevertWithheld,
+		},
+		{
+			name:   "hashed",
+			change: func(doc *profile) { doc.Email = "b@example.com" },
+			err:    ErrRevertWithheld,
+		},
+		{
+			name:   "ignored field within a changed one",
+			change: func(doc *profile) { doc.Home = home{City: "Bergen", Code: "x2"} },
+			want: func(doc profile) profile {
+				doc.Home.City = "Oslo"
+				return doc
+			},
+		},
+		{
+			name:   "ignored and excluded fields beside a changed one",
+			change: func(doc *profile) { doc.Name, doc.Cache, doc.Note = "b", "c2", "n2" },
+			want: func(doc profile) profile {
+				doc.Name = "a"
+				return doc
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := original
+			doc.Id = i
+			if err := store.Insert(ctx, col, doc); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(&doc)
+			if err := store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+				t.Fatal(err)
+			}
+
+			err := history.Revert(ctx, col, strconv.Itoa(doc.Id), "2")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Revert() = %v, want %v", err, tt.err)
+			}
+			want := doc
+			if tt.want != nil {
+				want = tt.want(doc)
+			}
+			var got profile
+			if err = store.FindOne(ctx, col, bson.M{"_id": doc.Id}, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("document = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRevertIdTypes(t *testing.T) {
+	ctx := context.Background()
+	type numbered struct {
+		Id   int    `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	type named struct {
+		Id   string `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	type identified struct {
+		Id   primitive.ObjectID `bson:"_id"`
+		Name string             `bson:"name"`
+	}
+	oid := primitive.NewObjectID()
+	tests := []struct {
+		name  string
+		id    interface{}
+		docId string
+		doc   func(name string) interface{}
+	}{
+		{"int", 7, "7", func(name string) interface{} { return numbered{Id: 7, Name: name} }},
+		{"string", "key", "key", func(name string) interface{} { return named{Id: "key", Name: name} }},
+		{"hex string", oid.Hex(), oid.Hex(), func(name string) interface{} { return named{Id: oid.Hex(), Name: name} }},
+		{"object id", oid, oid.Hex(), func(name string) interface{} { return identified{Id: oid, Name: name} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			col := "revert_ids_" + strings.ReplaceAll(tt.name, " ", "_")
+			store := newSharedStore(t, in.ModelConfig{Type: reflect.TypeOf(tt.doc("")), Collection: col})
+			if err := store.Insert(ctx, col, tt.doc("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Update(ctx, col, bson.M{"_id": tt.id}, tt.doc("b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewHistory(store).Revert(ctx, col, tt.docId, "2"); err != nil {
+				t.Fatalf("Revert: %v", err)
+			}
+			var got bson.M
+			if err := store.FindOne(ctx, col, bson.M{"_id": tt.id}, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["name"] != "a" {
+				t.Errorf("name = %v, want a", got["name"])
+			}
+		})
+	}
+}
+
+func TestRevertPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"name", "name"},
+		{"home.city", "home.city"},
+		{"lines[1]", "lines"},
+		{"home.lines[0].city", "home.lines"},
+		{"home.lines.2", "home.lines"},
+	}
+	for _, tt := range tests {
+		if got := revertPath(tt.path); got != tt.want {
+			t.Errorf("revertPath(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package hooks
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"sync"
+)
+
+// List of signature errors
+var (
+	ErrUnknownKey   = errors.New("hooks: unknown signing key")
+	ErrBadSignature = errors.New("hooks: invalid signature")
+)
+
+// Signer signs the hash of audit entries. The key id is recorded on each entry so that the key to verify
+// it with can be found after the signer has been rotated.
+type Signer interface {
+	KeyID() string
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Ed25519Signer signs with an Ed25519 private key, entries can be verified by anyone holding the public key
+type Ed25519Signer struct {
+	keyId string
+	key   ed25519.PrivateKey
+}
+
+func NewEd25519Signer(keyId string, key ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{keyId: keyId, key: key}
+}
+
+func (s *Ed25519Signer) KeyID() string {
+	return s.keyId
+}
+
+func (s *Ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, digest), nil
+}
+
+// HMACSigner signs with HMAC-SHA256, entries can only be verified with the same secret
+type HMACSigner struct {
+	keyId  string
+	secret []byte
+}
+
+func NewHMACSigner(keyId string, secret []byte) *HMACSigner {
+	return &HMACSigner{keyId: keyId, secret: secret}
+}
+
+func (s *HMACSigner) KeyID() string {
+	return s.keyId
+}
+
+func (s *HMACSigner) Sign(digest []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(digest)
+	return mac.Sum(nil), nil
+}
+
+// KeySet holds the keys audit entries are verified with, by key id. Keep the keys of rotated signers in the
+// set so that the entries they signed remain verifiable.
+type KeySet struct {
+	mu   sync.RWMutex
+	keys map[string]func(digest, sig []byte) bool
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]func(digest, sig []byte) bool)}
+}
+
+// AddEd25519 adds the public key of an Ed25519Signer
+func (k *KeySet) AddEd25519(keyId string, key ed25519.PublicKey) *KeySet {
+	return k.add(keyId, func(digest, sig []byte) bool {
+		return ed25519.Verify(key, digest, sig)
+	})
+}
+
+// AddHMAC adds the secret of an HMACSigner
+func (k *KeySet) AddHMAC(keyId string, secret []byte) *KeySet {
+	signer := NewHMACSigner(keyId, secret)
+	return k.add(keyId, func(digest, sig []byte) bool {
+		expected, _ := signer.Sign(digest)
+		return hmac.Equal(expected, sig)
+	})
+}
+
+func (k *KeySet) add(keyId string, verify func(digest, sig []byte) bool) *KeySet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyId] = verify
+	return k
+}
+
+// Verify checks that sig is the signature of digest made with the key keyId
+func (k *KeySet) Verify(keyId string, digest, sig []byte) error {
+	k.mu.RLock()
+	verify, ok := k.keys[keyId]
+	k.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, keyId)
+	}
+	if !verify(digest, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// verifyAuditLog checks the signature of entry, whose hash must already have been verified
+func (k *KeySet) verifyAuditLog(entry *in.AuditLog) error {
+	digest, err := hex.DecodeString(entry.AuditHash)
+	if err != nil {
+		return fmt.Errorf("%w: malformed hash", ErrBadSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(entry.AuditSignature)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrBadSignature)
+	}
+	return k.Verify(entry.AuditKeyId, digest, sig)
+}
+
+// signAuditLog signs the hash of entry
+func signAuditLog(entry *in.AuditLog, signer Signer) error {
+	digest, err := hex.DecodeString(entry.AuditHash)
+	if err != nil {
+		return err
+	}
+	sig, err := signer.Sign(digest)
+	if err != nil {
+		return fmt.Errorf("could not sign audit log: %w", err)
+	}
+	entry.AuditSignature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
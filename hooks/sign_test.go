@@ -0,0 +1,117 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/DeimosTech/hookie/db/memory"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestVerifyExport(t *testing.T) {
+	ctx := context.Background()
+	const col = "sign_accounts"
+	if err := registry.RegisterType(in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col}); err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	store := memory.New()
+	h := NewDefaultHookWithStore(store).SignWith(NewEd25519Signer("k1", private))
+	store.Hooks().Use(h)
+
+	doc := account{Id: primitive.NewObjectID(), Name: "a"}
+	if err = store.Insert(ctx, col, doc); err != nil {
+		t.Fatal(err)
+	}
+	doc.Name = "b"
+	if err = store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatal(err)
+	}
+	// Entries written after the rotation are signed with the new key
+	h.SignWith(NewHMACSigner("k2", secret))
+	doc.Count = 2
+	if err = store.Update(ctx, col, bson.M{"_id": doc.Id}, doc); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err = NewHistory(store).Export(ctx, &export); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	keys := NewKeySet().AddEd25519("k1", public).AddHMAC("k2", secret)
+	tests := []struct {
+		name    string
+		keys    *KeySet
+		tamper  func(export string) string
+		version int64
+		problem string
+	}{
+		{
+			name: "untouched export",
+			keys: keys,
+		},
+		{
+			name: "hashes only",
+		},
+		{
+			name:    "rotated key missing",
+			keys:    NewKeySet().AddEd25519("k1", public),
+			version: 3,
+			problem: IssueBadSignature,
+		},
+		{
+			name:    "modified entry",
+			keys:    keys,
+			tamper:  func(export string) string { return strings.Replace(export, `"new":"b"`, `"new":"x"`, 1) },
+			version: 2,
+			problem: IssueHashMismatch,
+		},
+		{
+			name: "removed signature",
+			keys: keys,
+			tamper: func(export string) string {
+				return regexp.MustCompile(`,"audit_signature":"[^"]*"`).ReplaceAllString(export, "")
+			},
+			version: 1,
+			problem: IssueUnsigned,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exported := export.String()
+			if tt.tamper != nil {
+				if exported = tt.tamper(exported); exported == export.String() {
+					t.Fatal("export was not modified")
+				}
+			}
+			issues, err := VerifyExport(strings.NewReader(exported), tt.keys)
+			if err != nil {
+				t.Fatalf("VerifyExport: %v", err)
+			}
+			if tt.problem == "" {
+				if len(issues) > 0 {
+					t.Fatalf("VerifyExport() = %v, want no issues", issues)
+				}
+				return
+			}
+			if len(issues) == 0 || issues[0].Problem != tt.problem || issues[0].Version != tt.version {
+				t.Fatalf("VerifyExport() = %v, want a %s issue on version %d", issues, tt.problem, tt.version)
+			}
+		})
+	}
+
+	if issues, err := NewHistory(store).WithKeys(keys).VerifyDocument(ctx, doc.Id.Hex()); err != nil || len(issues) > 0 {
+		t.Errorf("VerifyDocument() = %v, %v, want no issues", issues, err)
+	}
+}
@@ -0,0 +1,172 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// AuditSink receives the audit entries written by DefaultHooks. Sinks that hold resources also implement
+// io.Closer.
+type AuditSink interface {
+	Write(ctx context.Context, logs []in.AuditLog) error
+}
+
+// MongoSink writes audit entries to the audit_logs collection, where History reads them from
+type MongoSink struct {
+	db hookiedb.NoSql
+}
+
+// NewMongoSink returns a sink writing to store, or to the connection set up by mongo.InitMongo when store
+// is nil
+func NewMongoSink(store hookiedb.NoSql) *MongoSink {
+	return &MongoSink{db: store}
+}
+
+func (s *MongoSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	db, err := auditStore(s.db)
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(logs))
+	for i, log := range logs {
+		docs[i] = log
+	}
+	// Audit writes must not run the hooks again
+	return db.InsertMany(hookiedb.WithoutHooks(ctx), "audit_logs", docs)
+}
+
+// SlogSink writes audit entries as log records
+type SlogSink struct {
+	l     *slog.Logger
+	level slog.Level
+}
+
+// NewSlogSink returns a sink logging entries to l at info level
+func NewSlogSink(l *slog.Logger) *SlogSink {
+	return &SlogSink{l: l, level: slog.LevelInfo}
+}
+
+// WithLevel sets the level entries are logged at
+func (s *SlogSink) WithLevel(level slog.Level) *SlogSink {
+	s.level = level
+	return s
+}
+
+func (s *SlogSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	for _, log := range logs {
+		s.l.LogAttrs(ctx, s.level, "audit log",
+			slog.String("audit_id", log.Id.Hex()),
+			slog.String("audit_meta_id", log.AuditMetaId),
+			slog.Int64("audit_version", log.AuditVersion),
+			slog.String("audit_event", log.AuditEvent),
+			slog.String("user_id", log.UserID),
+			slog.String("audit_request_id", log.AuditRequestId),
+			slog.Any("change", log.Change),
+		)
+	}
+	return nil
+}
+
+// WebhookSink posts audit entries as a JSON array, each in the canonical form read by VerifyExport
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	header http.Header
+}
+
+// WebhookOption configures a WebhookSink
+type WebhookOption func(*WebhookSink)
+
+// WithHTTPClient sets the client requests are sent with, http.DefaultClient by default
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(s *WebhookSink) {
+		s.client = client
+	}
+}
+
+// WithHeader adds a header to every request, such as an authorization token
+func WithHeader(key, value string) WebhookOption {
+	return func(s *WebhookSink) {
+		s.header.Add(key, value)
+	}
+}
+
+func NewWebhookSink(url string, opts ...WebhookOption) *WebhookSink {
+	s := &WebhookSink{url: url, client: http.DefaultClient, header: make(http.Header)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *WebhookSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, log := range logs {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		data, err := canonicalAuditLog(log)
+		if err != nil {
+			return err
+		}
+		body.Write(data)
+	}
+	body.WriteByte(']')
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	for key, values := range s.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("hooks: audit webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// FanOut returns a sink writing every entry to all of sinks. All sinks are written to even when some fail.
+func FanOut(sinks ...AuditSink) AuditSink {
+	return multiSink(sinks)
+}
+
+type multiSink []AuditSink
+
+func (m multiSink) Write(ctx context.Context, logs []in.AuditLog) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, logs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the sinks that implement io.Closer
+func (m multiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,303 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	"github.com/DeimosTech/hookie/db/memory"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyDocument(t *testing.T) {
+	ctx := context.Background()
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: "chain_accounts"})
+	newDoc := func(t *testing.T, updates int) account {
+		doc := account{Id: primitive.NewObjectID(), Name: "a"}
+		if err := store.Insert(ctx, "chain_accounts", doc); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		for i := 0; i < updates; i++ {
+			doc.Count = i + 1
+			if err := store.Update(ctx, "chain_accounts", bson.M{"_id": doc.Id}, doc); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+		}
+		return doc
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, doc account)
+		problem string
+	}{
+		{
+			name:   "untouched chain",
+			tamper: func(t *testing.T, doc account) {},
+		},
+		{
+			name: "modified entry",
+			tamper: func(t *testing.T, doc account) {
+				logs := auditEntries(t, audit, doc.Id.Hex())
+				update := hookiedb.UnorderedDbQuery{"$set": bson.M{"user_id": "someone else"}}
+				if err := audit.PartialUpdateManyByQuery(ctx, "audit_logs", bson.M{"_id": logs[1].Id}, update); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: IssueHashMismatch,
+		},
+		{
+			name: "removed entry",
+			tamper: func(t *testing.T, doc account) {
+				logs := auditEntries(t, audit, doc.Id.Hex())
+				if err := audit.DeleteOne(ctx, "audit_logs", bson.M{"_id": logs[1].Id}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: IssueGap,
+		},
+		{
+			name: "removed last entry",
+			tamper: func(t *testing.T, doc account) {
+				logs := auditEntries(t, audit, doc.Id.Hex())
+				if err := audit.DeleteOne(ctx, "audit_logs", bson.M{"_id": logs[len(logs)-1].Id}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: IssueTruncated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := newDoc(t, 3)
+			tt.tamper(t, doc)
+			issues, err := NewHistory(audit).VerifyDocument(ctx, doc.Id.Hex())
+			if err != nil {
+				t.Fatalf("VerifyDocument: %v", err)
+			}
+			if tt.problem == "" {
+				if len(issues) > 0 {
+					t.Fatalf("VerifyDocument() = %v, want no issues", issues)
+				}
+				return
+			}
+			if len(issues) == 0 || issues[0].Problem != tt.problem {
+				t.Fatalf("VerifyDocument() = %v, want a %s issue", issues, tt.problem)
+			}
+		})
+	}
+}
+
+// slowReads is an audit store whose reads take long enough for concurrent writes to interleave
+type slowReads struct {
+	*memory.Memory
+}
+
+func (s slowReads) FindOne(ctx context.Context, col string, filter interface{}, v interface{}, sort ...interface{}) error {
+	defer time.Sleep(time.Millisecond)
+	return s.Memory.FindOne(ctx, col, filter, v, sort...)
+}
+
+func TestConcurrentUpdatesKeepChain(t *testing.T) {
+	ctx := context.Background()
+	audit := memory.New()
+	if err := registry.RegisterType(in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: "chain_concurrent"}); err != nil {
+		t.Fatal(err)
+	}
+	store := memory.New(NewDefaultHookWithStore(slowReads{audit}))
+	doc := account{Id: primitive.NewObjectID(), Name: "a"}
+	if err := store.Insert(ctx, "chain_concurrent", doc); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	const writers = 38
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			update := doc
+			update.Name = fmt.Sprintf("name %d", i)
+			errs <- store.Update(ctx, "chain_concurrent", bson.M{"_id": doc.Id}, update)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+
+	issues, err := NewHistory(audit).VerifyDocument(ctx, doc.Id.Hex())
+	if err != nil {
+		t.Fatalf("VerifyDocument: %v", err)
+	}
+	if len(issues) > 0 {
+		t.Fatalf("VerifyDocument() = %v, want no issues", issues)
+	}
+	if logs := auditEntries(t, audit, doc.Id.Hex()); len(logs) != writers+1 {
+		t.Errorf("got %d audit entries, want %d", len(logs), writers+1)
+	}
+}
+
+// flakySink writes to the audit_logs of its store, unless it is down
+type flakySink struct {
+	AuditSink
+	mu   sync.Mutex
+	down bool
+}
+
+func (s *flakySink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *flakySink) Write(ctx context.Context, logs []in.AuditLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("sink down")
+	}
+	return s.AuditSink.Write(ctx, logs)
+}
+
+func TestFailedSinkKeepsChain(t *testing.T) {
+	ctx := context.Background()
+	const col = "chain_flaky"
+	if err := registry.RegisterType(in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col}); err != nil {
+		t.Fatal(err)
+	}
+	audit := memory.New()
+	sink := &flakySink{AuditSink: NewMongoSink(audit)}
+	store := memory.New(NewDefaultHookWithStore(audit).WithSinks(sink))
+
+	tests := []struct {
+		name  string
+		write func(doc *account) error
+		want  []string // events of the entries once the sink is back
+	}{
+		{
+			name: "update",
+			write: func(doc *account) error {
+				doc.Name = "b"
+				return store.Update(ctx, col, bson.M{"_id": doc.Id}, *doc)
+			},
+			want: []string{"insert", "update"},
+		},
+		{
+			name:  "delete",
+			write: func(doc *account) error { return store.DeleteOne(ctx, col, bson.M{"_id": doc.Id}) },
+			want:  []string{"insert", "delete"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := account{Id: primitive.NewObjectID(), Name: "a"}
+			if err := store.Insert(ctx, col, doc); err != nil {
+				t.Fatal(err)
+			}
+			before, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sink.setDown(true)
+			if err = tt.write(&doc); err == nil {
+				t.Fatal("write with the sink down returned no error")
+			}
+			sink.setDown(false)
+			meta, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta, before) {
+				t.Errorf("meta = %+v after the failed write, want it rolled back to %+v", meta, before)
+			}
+
+			// The next entry chains to the last written one
+			if tt.name == "delete" {
+				// The memory store deleted the document before the audit failed
+				if err = store.Insert(ctx, col, doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = tt.write(&doc); err != nil {
+				t.Fatal(err)
+			}
+			var events []string
+			for _, log := range auditEntries(t, audit, doc.Id.Hex()) {
+				events = append(events, log.AuditEvent)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("audit entries = %v, want %v", events, tt.want)
+			}
+			if issues, err := NewHistory(audit).VerifyDocument(ctx, doc.Id.Hex()); err != nil || len(issues) > 0 {
+				t.Errorf("VerifyDocument() = %v, %v, want no issues", issues, err)
+			}
+		})
+	}
+}
+
+func TestPendingEntry(t *testing.T) {
+	ctx := context.Background()
+	store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: "chain_pending"})
+	tests := []struct {
+		name    string
+		claimed time.Time // when the last entry was chained, it is not written yet
+		waits   bool
+	}{
+		{name: "being written", claimed: time.Now(), waits: true},
+		{name: "abandoned", claimed: time.Now().Add(-2 * pendingTimeout)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := account{Id: primitive.NewObjectID(), Name: "a"}
+			if err := store.Insert(ctx, "chain_pending", doc); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := findAuditLogMeta(ctx, audit, doc.Id.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := bson.M{"pending": primitive.NewDateTimeFromTime(tt.claimed)}
+			if err = audit.Update(ctx, "audit_logs_meta", bson.M{"_id": meta.Id}, pending); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error)
+			go func() {
+				doc.Name = "b"
+				done <- store.Update(ctx, "chain_pending", bson.M{"_id": doc.Id}, doc)
+			}()
+			select {
+			case err = <-done:
+				if tt.waits {
+					t.Fatalf("Update() = %v before the pending entry was written", err)
+				}
+			case <-time.After(20 * time.Millisecond):
+				if !tt.waits {
+					t.Fatal("Update waits for an abandoned entry")
+				}
+				if err = settleMeta(ctx, audit, meta.Id, meta.Version); err != nil {
+					t.Fatal(err)
+				}
+				err = <-done
+			}
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if logs := auditEntries(t, audit, doc.Id.Hex()); len(logs) != 2 || logs[1].AuditPrevHash != logs[0].AuditHash {
+				t.Errorf("audit entries = %+v, want an update chained to the insert", logs)
+			}
+		})
+	}
+}
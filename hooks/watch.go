@@ -0,0 +1,224 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	hookiedb "github.com/DeimosTech/hookie/db"
+	hookiemongo "github.com/DeimosTech/hookie/db/mongo"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// resumeTokens keeps where each ChangeWatcher is in the change stream
+const resumeTokens = "audit_resume_tokens"
+
+// ChangeWatcher audits the changes of registered collections read from MongoDB change streams, so writes
+// made without hookie's client are audited too. Entries are the ones DefaultHooks writes for stored docs,
+// and writes also audited by the hooks of a client are recorded once.
+//
+// Changes are audited once older than a grace period, so writes made through hookie's client are audited
+// by its hooks first, with their actor and request details, and the watcher then finds nothing to add.
+//
+// Update entries are computed from the doc looked up after the update, which may include later changes.
+// WithPostImages uses the exact states instead, on MongoDB 6.0+ with changeStreamPreAndPostImages enabled
+// on the collections.
+type ChangeWatcher struct {
+	conn       *hookiemongo.Mongo
+	h          *DefaultHooks
+	name       string
+	cols       []string
+	postImages bool
+	grace      time.Duration
+}
+
+// WatchOption configures a ChangeWatcher
+type WatchOption func(*ChangeWatcher)
+
+// WithWatcherName sets the name the resume token of the watcher is stored under, "default" by default.
+// Watchers following different collections need different names.
+func WithWatcherName(name string) WatchOption {
+	return func(w *ChangeWatcher) {
+		w.name = name
+	}
+}
+
+// WithWatchedCollections sets the collections to audit, the collections of the registered models by default
+func WithWatchedCollections(cols ...string) WatchOption {
+	return func(w *ChangeWatcher) {
+		w.cols = append(w.cols, cols...)
+	}
+}
+
+// WithWatcherGrace sets how old a change must be before the watcher audits it, 5 seconds by default. It
+// should exceed the time the hooks of a client take to audit a write.
+func WithWatcherGrace(grace time.Duration) WatchOption {
+	return func(w *ChangeWatcher) {
+		w.grace = grace
+	}
+}
+
+// WithPostImages requires the pre and post images of every change
+func WithPostImages() WatchOption {
+	return func(w *ChangeWatcher) {
+		w.postImages = true
+	}
+}
+
+// NewChangeWatcher returns a watcher following the database of conn and auditing its changes with h
+func NewChangeWatcher(conn *hookiemongo.Mongo, h *DefaultHooks, opts ...WatchOption) *ChangeWatcher {
+	w := &ChangeWatcher{conn: conn, h: h, name: "default", grace: 5 * time.Second}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// changeEvent holds the fields of a change stream event the watcher uses
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey              bson.M `bson:"documentKey"`
+	FullDocument             bson.M `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.M `bson:"fullDocumentBeforeChange"`
+}
+
+// Run audits changes until ctx is done or a change can not be audited. It resumes after the last change
+// audited by a watcher of the same name, or starts with the changes made from now on.
+func (w *ChangeWatcher) Run(ctx context.Context) error {
+	cols := w.cols
+	if len(cols) == 0 {
+		cols = registry.Collections()
+	}
+	if len(cols) == 0 {
+		return errors.New("hooks: no collections to watch, register models or use WithWatchedCollections")
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"ns.coll":       bson.M{"$in": cols},
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+	}}}}
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if w.postImages {
+		opts.SetFullDocument(options.Required).SetFullDocumentBeforeChange(options.Required)
+	}
+	token, err := w.loadToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+
+	stream, err := w.conn.Database.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return fmt.Errorf("could not watch changes: %w", err)
+	}
+	defer stream.Close(context.Background())
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err = stream.Decode(&event); err != nil {
+			return fmt.Errorf("could not read change: %w", err)
+		}
+		if !w.settle(ctx, event) {
+			return nil
+		}
+		if err = w.audit(ctx, event); err != nil {
+			return fmt.Errorf("could not audit %s of %s: %w", event.OperationType, event.Ns.Coll, err)
+		}
+		if err = w.saveToken(ctx, stream.ResumeToken()); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// settle waits until event is older than the grace period of the watcher. It reports false when ctx is
+// done first.
+func (w *ChangeWatcher) settle(ctx context.Context, event changeEvent) bool {
+	wait := time.Until(time.Unix(int64(event.ClusterTime.T), 0).Add(w.grace))
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// audit records event like the hooks record the write that made it
+func (w *ChangeWatcher) audit(ctx context.Context, event changeEvent) error {
+	// The write may have been audited by the hooks of a client already
+	ctx = hookiedb.WithRedelivery(ctx)
+	col := event.Ns.Coll
+	docId := changeDocId(event.DocumentKey["_id"])
+	switch event.OperationType {
+	case "insert":
+		return w.h.PostSave(ctx, in.Document(event.FullDocument), nil, col, "insert", docId)
+	case "update", "replace":
+		if event.FullDocument == nil {
+			// Deleted before it could be looked up, the delete is audited on its own
+			return nil
+		}
+		return w.h.PostSave(ctx, in.Document(event.FullDocument), nil, col, "update", docId)
+	case "delete":
+		doc := event.FullDocumentBeforeChange
+		if doc == nil {
+			doc = event.DocumentKey
+		}
+		return w.h.PostDelete(ctx, in.Document(doc), nil, col, docId)
+	}
+	return nil
+}
+
+// resumeToken is the position of a watcher in the change stream
+type resumeToken struct {
+	Id        string    `bson:"_id"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+func (w *ChangeWatcher) loadToken(ctx context.Context) (bson.Raw, error) {
+	var token resumeToken
+	err := w.conn.Database.Collection(resumeTokens).FindOne(ctx, bson.M{"_id": w.name}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not load resume token: %w", err)
+	}
+	return token.Token, nil
+}
+
+func (w *ChangeWatcher) saveToken(ctx context.Context, token bson.Raw) error {
+	update := bson.M{"$set": bson.M{"token": token, "updated_at": time.Now()}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := w.conn.Database.Collection(resumeTokens).UpdateOne(ctx, bson.M{"_id": w.name}, update, opts); err != nil {
+		return fmt.Errorf("could not save resume token: %w", err)
+	}
+	return nil
+}
+
+// changeDocId converts the _id of a changed doc to the string form used by the hooks
+func changeDocId(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprintf("%v", id)
+}
@@ -0,0 +1,117 @@
+package hooks
+
+import (
+	"context"
+	"github.com/DeimosTech/hookie/db/memory"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+// storedDoc returns doc as the change stream reports it
+func storedDoc(t *testing.T, store *memory.Memory, col string, id primitive.ObjectID) bson.M {
+	t.Helper()
+	var doc bson.M
+	if err := store.FindOne(context.Background(), col, bson.M{"_id": id}, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestChangeWatcherAuditsOnce(t *testing.T) {
+	const col = "watch_accounts"
+	actor := in.Actor{UserID: "u1", UserType: "admin"}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store *memory.Memory, w *ChangeWatcher, id primitive.ObjectID)
+		want []string // event and user of each entry
+	}{
+		{
+			name: "client before watcher",
+			run: func(t *testing.T, store *memory.Memory, w *ChangeWatcher, id primitive.ObjectID) {
+				ctx := in.WithActor(context.Background(), actor)
+				if err := store.Insert(ctx, col, account{Id: id, Name: "a"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Update(ctx, col, bson.M{"_id": id}, account{Id: id, Name: "b"}); err != nil {
+					t.Fatal(err)
+				}
+				doc := storedDoc(t, store, col, id)
+				for _, op := range []string{"insert", "update"} {
+					event := changeEvent{OperationType: op, DocumentKey: bson.M{"_id": id}, FullDocument: doc}
+					event.Ns.Coll = col
+					if err := w.audit(context.Background(), event); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			want: []string{"insert u1", "update u1"},
+		},
+		{
+			name: "watcher before client",
+			run: func(t *testing.T, store *memory.Memory, w *ChangeWatcher, id primitive.ObjectID) {
+				doc := bson.M{"_id": id, "name": "a", "count": int32(0), "address": bson.M{"city": "", "lines": nil}}
+				event := changeEvent{OperationType: "insert", DocumentKey: bson.M{"_id": id}, FullDocument: doc}
+				event.Ns.Coll = col
+				if err := w.audit(context.Background(), event); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Insert(in.WithActor(context.Background(), actor), col, account{Id: id, Name: "a"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"insert "},
+		},
+		{
+			name: "inserted again after delete",
+			run: func(t *testing.T, store *memory.Memory, w *ChangeWatcher, id primitive.ObjectID) {
+				ctx := in.WithActor(context.Background(), actor)
+				if err := store.Insert(ctx, col, account{Id: id, Name: "a"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.DeleteOne(ctx, col, bson.M{"_id": id}); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Insert(ctx, col, account{Id: id, Name: "b"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"insert u1", "delete u1", "insert u1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, audit := newAuditedStore(t, in.ModelConfig{Type: reflect.TypeOf(account{}), Collection: col})
+			w := NewChangeWatcher(nil, NewDefaultHookWithStore(audit))
+			id := primitive.NewObjectID()
+			tt.run(t, store, w, id)
+
+			if n, err := audit.Count(context.Background(), "audit_logs_meta", bson.M{"document_current_state._id": id.Hex()}); err != nil || n != 1 {
+				t.Fatalf("got %d audit metas, %v, want 1", n, err)
+			}
+			var got []string
+			for _, log := range auditEntries(t, audit, id.Hex()) {
+				got = append(got, log.AuditEvent+" "+log.UserID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("audit entries = %v, want %v", got, tt.want)
+			}
+			history := NewHistory(audit)
+			issues, err := history.VerifyDocument(context.Background(), id.Hex())
+			if err != nil || len(issues) > 0 {
+				t.Errorf("VerifyDocument() = %v, %v, want no issues", issues, err)
+			}
+			versions, err := history.Versions(context.Background(), id.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range versions {
+				if (v.Event == "delete") != (v.State == nil) {
+					t.Errorf("version %d, a %s, has state %v", v.Number, v.Event, v.State)
+				}
+			}
+		})
+	}
+}
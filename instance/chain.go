@@ -0,0 +1,241 @@
+package in
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrStopChain can be returned by a hook to skip the remaining hooks of the chain without failing the operation
+var ErrStopChain = errors.New("hook: stop chain")
+
+// ErrDropResult can be returned by PostFind to leave a document out of the results of a read
+var ErrDropResult = errors.New("hook: drop result")
+
+// NopHook implements Hook with no-op methods, embed it to only implement the hooks you need
+type NopHook struct{}
+
+func (NopHook) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return nil
+}
+
+func (NopHook) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return nil
+}
+
+func (NopHook) PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return nil
+}
+
+func (NopHook) PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return nil
+}
+
+// Chain runs several hooks as one, ordered by priority.
+//
+// Pre hooks run until the first error, which aborts the operation. Post hooks all run and their errors
+// are joined, since the write has already happened. In both cases ErrStopChain ends the chain early
+// without reporting an error.
+type Chain struct {
+	mu    sync.RWMutex
+	links []link
+	seq   int
+}
+
+type link struct {
+	hook     Hook
+	priority int
+	seq      int
+	cols     map[string]bool
+	ops      map[string]bool
+}
+
+// LinkOption configures a hook registered on a Chain
+type LinkOption func(*link)
+
+// WithPriority sets the priority of a hook, lower priorities run first. Hooks with the same priority
+// run in registration order.
+func WithPriority(priority int) LinkOption {
+	return func(l *link) {
+		l.priority = priority
+	}
+}
+
+// ForCollections only runs the hook for the given collections
+func ForCollections(cols ...string) LinkOption {
+	return func(l *link) {
+		l.cols = toSet(cols)
+	}
+}
+
+// ForOps only runs the hook for the given operations: "insert", "update" or "delete", and "findOne", "list"
+// or "aggregate" for the find hooks
+func ForOps(ops ...string) LinkOption {
+	return func(l *link) {
+		l.ops = toSet(ops)
+	}
+}
+
+// NewChain returns a chain running hooks in the given order
+func NewChain(hooks ...Hook) *Chain {
+	c := &Chain{}
+	for _, h := range hooks {
+		c.Use(h)
+	}
+	return c
+}
+
+// Use adds h to the chain
+func (c *Chain) Use(h Hook, opts ...LinkOption) *Chain {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := link{hook: h, seq: c.seq}
+	c.seq++
+	for _, opt := range opts {
+		opt(&l)
+	}
+	c.links = append(c.links, l)
+	sort.SliceStable(c.links, func(i, j int) bool {
+		if c.links[i].priority != c.links[j].priority {
+			return c.links[i].priority < c.links[j].priority
+		}
+		return c.links[i].seq < c.links[j].seq
+	})
+	return c
+}
+
+// Len returns the number of hooks in the chain
+func (c *Chain) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.links)
+}
+
+func (c *Chain) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return c.runPre(col, ops, func(h Hook) error {
+		return h.PreSave(ctx, model, filter, col, ops, docId)
+	})
+}
+
+func (c *Chain) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return c.runPost(col, ops, func(h Hook) error {
+		return h.PostSave(ctx, model, filter, col, ops, docId)
+	})
+}
+
+func (c *Chain) PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return c.runPre(col, "delete", func(h Hook) error {
+		return h.PreDelete(ctx, model, filter, col, docId)
+	})
+}
+
+func (c *Chain) PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return c.runPost(col, "delete", func(h Hook) error {
+		return h.PostDelete(ctx, model, filter, col, docId)
+	})
+}
+
+// PreFind runs the hooks implementing PreFindHook, each receiving the filter returned by the previous one
+func (c *Chain) PreFind(ctx context.Context, filter interface{}, col, ops string) (interface{}, error) {
+	for _, l := range c.matching(col, ops) {
+		hook, ok := l.hook.(PreFindHook)
+		if !ok {
+			continue
+		}
+		next, err := hook.PreFind(ctx, filter, col, ops)
+		if err != nil {
+			if errors.Is(err, ErrStopChain) {
+				return filter, nil
+			}
+			return nil, err
+		}
+		filter = next
+	}
+	return filter, nil
+}
+
+// PostFind runs the hooks implementing PostFindHook until one drops doc or fails
+func (c *Chain) PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error {
+	for _, l := range c.matching(col, ops) {
+		hook, ok := l.hook.(PostFindHook)
+		if !ok {
+			continue
+		}
+		if err := hook.PostFind(ctx, doc, filter, col, ops); err != nil {
+			if errors.Is(err, ErrStopChain) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// PostRead runs the hooks implementing PostReadHook, joining their errors
+func (c *Chain) PostRead(ctx context.Context, result interface{}, filter interface{}, col, ops string) error {
+	var errs []error
+	for _, l := range c.matching(col, ops) {
+		hook, ok := l.hook.(PostReadHook)
+		if !ok {
+			continue
+		}
+		if err := hook.PostRead(ctx, result, filter, col, ops); err != nil {
+			if errors.Is(err, ErrStopChain) {
+				break
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Chain) runPre(col, ops string, call func(Hook) error) error {
+	for _, l := range c.matching(col, ops) {
+		if err := call(l.hook); err != nil {
+			if errors.Is(err, ErrStopChain) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chain) runPost(col, ops string, call func(Hook) error) error {
+	var errs []error
+	for _, l := range c.matching(col, ops) {
+		if err := call(l.hook); err != nil {
+			if errors.Is(err, ErrStopChain) {
+				break
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matching returns the hooks registered for col and ops, in the order they should run
+func (c *Chain) matching(col, ops string) []link {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	links := make([]link, 0, len(c.links))
+	for _, l := range c.links {
+		if l.cols != nil && !l.cols[col] {
+			continue
+		}
+		if l.ops != nil && !l.ops[ops] {
+			continue
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
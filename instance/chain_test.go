@@ -0,0 +1,219 @@
+package in
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// step is a hook appending its name to run when called, and returning err
+type step struct {
+	NopHook
+	name string
+	run  *[]string
+	err  error
+}
+
+func (s step) call() error {
+	*s.run = append(*s.run, s.name)
+	return s.err
+}
+
+func (s step) PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return s.call()
+}
+
+func (s step) PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error {
+	return s.call()
+}
+
+func (s step) PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return s.call()
+}
+
+func (s step) PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error {
+	return s.call()
+}
+
+// PreFind appends the name of the step to the filter, a slice of the names of the steps run so far
+func (s step) PreFind(ctx context.Context, filter interface{}, col, ops string) (interface{}, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return append(filter.([]string), s.name), nil
+}
+
+func (s step) PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error {
+	return s.call()
+}
+
+func (s step) PostRead(ctx context.Context, result interface{}, filter interface{}, col, ops string) error {
+	return s.call()
+}
+
+func TestChainOrder(t *testing.T) {
+	var run []string
+	c := NewChain(step{name: "a", run: &run})
+	c.Use(step{name: "late", run: &run}, WithPriority(10))
+	c.Use(step{name: "early", run: &run}, WithPriority(-1))
+	c.Use(step{name: "b", run: &run})
+	c.Use(step{name: "late2", run: &run}, WithPriority(10))
+	if err := c.PreSave(context.Background(), nil, nil, "items", "insert", ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"early", "a", "b", "late", "late2"}; !reflect.DeepEqual(run, want) {
+		t.Errorf("hooks ran in order %v, want %v", run, want)
+	}
+	if c.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", c.Len())
+	}
+}
+
+func TestChainFilters(t *testing.T) {
+	var run []string
+	c := NewChain()
+	c.Use(step{name: "all", run: &run})
+	c.Use(step{name: "items", run: &run}, ForCollections("items"))
+	c.Use(step{name: "deletes", run: &run}, ForOps("delete"))
+	c.Use(step{name: "item lists", run: &run}, ForCollections("items", "archive"), ForOps("list"))
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		call func() error
+		want []string
+	}{
+		{"insert into items", func() error { return c.PostSave(ctx, nil, nil, "items", "insert", "") }, []string{"all", "items"}},
+		{"update of users", func() error { return c.PreSave(ctx, nil, nil, "users", "update", "") }, []string{"all"}},
+		{"delete from users", func() error { return c.PostDelete(ctx, nil, nil, "users", "") }, []string{"all", "deletes"}},
+		{"delete from items", func() error { return c.PreDelete(ctx, nil, nil, "items", "") }, []string{"all", "items", "deletes"}},
+		{"list of archive", func() error { return c.PostFind(ctx, nil, nil, "archive", "list") }, []string{"all", "item lists"}},
+		{"findOne of archive", func() error { return c.PostRead(ctx, nil, nil, "archive", "findOne") }, []string{"all"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run = nil
+			if err := tt.call(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(run, tt.want) {
+				t.Errorf("hooks run = %v, want %v", run, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainErrors(t *testing.T) {
+	ctx := context.Background()
+	failed, other := errors.New("failed"), errors.New("other")
+	tests := []struct {
+		name string
+		errs []error // of the hooks of the chain, in order
+		call func(c *Chain) error
+		want []error // matched by the returned error, nil when it must be nil
+		run  int     // hooks run
+	}{
+		{
+			name: "pre hook error aborts",
+			errs: []error{nil, failed, nil},
+			call: func(c *Chain) error { return c.PreSave(ctx, nil, nil, "items", "insert", "") },
+			want: []error{failed},
+			run:  2,
+		},
+		{
+			name: "pre hook stops the chain",
+			errs: []error{ErrStopChain, failed},
+			call: func(c *Chain) error { return c.PreDelete(ctx, nil, nil, "items", "") },
+			run:  1,
+		},
+		{
+			name: "post hook errors are joined",
+			errs: []error{failed, nil, other},
+			call: func(c *Chain) error { return c.PostSave(ctx, nil, nil, "items", "update", "") },
+			want: []error{failed, other},
+			run:  3,
+		},
+		{
+			name: "post hook stops the chain",
+			errs: []error{failed, ErrStopChain, other},
+			call: func(c *Chain) error { return c.PostDelete(ctx, nil, nil, "items", "") },
+			want: []error{failed},
+			run:  2,
+		},
+		{
+			name: "dropped result",
+			errs: []error{nil, ErrDropResult, nil},
+			call: func(c *Chain) error { return c.PostFind(ctx, nil, nil, "items", "list") },
+			want: []error{ErrDropResult},
+			run:  2,
+		},
+		{
+			name: "find hook stops the chain",
+			errs: []error{ErrStopChain, ErrDropResult},
+			call: func(c *Chain) error { return c.PostFind(ctx, nil, nil, "items", "findOne") },
+			run:  1,
+		},
+		{
+			name: "read hook errors are joined",
+			errs: []error{failed, other, ErrStopChain, nil},
+			call: func(c *Chain) error { return c.PostRead(ctx, nil, nil, "items", "list") },
+			want: []error{failed, other},
+			run:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var run []string
+			c := NewChain()
+			for _, err := range tt.errs {
+				c.Use(step{name: "step", run: &run, err: err})
+			}
+			err := tt.call(c)
+			if tt.want == nil && err != nil {
+				t.Errorf("got %v, want nil", err)
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("got %v, want it to match %v", err, want)
+				}
+			}
+			if errors.Is(err, ErrStopChain) {
+				t.Errorf("ErrStopChain was returned in %v", err)
+			}
+			if len(run) != tt.run {
+				t.Errorf("%d hooks ran, want %d", len(run), tt.run)
+			}
+		})
+	}
+}
+
+func TestChainPreFind(t *testing.T) {
+	ctx := context.Background()
+	failed := errors.New("failed")
+	tests := []struct {
+		name string
+		errs []error
+		want interface{}
+		err  error
+	}{
+		{name: "filter passed along", errs: []error{nil, nil}, want: []string{"0", "1"}},
+		{name: "stopped chain keeps the filter so far", errs: []error{nil, ErrStopChain, nil}, want: []string{"0"}},
+		{name: "error", errs: []error{failed, nil}, err: failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var run []string
+			c := NewChain()
+			for i, err := range tt.errs {
+				c.Use(step{name: string(rune('0' + i)), run: &run, err: err})
+			}
+			filter, err := c.PreFind(ctx, []string{}, "items", "list")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("PreFind() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("PreFind() = %v, want %v", filter, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package in
+
+import "context"
+
+// Actor is the user on whose behalf a change is made
+type Actor struct {
+	UserID   string
+	UserType string
+}
+
+// RequestInfo describes the request during which a change is made
+type RequestInfo struct {
+	IPAddress string
+	UserAgent string
+	URL       string // without the query
+	RequestID string
+}
+
+type ctxKey int
+
+const (
+	actorKey ctxKey = iota
+	requestInfoKey
+)
+
+// WithActor returns a copy of ctx carrying actor, recorded on the audit logs of writes made with it
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// ActorFrom returns the actor stored in ctx
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	actor, ok := ctx.Value(actorKey).(Actor)
+	return actor, ok
+}
+
+// WithRequestInfo returns a copy of ctx carrying info, recorded on the audit logs of writes made with it
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// RequestInfoFrom returns the request info stored in ctx
+func RequestInfoFrom(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey).(RequestInfo)
+	return info, ok
+}
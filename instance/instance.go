@@ -3,45 +3,156 @@ package in
 import (
 	"context"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
 	"time"
 )
 
 // Hook interface for custom hooks
 type Hook interface {
-	PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string)
-	PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string)
+	PreSaveHook
+	PostSaveHook
+	PreDeleteHook
+	PostDeleteHook
+}
+
+// PreSaveHook is implemented by models that run their own logic before a save.
+// Returning an error aborts the save.
+type PreSaveHook interface {
+	PreSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error
+}
+
+// PostSaveHook is implemented by models that run their own logic after a save
+type PostSaveHook interface {
+	PostSave(ctx context.Context, model interface{}, filter interface{}, col, ops, docId string) error
+}
+
+// PreDeleteHook is called with the stored document before it is removed.
+// Returning an error aborts the delete.
+type PreDeleteHook interface {
+	PreDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error
+}
+
+// PostDeleteHook is called with the stored document after it has been removed
+type PostDeleteHook interface {
+	PostDelete(ctx context.Context, model interface{}, filter interface{}, col, docId string) error
+}
+
+// PreFindHook is implemented by hooks and models that run before a read, ops being "findOne", "list" or
+// "aggregate". It returns the filter to query with, or the pipeline for aggregate, which may be rewritten.
+// Returning an error aborts the read.
+type PreFindHook interface {
+	PreFind(ctx context.Context, filter interface{}, col, ops string) (interface{}, error)
+}
+
+// PostFindHook is implemented by hooks and models that run on every document read. doc is a pointer to
+// the decoded document, which can be changed in place. Returning ErrDropResult leaves it out of the results,
+// other errors abort the read.
+type PostFindHook interface {
+	PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error
+}
+
+// PostReadHook is implemented by hooks that run once after a read, result pointing to the decoded document,
+// or to the slice of documents for "list", without those dropped by PostFind
+type PostReadHook interface {
+	PostRead(ctx context.Context, result interface{}, filter interface{}, col, ops string) error
 }
 
 type Inject struct {
 }
 
+// Document is a document as stored in the database. It is the model passed to the delete hooks, and to
+// PostSave by the update paths that accept arbitrary update operators.
+type Document map[string]interface{}
+
 type Test struct {
 	*Inject
 	Id   string
 	Name string
 }
 
+// ModelConfig holds the audit settings of a model registered with hookie.Register.
+// Field names are the keys of the stored document.
+type ModelConfig struct {
+	Type         reflect.Type
+	Collection   string           // collection the model is stored in
+	Fields       []string         // audited fields, all fields when empty
+	Redact       []string         // fields whose values are never written to audit storage
+	Ignore       []string         // fields left out of audit storage entirely
+	TrackOnly    []string         // fields whose changes alone do not create an audit entry
+	AccessLog    *AccessLogConfig // reads are logged when set
+	SoftDelete   string           // field set on deleted documents instead of removing them, when not empty
+	VersionField string           // field Update checks and increments, when not empty
+}
+
+// AccessLogConfig holds the settings of read access logging
+type AccessLogConfig struct {
+	SampleRate  float64       // fraction of reads logged, all of them when 0
+	DedupWindow time.Duration // reads of the same documents by the same actor are logged once per window
+}
+
 type AuditLogMeta struct {
 	Id                   primitive.ObjectID     `json:"id,omitempty" bson:"_id,omitempty"`
 	DocumentCurrentState map[string]interface{} `json:"document_current_state,omitempty" bson:"document_current_state,omitempty"`
+	Version              int64                  `json:"version,omitempty" bson:"version,omitempty"`         // version of the last audit entry
+	LastHash             string                 `json:"last_hash,omitempty" bson:"last_hash,omitempty"`     // hash of the last audit entry
+	Digests              map[string]string      `json:"digests,omitempty" bson:"digests,omitempty"`         // digests of redacted and masked values, by path
+	DigestSalt           string                 `json:"digest_salt,omitempty" bson:"digest_salt,omitempty"` // random key of the digests
+	Deleted              bool                   `json:"deleted,omitempty" bson:"deleted,omitempty"`         // whether the delete of the document was recorded
+	Pending              primitive.DateTime     `json:"pending,omitempty" bson:"pending,omitempty"`         // when the last entry was chained, until it is written
 }
 
 type AuditLog struct {
-	Id             primitive.ObjectID     `json:"id,omitempty" bson:"_id,omitempty"`
-	AuditMetaId    string                 `json:"audit_meta_id,omitempty" bson:"audit_meta_id,omitempty"`
-	AuditEvent     string                 `json:"audit_event,omitempty" bson:"audit_event,omitempty"`
-	AuditURL       string                 `json:"audit_url,omitempty" bson:"audit_url,omitempty"`
-	AuditIPAddress string                 `json:"audit_ip_address,omitempty" bson:"audit_ip_address,omitempty"`
-	AuditUserAgent string                 `json:"audit_user_agent,omitempty" bson:"audit_user_agent,omitempty"`
-	AuditTags      []string               `json:"audit_tags,omitempty" bson:"audit_tags,omitempty"`
-	AuditCreatedAt *time.Time             `json:"audit_created_at,omitempty" bson:"audit_created_at,omitempty"`
-	AuditUpdatedAt *time.Time             `json:"audit_updated_at,omitempty" bson:"audit_updated_at,omitempty"`
-	UserID         string                 `json:"user_id,omitempty" bson:"user_id,omitempty"`
-	UserType       string                 `json:"user_type,omitempty" bson:"user_type,omitempty"`
-	Change         map[string]AuditChange `json:"change,omitempty" bson:"change,omitempty"`
+	Id             primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	AuditMetaId    string             `json:"audit_meta_id,omitempty" bson:"audit_meta_id,omitempty"`
+	AuditVersion   int64              `json:"audit_version,omitempty" bson:"audit_version,omitempty"`     // sequence number in the chain of the document, from 1
+	AuditPrevHash  string             `json:"audit_prev_hash,omitempty" bson:"audit_prev_hash,omitempty"` // hash of the previous entry of the document
+	AuditHash      string             `json:"audit_hash,omitempty" bson:"audit_hash,omitempty"`           // hash of this entry, covering every other field but the signature
+	AuditKeyId     string             `json:"audit_key_id,omitempty" bson:"audit_key_id,omitempty"`       // key the entry was signed with
+	AuditSignature string             `json:"audit_signature,omitempty" bson:"audit_signature,omitempty"` // base64 signature of the hash
+	AuditEvent     string             `json:"audit_event,omitempty" bson:"audit_event,omitempty"`
+	AuditURL       string             `json:"audit_url,omitempty" bson:"audit_url,omitempty"`
+	AuditIPAddress string             `json:"audit_ip_address,omitempty" bson:"audit_ip_address,omitempty"`
+	AuditUserAgent string             `json:"audit_user_agent,omitempty" bson:"audit_user_agent,omitempty"`
+	AuditRequestId string             `json:"audit_request_id,omitempty" bson:"audit_request_id,omitempty"`
+	AuditTags      []string           `json:"audit_tags,omitempty" bson:"audit_tags,omitempty"`
+	AuditCreatedAt *time.Time         `json:"audit_created_at,omitempty" bson:"audit_created_at,omitempty"`
+	AuditUpdatedAt *time.Time         `json:"audit_updated_at,omitempty" bson:"audit_updated_at,omitempty"`
+	UserID         string             `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	UserType       string             `json:"user_type,omitempty" bson:"user_type,omitempty"`
+	Change         []AuditChange      `json:"change,omitempty" bson:"change,omitempty"`           // ordered by path
+	DocVersion     int64              `json:"doc_version,omitempty" bson:"doc_version,omitempty"` // version the entry leaves a versioned document at
+}
+
+// AccessLog records a read of documents whose model has access logging enabled
+type AccessLog struct {
+	Id               primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	AccessEvent      string             `json:"access_event,omitempty" bson:"access_event,omitempty"`
+	AccessOperation  string             `json:"access_operation,omitempty" bson:"access_operation,omitempty"` // findOne or list
+	AccessCol        string             `json:"access_col,omitempty" bson:"access_col,omitempty"`
+	AccessFilter     interface{}        `json:"access_filter,omitempty" bson:"access_filter,omitempty"`
+	AccessDocIds     []string           `json:"access_doc_ids,omitempty" bson:"access_doc_ids,omitempty"`         // documents returned
+	AccessSampleRate float64            `json:"access_sample_rate,omitempty" bson:"access_sample_rate,omitempty"` // set when only a fraction of reads is logged
+	AccessURL        string             `json:"access_url,omitempty" bson:"access_url,omitempty"`
+	AccessIPAddress  string             `json:"access_ip_address,omitempty" bson:"access_ip_address,omitempty"`
+	AccessUserAgent  string             `json:"access_user_agent,omitempty" bson:"access_user_agent,omitempty"`
+	AccessRequestId  string             `json:"access_request_id,omitempty" bson:"access_request_id,omitempty"`
+	AccessCreatedAt  *time.Time         `json:"access_created_at,omitempty" bson:"access_created_at,omitempty"`
+	UserID           string             `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	UserType         string             `json:"user_type,omitempty" bson:"user_type,omitempty"`
 }
 
+// Kinds of AuditChange
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// AuditChange is the change of the single value at Path, such as "address.city" or "tags[2]". Paths are
+// kept as values rather than keys, as MongoDB can not query keys holding dots.
 type AuditChange struct {
-	Old string `json:"old,omitempty" bson:"old,omitempty"`
-	New string `json:"new,omitempty" bson:"new,omitempty"`
+	Path string      `json:"path,omitempty" bson:"path,omitempty"`
+	Type string      `json:"type,omitempty" bson:"type,omitempty"`
+	Old  interface{} `json:"old,omitempty" bson:"old,omitempty"`
+	New  interface{} `json:"new,omitempty" bson:"new,omitempty"`
 }
@@ -0,0 +1,43 @@
+package hook
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"text/template"
+)
+
+var genTemplate = template.Must(template.New("gen").Parse(`// Code generated by hookie gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import "github.com/DeimosTech/hookie"
+
+func init() {
+	hookie.RegisterGenerated(
+{{- range .Models}}
+		{{printf "%q" .Key}}, // {{.PkgPath}}.{{.Name}} {{.Reason}}
+{{- end}}
+	)
+}
+`))
+
+// Generate writes a Go file for package pkgName that registers models at init
+func Generate(w io.Writer, pkgName string, models []Model) error {
+	sorted := dedupeModels(append([]Model(nil), models...))
+	var buf bytes.Buffer
+	err := genTemplate.Execute(&buf, struct {
+		Package string
+		Models  []Model
+	}{pkgName, sorted})
+	if err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not format generated code: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
@@ -0,0 +1,42 @@
+package hook
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	models := []Model{
+		{PkgPath: "example.com/app/users", Name: "User", Reason: "embeds instance.Inject"},
+		{PkgPath: "example.com/app/orders", Name: "Page[example.com/app/orders.Order]", Reason: "embeds Base -> instance.Inject"},
+		{PkgPath: "example.com/app/users", Name: "User", Reason: "embeds instance.Inject"},
+	}
+	var buf bytes.Buffer
+	if err := Generate(&buf, "main", models); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := `// Code generated by hookie gen. DO NOT EDIT.
+
+package main
+
+import "github.com/DeimosTech/hookie"
+
+func init() {
+	hookie.RegisterGenerated(
+		"example.com/app/ordersPage[example.com/app/orders.Order]", // example.com/app/orders.Page[example.com/app/orders.Order] embeds Base -> instance.Inject
+		"example.com/app/usersUser",                                // example.com/app/users.User embeds instance.Inject
+	)
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Generate() =\n%s\nwant\n%s", got, want)
+	}
+	if models[0].Name != "User" {
+		t.Errorf("Generate reordered the models passed in")
+	}
+
+	buf.Reset()
+	if err := Generate(&buf, "main", nil); err != nil {
+		t.Fatalf("Generate without models: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+// Package generic holds generic structs embedding in.Inject, which are models once instantiated
+package generic
+
+import (
+	in "github.com/DeimosTech/hookie/instance"
+)
+
+// Page is a model for each type it is instantiated with
+type Page[T any] struct {
+	in.Inject
+	Items []T
+}
+
+// Item is not a model
+type Item struct {
+	Name string
+}
+
+// Envelope embeds in.Inject through the generic Page
+type Envelope struct {
+	Page[int]
+}
+
+var items Page[Item]
@@ -0,0 +1,49 @@
+// Package models holds structs embedding in.Inject in the ways the scanner must recognise, and structs it
+// must not mistake for models
+package models
+
+import (
+	hookin "github.com/DeimosTech/hookie/instance"
+)
+
+// Aliased embeds in.Inject imported under another name
+type Aliased struct {
+	hookin.Inject
+	Name string
+}
+
+// Pointer embeds a pointer to in.Inject
+type Pointer struct {
+	*hookin.Inject
+}
+
+// Inject is unrelated to in.Inject
+type Inject struct{}
+
+// Lookalike embeds a type named Inject that is not in.Inject
+type Lookalike struct {
+	Inject
+}
+
+// Named holds in.Inject in a field without embedding it
+type Named struct {
+	Audit hookin.Inject
+}
+
+// Base is embedded by Derived
+type Base struct {
+	hookin.Inject
+}
+
+// Derived embeds in.Inject through Base
+type Derived struct {
+	Base
+}
+
+// Deep embeds in.Inject through a pointer to Derived
+type Deep struct {
+	*Derived
+}
+
+// Alias is another name of Aliased, not a model of its own
+type Alias = Aliased
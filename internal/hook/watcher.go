@@ -3,125 +3,188 @@ package hook
 import (
 	"context"
 	"fmt"
-	"go/ast"
-	"go/token"
 	"go/types"
 	"golang.org/x/mod/modfile"
 	"golang.org/x/tools/go/packages"
-	"log"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 )
 
-// WatchAndInjectHooks finds structs with hookie.Inject and calls their hooks
-func WatchAndInjectHooks(ctx context.Context, rootDir string) error {
-	goDirs, err := collectGoDirs("./")
+// instancePkgPath is the package of in.Inject
+const instancePkgPath = "github.com/DeimosTech/hookie/instance"
+
+// Model is a struct found to embed in.Inject
+type Model struct {
+	PkgPath string
+	Name    string
+	Reason  string // how the struct embeds in.Inject
+}
+
+// Key returns the key the model is registered under
+func (m Model) Key() string {
+	return m.PkgPath + m.Name
+}
+
+// DiscoverModels finds structs with hookie.Inject in every package of the module at rootDir
+func DiscoverModels(ctx context.Context, rootDir string) ([]Model, error) {
+	goDirs, err := collectGoDirs(rootDir)
 	if err != nil {
-		log.Fatalf("Error collecting Go directories: %v", err)
+		return nil, fmt.Errorf("error collecting Go directories: %v", err)
 	}
-	moduleName, err := getGoModuleName("./")
+	moduleName, err := getGoModuleName(rootDir)
 	if err != nil {
-		log.Fatalf("Error getting Go module name: %v", err)
+		return nil, fmt.Errorf("error getting Go module name: %v", err)
 	}
+	var models []Model
 	for _, dir := range goDirs {
-		path := filepath.Join(moduleName, dir)
-		err = WatchAndRegister(ctx, path)
+		rel, err := filepath.Rel(rootDir, dir)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
+		found, err := discoverPackage(ctx, rootDir, path.Join(moduleName, filepath.ToSlash(rel)))
+		if err != nil {
+			slog.Default().Warn(err.Error())
+		}
+		models = append(models, found...)
 	}
-	return nil
+	return dedupeModels(models), nil
 }
 
-// WatchAndRegister finds structs with hookie.Inject and calls their hooks
-func WatchAndRegister(ctx context.Context, dir string) error {
+// discoverPackage finds structs with hookie.Inject in the package pkgPath, resolved from dir
+func discoverPackage(ctx context.Context, dir, pkgPath string) (models []Model, err error) {
 	_log := slog.Default()
 	cfg := &packages.Config{
-		Mode: packages.NeedSyntax | packages.NeedTypes | packages.NeedImports,
+		Context: ctx,
+		Dir:     dir,
+		Mode:    packages.NeedName | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps,
 	}
 
 	// Handle the panic gracefully
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic:", r)
+			err = fmt.Errorf("recovered from panic: %v", r)
 		}
 	}()
 
-	_packages, err := packages.Load(cfg, dir)
+	_packages, err := packages.Load(cfg, pkgPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	for _, pkg := range _packages {
-		for _, file := range pkg.Syntax {
-			// Inspect the AST
-			for _, decl := range file.Decls {
-				if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.TYPE {
-					for _, spec := range genDecl.Specs {
-						typeSpec := spec.(*ast.TypeSpec)
-						if structType, ok := typeSpec.Type.(*ast.StructType); ok {
-							if isInjectable(structType) {
-								structName := typeSpec.Name.Name
-								_log.Info(fmt.Sprintf("Found injectable struct: %s in package: %s", structName, pkg.PkgPath))
-
-								// Get the full type from the types package
-								obj := pkg.Types.Scope().Lookup(structName)
-								if obj == nil {
-									return fmt.Errorf("could not find type for struct: %s", structName)
-								}
-
-								// Ensure the object is of type *types.Named
-								if t, ok := obj.Type().(*types.Named); ok && t != nil {
-									RegisterModel(pkg.ID + structName)
-								}
-							}
-						}
+		if pkg.Types == nil {
+			continue
+		}
+		// Package level structs
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || obj.IsAlias() {
+				continue
+			}
+			named, ok := obj.Type().(*types.Named)
+			if !ok || named.TypeParams().Len() > 0 {
+				// Generic types are registered through their instantiations below
+				continue
+			}
+			if m, ok := injectableModel(named); ok {
+				models = append(models, m)
+			}
+		}
+		// Instantiations of generic structs, registered under the package of the generic type
+		if pkg.TypesInfo != nil {
+			for _, inst := range pkg.TypesInfo.Instances {
+				if named, ok := inst.Type.(*types.Named); ok {
+					if m, ok := injectableModel(named); ok {
+						models = append(models, m)
 					}
 				}
 			}
 		}
 	}
-	return nil
+	models = dedupeModels(models)
+	for _, m := range models {
+		_log.Info(fmt.Sprintf("Found injectable struct: %s in package: %s (%s)", m.Name, m.PkgPath, m.Reason))
+	}
+	return models, nil
 }
 
-// isInjectable checks if the struct has the hookie.Inject embedded type
-func isInjectable(structType *ast.StructType) bool {
+// injectableModel returns the model for named when it is a struct embedding in.Inject
+func injectableModel(named *types.Named) (Model, bool) {
+	if _, ok := named.Underlying().(*types.Struct); !ok || named.Obj().Pkg() == nil {
+		return Model{}, false
+	}
+	path, ok := injectPath(named, make(map[types.Type]bool))
+	if !ok {
+		return Model{}, false
+	}
+	pkgPath := named.Obj().Pkg().Path()
+	return Model{
+		PkgPath: pkgPath,
+		// Matches reflect.Type.Name, which includes the type arguments of generic types
+		Name:   strings.TrimPrefix(types.TypeString(named, nil), pkgPath+"."),
+		Reason: "embeds " + strings.Join(path, " -> "),
+	}, true
+}
 
-	for _, field := range structType.Fields.List {
-		// Check if the field is a type
-		if selExpr, ok := field.Type.(*ast.SelectorExpr); ok {
-			pkgIdent, ok := selExpr.X.(*ast.Ident)
-			if ok && pkgIdent.Name == "in" && selExpr.Sel.Name == "Inject" {
-				// Found a field of type instance.Inject
-				return true
-			}
+// injectPath returns the embedded fields through which t embeds in.Inject, following embedded structs
+func injectPath(t types.Type, seen map[types.Type]bool) ([]string, bool) {
+	if seen[t] {
+		return nil, false
+	}
+	seen[t] = true
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return nil, false
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		field := st.Field(i)
+		if !field.Embedded() {
+			continue
 		}
-
-		// Handle qualified names (for example, just Inject)
-		if typeIdent, ok := field.Type.(*ast.Ident); ok {
-			if typeIdent.Name == "Inject" {
-				return true
-			}
+		fieldType := field.Type()
+		if ptr, ok := fieldType.(*types.Pointer); ok {
+			fieldType = ptr.Elem()
+		}
+		name := types.TypeString(field.Type(), nil)
+		if isInject(fieldType) {
+			return []string{name}, true
+		}
+		if path, ok := injectPath(fieldType, seen); ok {
+			return append([]string{name}, path...), true
 		}
+	}
+	return nil, false
+}
 
-		// Handle pointer to a type (e.g., *Inject or *instance.Inject)
-		if typeSpec, ok := field.Type.(*ast.StarExpr); ok {
-			// If it's a pointer to a simple type (e.g., *Inject)
-			if ident, ok := typeSpec.X.(*ast.Ident); ok && ident.Name == "Inject" {
-				return true
-			}
-			// If it's a pointer to a qualified type (e.g., *instance.Inject)
-			if selExpr, ok := typeSpec.X.(*ast.SelectorExpr); ok {
-				pkgIdent, ok := selExpr.X.(*ast.Ident)
-				if ok && pkgIdent.Name == "in" && selExpr.Sel.Name == "Inject" {
-					return true
-				}
-			}
+// isInject checks if t is exactly instance.Inject, whatever name its package was imported as
+func isInject(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == instancePkgPath && obj.Name() == "Inject"
+}
+
+// dedupeModels sorts models by key and drops duplicates
+func dedupeModels(models []Model) []Model {
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Key() < models[j].Key()
+	})
+	deduped := models[:0]
+	for i, m := range models {
+		if i > 0 && m.Key() == models[i-1].Key() {
+			continue
 		}
+		deduped = append(deduped, m)
 	}
-	return false
+	return deduped
 }
 
 func collectGoDirs(baseDir string) ([]string, error) {
@@ -131,7 +194,11 @@ func collectGoDirs(baseDir string) ([]string, error) {
 			return err
 		}
 		if info.IsDir() {
-			if hasGoFiles(path) && !isExclude(path) {
+			rel, err := filepath.Rel(baseDir, path)
+			if err != nil {
+				return err
+			}
+			if hasGoFiles(path) && !isExclude(rel) {
 				goDirs = append(goDirs, path)
 			}
 		}
@@ -161,7 +228,8 @@ func isExclude(dir string) bool {
 		strings.HasPrefix(dir, "golang.org") {
 		return true
 	}
-	return false
+	// Like the go command, testdata directories are not part of the module
+	return slices.Contains(strings.Split(filepath.ToSlash(dir), "/"), "testdata")
 }
 
 func getGoModuleName(dir string) (string, error) {
@@ -0,0 +1,66 @@
+package hook
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverPackage(t *testing.T) {
+	const (
+		testdata = "github.com/DeimosTech/hookie/internal/hook/testdata/"
+		inject   = "github.com/DeimosTech/hookie/instance.Inject"
+	)
+	tests := []struct {
+		pkg  string
+		want []Model
+	}{
+		{
+			pkg: "models",
+			want: []Model{
+				{PkgPath: testdata + "models", Name: "Aliased", Reason: "embeds " + inject},
+				{PkgPath: testdata + "models", Name: "Base", Reason: "embeds " + inject},
+				{PkgPath: testdata + "models", Name: "Deep", Reason: "embeds *" + testdata + "models.Derived -> " + testdata + "models.Base -> " + inject},
+				{PkgPath: testdata + "models", Name: "Derived", Reason: "embeds " + testdata + "models.Base -> " + inject},
+				{PkgPath: testdata + "models", Name: "Pointer", Reason: "embeds *" + inject},
+			},
+		},
+		{
+			pkg: "generic",
+			want: []Model{
+				{PkgPath: testdata + "generic", Name: "Envelope", Reason: "embeds " + testdata + "generic.Page[int] -> " + inject},
+				{PkgPath: testdata + "generic", Name: "Page[" + testdata + "generic.Item]", Reason: "embeds " + inject},
+				{PkgPath: testdata + "generic", Name: "Page[int]", Reason: "embeds " + inject},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pkg, func(t *testing.T) {
+			got, err := discoverPackage(context.Background(), ".", testdata+tt.pkg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discoverPackage() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsExclude(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"models", false},
+		{"cmd/app", true},
+		{"internal/hook/testdata/models", true},
+		{"testdata", true},
+		{"testdatas", false},
+	}
+	for _, tt := range tests {
+		if got := isExclude(tt.dir); got != tt.want {
+			t.Errorf("isExclude(%s) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package registry holds the models registered for audit logging. It only depends on the standard library
+// and instance, so binaries look models up without linking the source scanner of hook, which only
+// hookie gen uses.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	in "github.com/DeimosTech/hookie/instance"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+var (
+	mu         sync.RWMutex
+	keys       = make(map[string]bool)
+	typeModels = make(map[reflect.Type]*in.ModelConfig)
+	// collections maps each collection to the type registered for it
+	collections = make(map[string]reflect.Type)
+)
+
+// ErrDuplicateCollection is returned by RegisterType when another type is registered for the collection
+var ErrDuplicateCollection = errors.New("hookie: collection is registered for another model")
+
+// injectType is the type models embed to be audited without being registered
+var injectType = reflect.TypeOf(in.Inject{})
+
+// RegisterGenerated registers the model keys, the package path followed by the type name, found by
+// hookie gen
+func RegisterGenerated(modelKeys ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range modelKeys {
+		keys[key] = true
+	}
+}
+
+// RegisterType registers the struct type of cfg for audit logging, replacing its previous registration.
+// A collection is only registered for one type.
+func RegisterType(cfg in.ModelConfig) error {
+	for cfg.Type.Kind() == reflect.Ptr {
+		cfg.Type = cfg.Type.Elem()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if owner, ok := collections[cfg.Collection]; ok && owner != cfg.Type {
+		return fmt.Errorf("%w: %s is registered for %s", ErrDuplicateCollection, owner, cfg.Collection)
+	}
+	if prev, ok := typeModels[cfg.Type]; ok {
+		delete(collections, prev.Collection)
+	}
+	typeModels[cfg.Type] = &cfg
+	if cfg.Collection != "" {
+		collections[cfg.Collection] = cfg.Type
+	}
+	return nil
+}
+
+// IsRegistered reports whether the struct type t is audited: registered by type, found by hookie gen,
+// or embedding in.Inject, directly or through other embedded structs
+func IsRegistered(t reflect.Type) bool {
+	mu.RLock()
+	_, typed := typeModels[t]
+	generated := keys[t.PkgPath()+t.Name()]
+	mu.RUnlock()
+	return typed || generated || embedsInject(t, make(map[reflect.Type]bool))
+}
+
+// embedsInject reports whether the struct type t embeds in.Inject, following embedded structs
+func embedsInject(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType == injectType || embedsInject(fieldType, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupType returns the config of the registered struct type t
+func LookupType(t reflect.Type) (*in.ModelConfig, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	cfg, ok := typeModels[t]
+	return cfg, ok
+}
+
+// LookupCollection returns the config of the model registered for collection col
+func LookupCollection(col string) (*in.ModelConfig, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := collections[col]
+	if !ok {
+		return nil, false
+	}
+	return typeModels[t], true
+}
+
+// Collections returns the collections of the registered models, sorted
+func Collections() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	cols := make([]string, 0, len(collections))
+	for col := range collections {
+		cols = append(cols, col)
+	}
+	slices.Sort(cols)
+	return cols
+}
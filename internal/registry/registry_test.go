@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"errors"
+	in "github.com/DeimosTech/hookie/instance"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type Inject struct{}
+
+type (
+	direct         struct{ in.Inject }
+	pointer        struct{ *in.Inject }
+	base           struct{ in.Inject }
+	derived        struct{ base }
+	generic[T any] struct {
+		in.Inject
+		Value T
+	}
+	lookalike struct{ Inject }
+	named     struct{ Inject in.Inject }
+	generated struct{}
+	typed     struct{}
+	plain     struct{}
+	cyclic    struct{ *cyclic }
+)
+
+func TestIsRegistered(t *testing.T) {
+	RegisterGenerated(reflect.TypeOf(generated{}).PkgPath() + "generated")
+	RegisterType(in.ModelConfig{Type: reflect.TypeOf(&typed{})})
+	tests := []struct {
+		model interface{}
+		want  bool
+	}{
+		{direct{}, true},
+		{pointer{}, true},
+		{derived{}, true},
+		{generic[int]{}, true},
+		{lookalike{}, false},
+		{named{}, false},
+		{generated{}, true},
+		{typed{}, true},
+		{plain{}, false},
+		{cyclic{}, false},
+	}
+	for _, tt := range tests {
+		modelType := reflect.TypeOf(tt.model)
+		t.Run(modelType.Name(), func(t *testing.T) {
+			if got := IsRegistered(modelType); got != tt.want {
+				t.Errorf("IsRegistered(%s) = %v, want %v", modelType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterTypeCollections(t *testing.T) {
+	type first struct{}
+	type second struct{}
+	steps := []struct {
+		name string
+		cfg  in.ModelConfig
+		err  error
+		want map[string]reflect.Type // owner of each collection after the step
+	}{
+		{
+			name: "first type",
+			cfg:  in.ModelConfig{Type: reflect.TypeOf(first{}), Collection: "a"},
+			want: map[string]reflect.Type{"a": reflect.TypeOf(first{})},
+		},
+		{
+			name: "collection of another type",
+			cfg:  in.ModelConfig{Type: reflect.TypeOf(second{}), Collection: "a"},
+			err:  ErrDuplicateCollection,
+			want: map[string]reflect.Type{"a": reflect.TypeOf(first{})},
+		},
+		{
+			name: "type moved to another collection",
+			cfg:  in.ModelConfig{Type: reflect.TypeOf(first{}), Collection: "b"},
+			want: map[string]reflect.Type{"a": nil, "b": reflect.TypeOf(first{})},
+		},
+		{
+			name: "freed collection",
+			cfg:  in.ModelConfig{Type: reflect.TypeOf(second{}), Collection: "a"},
+			want: map[string]reflect.Type{"a": reflect.TypeOf(second{}), "b": reflect.TypeOf(first{})},
+		},
+	}
+	for _, step := range steps {
+		if err := RegisterType(step.cfg); !errors.Is(err, step.err) {
+			t.Fatalf("%s: RegisterType() = %v, want %v", step.name, err, step.err)
+		}
+		for col, want := range step.want {
+			cfg, ok := LookupCollection(col)
+			if ok != (want != nil) || ok && cfg.Type != want {
+				t.Errorf("%s: LookupCollection(%s) = %v, %v, want %v", step.name, col, cfg, ok, want)
+			}
+		}
+	}
+	if got := Collections(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Collections() = %v, want [a b]", got)
+	}
+}
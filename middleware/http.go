@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	in "github.com/DeimosTech/hookie/instance"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RequestIDHeader is read for the id of incoming requests and set on responses
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIdLen is the length of the longest request id accepted from clients
+const maxRequestIdLen = 128
+
+type config struct {
+	actor         func(r *http.Request) (in.Actor, bool)
+	proxies       []netip.Prefix
+	hops          int
+	generateReqId bool
+}
+
+// Option configures the Audit middleware
+type Option func(*config)
+
+// WithActorFunc sets how the acting user is resolved from a request, usually from the authentication
+// already performed on it. Without it the actor can still be set later with in.WithActor.
+func WithActorFunc(f func(r *http.Request) (in.Actor, bool)) Option {
+	return func(c *config) {
+		c.actor = f
+	}
+}
+
+// WithTrustedProxies honors the X-Forwarded-For header of requests coming through proxies within the
+// given prefixes, such as netip.MustParsePrefix("10.0.0.0/8"). The client IP is the last address that is
+// not a trusted proxy, walking from the connection back through X-Forwarded-For.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(c *config) {
+		c.proxies = append(c.proxies, prefixes...)
+	}
+}
+
+// WithTrustedHops honors the X-Forwarded-For header set by the n proxies in front of the server, whatever
+// their addresses. The client IP is the address the farthest of them received the request from.
+func WithTrustedHops(n int) Option {
+	return func(c *config) {
+		c.hops = n
+	}
+}
+
+// IgnoreForwardedFor uses the address of the connection as the client IP, undoing WithTrustedProxies and
+// WithTrustedHops. X-Forwarded-For is ignored by default, as clients can set it to anything.
+func IgnoreForwardedFor() Option {
+	return func(c *config) {
+		c.proxies, c.hops = nil, 0
+	}
+}
+
+// WithoutRequestId leaves requests without an X-Request-Id header without a request id
+func WithoutRequestId() Option {
+	return func(c *config) {
+		c.generateReqId = false
+	}
+}
+
+// Audit stores the details of each request in its context, so the audit logs of writes made while
+// serving it record who made them and from where
+func Audit(next http.Handler, opts ...Option) http.Handler {
+	cfg := config{generateReqId: true}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := in.RequestInfo{
+			IPAddress: cfg.clientIP(r),
+			UserAgent: r.UserAgent(),
+			URL:       requestURL(r),
+			RequestID: r.Header.Get(RequestIDHeader),
+		}
+		if !validRequestId(info.RequestID) {
+			// Ids set by clients are echoed and recorded, only well formed ones are kept
+			info.RequestID = ""
+		}
+		if info.RequestID == "" && cfg.generateReqId {
+			info.RequestID = newRequestId()
+		}
+		if info.RequestID != "" {
+			w.Header().Set(RequestIDHeader, info.RequestID)
+		}
+		ctx := in.WithRequestInfo(r.Context(), info)
+		if cfg.actor != nil {
+			if actor, ok := cfg.actor(r); ok {
+				ctx = in.WithActor(ctx, actor)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the address of the client: the connection address, unless it is a trusted proxy, in
+// which case the X-Forwarded-For entries the trusted proxies appended are skipped
+func (c *config) clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if len(c.proxies) == 0 && c.hops <= 0 {
+		return remote
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if c.hops > 0 {
+		// The connection comes from the nearest proxy, the others appended the last hops-1 entries
+		if len(hops) < c.hops {
+			return remote
+		}
+		if _, err := netip.ParseAddr(hops[len(hops)-c.hops]); err != nil {
+			return remote
+		}
+		return hops[len(hops)-c.hops]
+	}
+	if !c.trusted(remote) {
+		return remote
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(hops[i]); err != nil {
+			// A malformed entry was not appended by a trusted proxy, the last trusted address is kept
+			return client
+		}
+		client = hops[i]
+		if !c.trusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+// trusted reports whether addr is within the trusted proxies
+func (c *config) trusted(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range c.proxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validRequestId reports whether id is short and only made of letters, digits, '-', '_', '.' and ':'
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestURL rebuilds the absolute URL of the request without its query, which often carries tokens or
+// personal data that must not end up in audit storage
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	in "github.com/DeimosTech/hookie/instance"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAuditClientIP(t *testing.T) {
+	proxies := WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.1/32"))
+	tests := []struct {
+		name   string
+		opts   []Option
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"forwarded for ignored by default", nil, "203.0.113.7:1234", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"untrusted connection", []Option{proxies}, "203.0.113.7:1234", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"trusted proxy", []Option{proxies}, "10.0.0.2:1234", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"forged leftmost entry", []Option{proxies}, "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.9"}, "198.51.100.9"},
+		{"chain of trusted proxies", []Option{proxies}, "10.0.0.2:1234", []string{"198.51.100.9, 192.168.1.1", "10.0.0.3"}, "198.51.100.9"},
+		{"malformed entry", []Option{proxies}, "10.0.0.2:1234", []string{"not an ip, 10.0.0.3"}, "10.0.0.3"},
+		{"every hop trusted", []Option{proxies}, "10.0.0.2:1234", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"trusted hops", []Option{WithTrustedHops(2)}, "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.9, 172.16.0.1"}, "198.51.100.9"},
+		{"fewer hops than trusted", []Option{WithTrustedHops(2)}, "10.0.0.2:1234", []string{"1.2.3.4"}, "10.0.0.2"},
+		{"ignored again", []Option{proxies, IgnoreForwardedFor()}, "10.0.0.2:1234", []string{"198.51.100.9"}, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := Audit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info, _ := in.RequestInfoFrom(r.Context())
+				got = info.IPAddress
+			}), tt.opts...)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditRequestId(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		keep     bool
+		generate bool
+	}{
+		{"well formed id", "req-42_a.b:c", true, true},
+		{"missing id", "", false, true},
+		{"too long", strings.Repeat("a", maxRequestIdLen+1), false, true},
+		{"header injection", "abc\r\nSet-Cookie: x", false, true},
+		{"spaces", "a b", false, true},
+		{"not generated", "a b", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if !tt.generate {
+				opts = append(opts, WithoutRequestId())
+			}
+			var got string
+			handler := Audit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info, _ := in.RequestInfoFrom(r.Context())
+				got = info.RequestID
+			}), opts...)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header[RequestIDHeader] = []string{tt.header}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			switch {
+			case tt.keep && got != tt.header:
+				t.Errorf("request id = %q, want %q", got, tt.header)
+			case !tt.keep && got == tt.header && got != "":
+				t.Errorf("request id %q was kept", got)
+			case !tt.keep && tt.generate && !validRequestId(got):
+				t.Errorf("generated request id %q is not valid", got)
+			case !tt.generate && got != "":
+				t.Errorf("request id = %q, want none", got)
+			}
+			if echoed := w.Header().Get(RequestIDHeader); echoed != got {
+				t.Errorf("response request id = %q, want %q", echoed, got)
+			}
+		})
+	}
+}
+
+func TestAuditURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"path", "http://example.com/users/7", "http://example.com/users/7"},
+		{"query left out", "http://example.com/reset?token=s3cret&email=a%40example.com", "http://example.com/reset"},
+		{"fragment and empty query", "http://example.com/a?#top", "http://example.com/a"},
+		{"escaped path", "http://example.com/files/a%2Fb%3Fc", "http://example.com/files/a%2Fb%3Fc"},
+		{"host only", "http://example.com?q=1", "http://example.com/"},
+		{"https", "https://example.com:8443/login?password=p", "https://example.com:8443/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := Audit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info, _ := in.RequestInfoFrom(r.Context())
+				got = info.URL
+			}))
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("URL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
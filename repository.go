@@ -0,0 +1,274 @@
+package hookie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DeimosTech/hookie/db"
+	in "github.com/DeimosTech/hookie/instance"
+	"github.com/DeimosTech/hookie/internal/registry"
+	"go.mongodb.org/mongo-driver/bson"
+	"iter"
+	"reflect"
+)
+
+// ErrNoCollection is returned by NewRepository when the collection of the model is not known
+var ErrNoCollection = errors.New("hookie: no collection for model, register it with WithCollection or implement CollectionName")
+
+// CollectionNamer is implemented by models naming their own collection
+type CollectionNamer interface {
+	CollectionName() string
+}
+
+// Repository reads and writes the documents of the model T through a db.NoSql, running its hooks
+type Repository[T any] struct {
+	store db.NoSql
+	col   string
+}
+
+// NewRepository returns a repository of T over store. The collection is the one T was registered with,
+// else the one named by its CollectionName method. T is registered for audit logging when it is not yet.
+func NewRepository[T any](store db.NoSql) (*Repository[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	cfg, registered := registry.LookupType(t)
+	var col string
+	if registered {
+		col = cfg.Collection
+	}
+	if col == "" {
+		if namer, ok := reflect.New(t).Interface().(CollectionNamer); ok {
+			col = namer.CollectionName()
+		}
+	}
+	if col == "" {
+		return nil, fmt.Errorf("%w %s", ErrNoCollection, t)
+	}
+	if !registered && !registry.IsRegistered(t) {
+		if err := registry.RegisterType(in.ModelConfig{Type: t, Collection: col}); err != nil {
+			return nil, err
+		}
+	}
+	return &Repository[T]{store: store, col: col}, nil
+}
+
+// Collection returns the collection of the repository
+func (r *Repository[T]) Collection() string {
+	return r.col
+}
+
+// FindOption configures Find and All
+type FindOption func(*findOptions)
+
+type findOptions struct {
+	skip, limit int64
+	sort        interface{}
+	batch       int64
+}
+
+// Skip skips the first n documents found
+func Skip(n int64) FindOption {
+	return func(o *findOptions) {
+		o.skip = n
+	}
+}
+
+// Limit returns at most n documents
+func Limit(n int64) FindOption {
+	return func(o *findOptions) {
+		o.limit = n
+	}
+}
+
+// SortBy orders the documents found, such as bson.D{{Key: "name", Value: 1}}. All always iterates in _id order.
+func SortBy(sort interface{}) FindOption {
+	return func(o *findOptions) {
+		o.sort = sort
+	}
+}
+
+// BatchSize sets the number of documents All reads at a time, 100 by default
+func BatchSize(n int64) FindOption {
+	return func(o *findOptions) {
+		if n > 0 {
+			o.batch = n
+		}
+	}
+}
+
+func newFindOptions(opts []FindOption) findOptions {
+	o := findOptions{batch: 100}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Get returns the document with the given _id, or db.ErrNotFound
+func (r *Repository[T]) Get(ctx context.Context, id interface{}) (*T, error) {
+	return r.FindOne(ctx, bson.M{"_id": id})
+}
+
+// FindOne returns the first document matching filter, or db.ErrNotFound
+func (r *Repository[T]) FindOne(ctx context.Context, filter interface{}, opts ...FindOption) (*T, error) {
+	o := newFindOptions(opts)
+	var doc T
+	var err error
+	if o.sort != nil {
+		err = r.store.FindOne(ctx, r.col, orAll(filter), &doc, o.sort)
+	} else {
+		err = r.store.FindOne(ctx, r.col, orAll(filter), &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Find returns the documents matching filter
+func (r *Repository[T]) Find(ctx context.Context, filter interface{}, opts ...FindOption) ([]T, error) {
+	o := newFindOptions(opts)
+	var docs []T
+	var err error
+	if o.sort != nil {
+		err = r.store.List(ctx, r.col, orAll(filter), o.skip, o.limit, &docs, o.sort)
+	} else {
+		err = r.store.List(ctx, r.col, orAll(filter), o.skip, o.limit, &docs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// All iterates over the documents matching filter in _id order, reading them in batches. Documents
+// inserted while iterating are seen when their _id sorts after the current one. Skip and Limit apply to
+// the documents iterated, SortBy is ignored.
+func (r *Repository[T]) All(ctx context.Context, filter interface{}, opts ...FindOption) iter.Seq2[T, error] {
+	o := newFindOptions(opts)
+	return func(yield func(T, error) bool) {
+		var (
+			zero    T
+			last    interface{}
+			skip    = o.skip
+			yielded int64
+		)
+		for {
+			size := o.batch
+			if o.limit > 0 && o.limit-yielded < size {
+				size = o.limit - yielded
+			}
+			page := orAll(filter)
+			if last != nil {
+				page = bson.M{"$and": bson.A{page, bson.M{"_id": bson.M{"$gt": last}}}}
+			}
+			var (
+				docs []T
+				read db.Page
+			)
+			err := r.store.List(db.WithPage(ctx, &read), r.col, page, skip, size, &docs, bson.D{{Key: "_id", Value: 1}})
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			for _, doc := range docs {
+				if !yield(doc, nil) {
+					return
+				}
+			}
+			yielded += int64(len(docs))
+			if !read.Recorded {
+				// Stores that do not record pages are paged on the documents returned
+				read.Read = int64(len(docs))
+				if len(docs) > 0 {
+					if read.LastId, err = idOf(docs[len(docs)-1]); err != nil {
+						yield(zero, err)
+						return
+					}
+				}
+			}
+			// Pages are only short at the end, documents dropped by PostFind hooks do not shorten them
+			if read.Read == 0 || read.Read < size || (o.limit > 0 && yielded >= o.limit) {
+				return
+			}
+			if read.LastId == nil {
+				yield(zero, fmt.Errorf("%w: document has no _id", db.ErrInvalidData))
+				return
+			}
+			last, skip = read.LastId, 0
+		}
+	}
+}
+
+// Count returns the number of documents matching filter
+func (r *Repository[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.store.Count(ctx, r.col, orAll(filter))
+}
+
+// Insert inserts doc
+func (r *Repository[T]) Insert(ctx context.Context, doc T) error {
+	return r.store.Insert(ctx, r.col, doc)
+}
+
+// InsertMany inserts docs
+func (r *Repository[T]) InsertMany(ctx context.Context, docs []T) error {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		values[i] = doc
+	}
+	return r.store.InsertMany(ctx, r.col, values)
+}
+
+// Update sets the fields of doc on the first document matching filter. For models registered with
+// WithVersionField, a stale version returns a *db.ConflictError.
+func (r *Repository[T]) Update(ctx context.Context, filter interface{}, doc T) error {
+	return r.store.Update(ctx, r.col, filter, doc)
+}
+
+// Patch sets fields, keyed by their stored name or dotted path, on every document matching filter
+func (r *Repository[T]) Patch(ctx context.Context, filter interface{}, fields map[string]interface{}) error {
+	return r.store.PartialUpdateMany(ctx, r.col, orAll(filter), bson.M(fields))
+}
+
+// Delete deletes the document with the given _id, or returns db.ErrNotFound
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	return r.store.DeleteOne(ctx, r.col, bson.M{"_id": id})
+}
+
+// Restore undoes the soft delete of the document with the given _id
+func (r *Repository[T]) Restore(ctx context.Context, id interface{}) error {
+	return db.Restore(ctx, r.store, r.col, bson.M{"_id": id})
+}
+
+// DeleteMany deletes every document matching filter
+func (r *Repository[T]) DeleteMany(ctx context.Context, filter interface{}) error {
+	return r.store.DeleteMany(ctx, r.col, orAll(filter))
+}
+
+// orAll returns filter, or a filter matching every document when it is nil
+func orAll(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.M{}
+	}
+	return filter
+}
+
+// idOf returns the _id doc is stored with
+func idOf(doc interface{}) (interface{}, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var id struct {
+		Id interface{} `bson:"_id"`
+	}
+	if err = bson.Unmarshal(data, &id); err != nil {
+		return nil, err
+	}
+	if id.Id == nil {
+		return nil, fmt.Errorf("%w: document has no _id", db.ErrInvalidData)
+	}
+	return id.Id, nil
+}
@@ -0,0 +1,347 @@
+package hookie
+
+import (
+	"context"
+	"errors"
+	"github.com/DeimosTech/hookie/db"
+	"github.com/DeimosTech/hookie/db/memory"
+	"github.com/DeimosTech/hookie/hooks"
+	in "github.com/DeimosTech/hookie/instance"
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type item struct {
+	Id   int    `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func (item) CollectionName() string {
+	return "repository_items"
+}
+
+// hiddenItem is dropped from reads when its _id is a multiple of 3
+type hiddenItem struct {
+	Id int `bson:"_id"`
+}
+
+func (hiddenItem) CollectionName() string {
+	return "repository_hidden"
+}
+
+func (h *hiddenItem) PostFind(ctx context.Context, doc interface{}, filter interface{}, col, ops string) error {
+	if h.Id%3 == 0 {
+		return in.ErrDropResult
+	}
+	return nil
+}
+
+type softItem struct {
+	Id        int        `bson:"_id"`
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+}
+
+type versionedItem struct {
+	Id      int    `bson:"_id"`
+	Name    string `bson:"name"`
+	Version int64  `bson:"version"`
+}
+
+func init() {
+	Register[item]()
+	Register[hiddenItem]()
+	Register[softItem](WithCollection("repository_soft"), WithSoftDelete())
+	Register[versionedItem](WithCollection("repository_versioned"), WithVersionField("version"))
+}
+
+func idsOf[T any](t *testing.T, seq func(func(T, error) bool)) []int {
+	t.Helper()
+	var ids []int
+	for doc, err := range seq {
+		if err != nil {
+			t.Fatalf("All: %v", err)
+		}
+		id, err := idOf(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, int(id.(int32)))
+	}
+	return ids
+}
+
+func TestRepositoryCRUD(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository[item](memory.New())
+	if err != nil {
+		t.Fatalf("NewRepository: %v", err)
+	}
+	if repo.Collection() != "repository_items" {
+		t.Fatalf("Collection() = %s, want repository_items", repo.Collection())
+	}
+	if err = repo.InsertMany(ctx, []item{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}, {Id: 3, Name: "c"}}); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	if err = repo.Update(ctx, bson.M{"_id": 1}, item{Id: 1, Name: "z"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err = repo.Patch(ctx, bson.M{"_id": 2}, map[string]interface{}{"name": "y"}); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	if err = repo.Delete(ctx, 3); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	got, err := repo.Find(ctx, nil, SortBy(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	want := []item{{Id: 2, Name: "y"}, {Id: 1, Name: "z"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Find() = %v, want %v", got, want)
+	}
+	if n, err := repo.Count(ctx, nil); err != nil || n != 2 {
+		t.Errorf("Count() = %d, %v, want 2", n, err)
+	}
+	if _, err = repo.Get(ctx, 3); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get of a deleted document returned %v, want db.ErrNotFound", err)
+	}
+}
+
+func TestRepositoryAll(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	items, err := NewRepository[item](store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := NewRepository[hiddenItem](store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 10; id++ {
+		if err = items.Insert(ctx, item{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err = hidden.Insert(ctx, hiddenItem{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		seq  func() []int
+		want []int
+	}{
+		{
+			name: "every document in batches",
+			seq:  func() []int { return idsOf(t, items.All(ctx, nil, BatchSize(3))) },
+			want: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		{
+			name: "batch dividing the documents",
+			seq:  func() []int { return idsOf(t, items.All(ctx, nil, BatchSize(5))) },
+			want: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		{
+			name: "filter",
+			seq:  func() []int { return idsOf(t, items.All(ctx, bson.M{"_id": bson.M{"$gt": 6}}, BatchSize(2))) },
+			want: []int{7, 8, 9, 10},
+		},
+		{
+			name: "skip and limit",
+			seq:  func() []int { return idsOf(t, items.All(ctx, nil, Skip(2), Limit(5), BatchSize(3))) },
+			want: []int{3, 4, 5, 6, 7},
+		},
+		{
+			name: "documents dropped by PostFind",
+			seq:  func() []int { return idsOf(t, hidden.All(ctx, nil, BatchSize(3))) },
+			want: []int{1, 2, 4, 5, 7, 8, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.seq(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("All() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepositoryVersionedUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	repo, err := NewRepository[versionedItem](store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		update   func(id int) error
+		conflict bool
+		want     int64 // stored version after the update
+	}{
+		{
+			name:   "struct at version 0 is not checked",
+			update: func(id int) error { return repo.Update(ctx, bson.M{"_id": id}, versionedItem{Id: id, Name: "b"}) },
+			want:   4,
+		},
+		{
+			name: "current version",
+			update: func(id int) error {
+				return repo.Update(ctx, bson.M{"_id": id}, versionedItem{Id: id, Name: "b", Version: 3})
+			},
+			want: 4,
+		},
+		{
+			name: "stale version",
+			update: func(id int) error {
+				return repo.Update(ctx, bson.M{"_id": id}, versionedItem{Id: id, Name: "b", Version: 2})
+			},
+			conflict: true,
+			want:     3,
+		},
+		{
+			name: "version 0 set explicitly",
+			update: func(id int) error {
+				return store.Update(ctx, repo.Collection(), bson.M{"_id": id}, bson.M{"name": "b", "version": 0})
+			},
+			conflict: true,
+			want:     3,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := repo.Insert(ctx, versionedItem{Id: i, Name: "a", Version: 3}); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.update(i)
+			if got := errors.Is(err, db.ErrVersionConflict); got != tt.conflict {
+				t.Fatalf("Update() = %v, want conflict %v", err, tt.conflict)
+			}
+			if !tt.conflict && err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			doc, err := repo.Get(ctx, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Version != tt.want {
+				t.Errorf("stored version = %d, want %d", doc.Version, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepositorySoftDelete(t *testing.T) {
+	ctx := context.Background()
+	audit := memory.New()
+	store := memory.New(hooks.NewDefaultHookWithStore(audit))
+	repo, err := NewRepository[softItem](store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.InsertMany(ctx, []softItem{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{2, 3, 4} {
+		if err = repo.Delete(ctx, id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if err = repo.Restore(ctx, 3); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if err = repo.Delete(db.WithHardDelete(ctx), 4); err != nil {
+		t.Fatalf("hard Delete: %v", err)
+	}
+
+	ids := func(t *testing.T, ctx context.Context) []int {
+		docs, err := repo.Find(ctx, nil, SortBy(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		var ids []int
+		for _, doc := range docs {
+			ids = append(ids, doc.Id)
+		}
+		return ids
+	}
+	tests := []struct {
+		name string
+		got  func(t *testing.T) interface{}
+		want interface{}
+	}{
+		{
+			name: "find",
+			got:  func(t *testing.T) interface{} { return ids(t, ctx) },
+			want: []int{1, 3},
+		},
+		{
+			name: "find with deleted",
+			got:  func(t *testing.T) interface{} { return ids(t, db.WithDeleted(ctx)) },
+			want: []int{1, 2, 3},
+		},
+		{
+			name: "find only deleted",
+			got:  func(t *testing.T) interface{} { return ids(t, db.OnlyDeleted(ctx)) },
+			want: []int{2},
+		},
+		{
+			name: "count",
+			got: func(t *testing.T) interface{} {
+				n, err := repo.Count(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return n
+			},
+			want: int64(2),
+		},
+		{
+			name: "get deleted",
+			got: func(t *testing.T) interface{} {
+				_, err := repo.Get(ctx, 2)
+				return errors.Is(err, db.ErrNotFound)
+			},
+			want: true,
+		},
+		{
+			name: "aggregate",
+			got: func(t *testing.T) interface{} {
+				var docs []bson.M
+				if err := store.Aggregate(ctx, repo.Collection(), []interface{}{bson.M{"$sort": bson.M{"_id": 1}}}, &docs); err != nil {
+					t.Fatal(err)
+				}
+				return len(docs)
+			},
+			want: 2,
+		},
+		{
+			name: "audit events",
+			got: func(t *testing.T) interface{} {
+				var events []string
+				for _, id := range []string{"2", "3", "4"} {
+					versions, err := hooks.NewHistory(audit).Versions(ctx, id)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, v := range versions[1:] {
+						events = append(events, id+" "+v.Event)
+					}
+				}
+				return events
+			},
+			want: []string{"2 soft_delete", "3 soft_delete", "3 restore", "4 soft_delete", "4 delete"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got(t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}